@@ -0,0 +1,540 @@
+package sniper
+
+import (
+	"encoding/binary"
+	"hash/crc32"
+	"io"
+	"os"
+	"sort"
+)
+
+// batch operations
+const (
+	opSet    = 1
+	opDelete = 2
+	opIncr   = 3
+	// bucket index operations: key is bucket name, val is key in bucket
+	opBucketPut    = 5
+	opBucketDelete = 6
+)
+
+// key states in chunk
+const (
+	keyAbsent = iota
+	keySame
+	keyOther // hash taken by other key
+)
+
+// maxRecordSize - maximum size of record in batch log
+const maxRecordSize = 1 << 30
+
+var crcTable = crc32.MakeTable(crc32.Castagnoli)
+
+// batchOp - operation in batch
+type batchOp struct {
+	op     byte
+	key    []byte
+	val    []byte
+	expire uint32
+	delta  uint64
+	chunk  int // chunk, resolved by Write
+}
+
+// Batch - set of operations, applied atomically by Store.Write
+type Batch struct {
+	ops []batchOp
+}
+
+// Set - add set operation to batch
+func (b *Batch) Set(k, v []byte, expire uint32) {
+	b.ops = append(b.ops, batchOp{op: opSet, key: append([]byte{}, k...), val: append([]byte{}, v...), expire: expire})
+}
+
+// Delete - add delete operation to batch
+func (b *Batch) Delete(k []byte) {
+	b.ops = append(b.ops, batchOp{op: opDelete, key: append([]byte{}, k...)})
+}
+
+// Incr - add incr operation to batch
+func (b *Batch) Incr(k []byte, v uint64) {
+	b.ops = append(b.ops, batchOp{op: opIncr, key: append([]byte{}, k...), delta: v})
+}
+
+// Len return count of operations in batch
+func (b *Batch) Len() int {
+	return len(b.ops)
+}
+
+// Reset - remove all operations from batch
+func (b *Batch) Reset() {
+	b.ops = b.ops[:0]
+}
+
+// encodeOps - serialize resolved operations
+func encodeOps(ops []batchOp) []byte {
+	var l [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(l[:], uint64(len(ops)))
+	b := append([]byte{}, l[:n]...)
+	for _, op := range ops {
+		b = append(b, op.op)
+		n = binary.PutUvarint(l[:], uint64(op.chunk))
+		b = append(b, l[:n]...)
+		n = binary.PutUvarint(l[:], uint64(len(op.key)))
+		b = append(b, l[:n]...)
+		b = append(b, op.key...)
+		if op.op == opSet || isBucketOp(op.op) {
+			n = binary.PutUvarint(l[:], uint64(len(op.val)))
+			b = append(b, l[:n]...)
+			b = append(b, op.val...)
+		}
+		if op.op == opSet || op.op == opTouch {
+			b = appendUint32(b, op.expire)
+		}
+	}
+	return b
+}
+
+// decodeOps - deserialize operations, encoded with encodeOps
+func decodeOps(b []byte) (ops []batchOp, err error) {
+	next := func() (uint64, error) {
+		v, n := binary.Uvarint(b)
+		if n <= 0 {
+			return 0, ErrFormat
+		}
+		b = b[n:]
+		return v, nil
+	}
+	take := func(l uint64) ([]byte, error) {
+		if uint64(len(b)) < l {
+			return nil, ErrFormat
+		}
+		v := b[:l]
+		b = b[l:]
+		return v, nil
+	}
+	cnt, err := next()
+	if err != nil {
+		return
+	}
+	for i := uint64(0); i < cnt; i++ {
+		var op batchOp
+		if len(b) == 0 {
+			return nil, ErrFormat
+		}
+		op.op = b[0]
+		b = b[1:]
+		chunk, err := next()
+		if err != nil {
+			return nil, err
+		}
+		op.chunk = int(chunk)
+		l, err := next()
+		if err != nil {
+			return nil, err
+		}
+		op.key, err = take(l)
+		if err != nil {
+			return nil, err
+		}
+		switch op.op {
+		case opSet, opBucketPut, opBucketDelete:
+			l, err = next()
+			if err != nil {
+				return nil, err
+			}
+			op.val, err = take(l)
+			if err != nil {
+				return nil, err
+			}
+		case opDelete, opTouch:
+		default:
+			return nil, ErrFormat
+		}
+		if op.op == opSet || op.op == opTouch {
+			if len(b) < 4 {
+				return nil, ErrFormat
+			}
+			op.expire = readUint32(b)
+			b = b[4:]
+		}
+		ops = append(ops, op)
+	}
+	return
+}
+
+// frameRecord - prepend payload with length and checksum
+func frameRecord(payload []byte) []byte {
+	b := make([]byte, 0, 8+len(payload))
+	b = appendUint32(b, uint32(len(payload)))
+	b = appendUint32(b, crc32.Checksum(payload, crcTable))
+	return append(b, payload...)
+}
+
+// readRecord - read record, framed with frameRecord
+// return io.EOF if no more records and ErrFormat on damaged record
+func readRecord(r io.Reader) (payload []byte, err error) {
+	head := make([]byte, 8)
+	n, err := io.ReadFull(r, head)
+	if err != nil {
+		if n == 0 && err == io.EOF {
+			return nil, io.EOF
+		}
+		return nil, ErrFormat
+	}
+	size := readUint32(head)
+	if size > maxRecordSize {
+		return nil, ErrFormat
+	}
+	payload = make([]byte, size)
+	_, err = io.ReadFull(r, payload)
+	if err != nil {
+		return nil, ErrFormat
+	}
+	if crc32.Checksum(payload, crcTable) != readUint32(head[4:]) {
+		return nil, ErrFormat
+	}
+	return
+}
+
+// keyState return keyAbsent if chunk has no key hash,
+// keySame if hash belong to key, keyOther on collision
+func (c *chunk) keyState(k []byte, h uint32) (int, error) {
+	meta, ok := c.m[h]
+	if !ok {
+		return keyAbsent, nil
+	}
+	addr, size, _ := decodeKeyMeta(meta)
+	packet, err := c.read_packet(addr, size)
+	if err == ErrCorrupted {
+		// damaged record will be overwritten
+		return keySame, nil
+	}
+	if err != nil {
+		return keyAbsent, err
+	}
+	_, key, _ := packetUnmarshal(packet)
+	if string(key) != string(k) {
+		return keyOther, nil
+	}
+	return keySame, nil
+}
+
+// chunkHash - hash in chunk
+type chunkHash struct {
+	chunk int
+	h     uint32
+}
+
+// batchChunks return sorted chunks, touched by batch
+// collision chunks are always included
+func (s *Store) batchChunks(ops []batchOp) []int {
+	set := make(map[int]bool)
+	for i := 0; i < s.chunkColCnt; i++ {
+		set[i] = true
+	}
+	for _, op := range ops {
+		if isBucketOp(op.op) {
+			continue
+		}
+		set[int(s.idx(hash(op.key)))] = true
+	}
+	idxs := make([]int, 0, len(set))
+	for i := range set {
+		idxs = append(idxs, i)
+	}
+	sort.Ints(idxs)
+	return idxs
+}
+
+// candidates return chunks, which may hold key: main chunk and collision chunks
+func (s *Store) candidates(h uint32) []int {
+	idxs := make([]int, 0, s.chunkColCnt+1)
+	idxs = append(idxs, int(s.idx(h)))
+	for i := 0; i < s.chunkColCnt; i++ {
+		idxs = append(idxs, i)
+	}
+	return idxs
+}
+
+// resolveOps turn Incr to Set and choose chunk for every operation,
+// same way as Set and Delete do. Chunks must be locked
+func (s *Store) resolveOps(ops []batchOp) (resolved []batchOp, err error) {
+	type pending struct {
+		val    []byte
+		expire uint32
+	}
+	// values, written by previous operations in batch, nil - deleted
+	overlay := make(map[string]*pending)
+	// hashes, claimed by previous operations in batch
+	owners := make(map[chunkHash]string)
+
+	state := func(i int, k []byte, h uint32) (int, error) {
+		if owner, ok := owners[chunkHash{i, h}]; ok {
+			if owner == string(k) {
+				return keySame, nil
+			}
+			return keyOther, nil
+		}
+		return s.chunks[i].keyState(k, h)
+	}
+
+	resolved = make([]batchOp, 0, len(ops))
+	for _, op := range ops {
+		if isBucketOp(op.op) {
+			resolved = append(resolved, op)
+			continue
+		}
+		h := hash(op.key)
+		if op.op == opIncr {
+			var old []byte
+			expire := uint32(0)
+			if p, ok := overlay[string(op.key)]; ok {
+				if p != nil {
+					old, expire = p.val, p.expire
+				}
+			} else {
+				for _, i := range s.candidates(h) {
+					var header *Header
+					old, header, err = s.chunks[i].load_key(op.key, h)
+					if err == ErrCollision || err == ErrNotFound {
+						continue
+					}
+					if err != nil {
+						return
+					}
+					expire = header.expire
+					break
+				}
+				err = nil
+			}
+			// counter is 8 bytes big endian, same as for Store.Incr
+			n := uint64(0)
+			if old != nil {
+				n, err = parseUint(old)
+				if err != nil {
+					return
+				}
+			}
+			val := binaryUint(n + op.delta)
+			op = batchOp{op: opSet, key: op.key, val: val, expire: expire}
+		}
+
+		op.chunk = -1
+		switch op.op {
+		case opSet:
+			for _, i := range s.candidates(h) {
+				st, errState := state(i, op.key, h)
+				if errState != nil {
+					return nil, errState
+				}
+				if st != keyOther {
+					op.chunk = i
+					break
+				}
+			}
+			if op.chunk < 0 {
+				return nil, ErrCollision
+			}
+			owners[chunkHash{op.chunk, h}] = string(op.key)
+			overlay[string(op.key)] = &pending{val: op.val, expire: op.expire}
+		case opDelete:
+			for _, i := range s.candidates(h) {
+				st, errState := state(i, op.key, h)
+				if errState != nil {
+					return nil, errState
+				}
+				if st == keyAbsent {
+					break
+				}
+				if st == keySame {
+					op.chunk = i
+					break
+				}
+			}
+			overlay[string(op.key)] = nil
+			if op.chunk < 0 {
+				// nothing to delete
+				continue
+			}
+		}
+		resolved = append(resolved, op)
+	}
+	return
+}
+
+// applyOps write resolved operations in chunks. Chunks must be locked
+func (s *Store) applyOps(ops []batchOp) (err error) {
+	for _, op := range ops {
+		if isBucketOp(op.op) {
+			err = s.applyBucketOp(op)
+			if err != nil {
+				return
+			}
+			continue
+		}
+		if op.chunk < 0 || op.chunk >= len(s.chunks) {
+			return ErrFormat
+		}
+		c := &s.chunks[op.chunk]
+		h := hash(op.key)
+		switch op.op {
+		case opSet:
+			err = c.write_key(op.key, op.val, h, op.expire, 0)
+		case opDelete:
+			_, err = c.delete_key(op.key, h)
+		}
+		if err != nil {
+			return
+		}
+	}
+	return
+}
+
+// Write apply all operations from batch atomically:
+// all operations become visible at once or none of them
+// batch is stored in batch log (or write ahead log, if enabled)
+// before apply, so batch interrupted by crash will be finished on next Open
+func (s *Store) Write(b *Batch) (err error) {
+	_, err = s.write(b.ops)
+	return
+}
+
+// write apply operations atomically and return resolved operations
+func (s *Store) write(batch []batchOp) (ops []batchOp, err error) {
+	err = s.writable()
+	if err != nil {
+		return
+	}
+	if len(batch) == 0 {
+		return
+	}
+	s.RLock()
+	defer s.RUnlock()
+	if s.wal != nil {
+		s.wal.ckpt.RLock()
+		defer s.wal.ckpt.RUnlock()
+	}
+	s.batchMu.Lock()
+	defer s.batchMu.Unlock()
+
+	idxs := s.batchChunks(batch)
+	for _, i := range idxs {
+		s.chunks[i].Lock()
+	}
+	defer func() {
+		for _, i := range idxs {
+			s.chunks[i].Unlock()
+		}
+	}()
+
+	ops, err = s.resolveOps(batch)
+	if err != nil || len(ops) == 0 {
+		return
+	}
+	if s.wal != nil {
+		// batch is one record in write ahead log
+		err = s.wal.append(ops)
+		if err != nil {
+			return
+		}
+		err = s.rollForward(ops)
+		return
+	}
+	_, err = s.batchf.WriteAt(frameRecord(encodeOps(ops)), 0)
+	if err != nil {
+		return
+	}
+	err = s.batchf.Sync()
+	if err != nil {
+		return
+	}
+	err = s.rollForward(ops)
+	if err != nil {
+		return
+	}
+	// batch must be on disk before log truncate
+	for _, i := range idxs {
+		c := &s.chunks[i]
+		if c.needFsync {
+			c.needFsync = false
+			err = c.sync()
+			if err != nil {
+				// batch in log must not be overwritten by next batch
+				err = s.fail(err)
+				return
+			}
+		}
+	}
+	err = s.syncBuckets()
+	if err == nil {
+		err = s.batchf.Truncate(0)
+	}
+	if err == nil {
+		err = s.batchf.Sync()
+	}
+	if err != nil {
+		err = s.fail(err)
+	}
+	return
+}
+
+// rollForward apply logged operations, operation may be applied again,
+// so failed apply is repeated once. If it fail again, store is put in failed
+// state: batch stay in log and will be finished on next Open, other writes
+// are refused, so they can't overwrite log or be overwritten on replay
+func (s *Store) rollForward(ops []batchOp) (err error) {
+	err = s.applyOps(ops)
+	if err == nil {
+		return
+	}
+	err = s.applyOps(ops)
+	if err != nil {
+		err = s.fail(err)
+	}
+	return
+}
+
+// openBatchLog open batch log and finish batch, interrupted by crash
+// batch with damaged record was not applied and will be dropped
+func (s *Store) openBatchLog() (err error) {
+	s.batchf, err = s.fs.OpenFile(s.filename("batch.log"), os.O_CREATE|os.O_RDWR, os.FileMode(fileMode))
+	if err != nil {
+		return
+	}
+	payload, err := readRecord(s.batchf)
+	if err == io.EOF {
+		return nil
+	}
+	if err == nil {
+		var ops []batchOp
+		ops, err = decodeOps(payload)
+		if err != nil {
+			return
+		}
+		for i := range s.chunks {
+			s.chunks[i].Lock()
+		}
+		err = s.applyOps(ops)
+		for i := range s.chunks {
+			s.chunks[i].Unlock()
+		}
+		if err != nil {
+			return
+		}
+		for i := range s.chunks {
+			err = s.chunks[i].fsync()
+			if err != nil {
+				return
+			}
+		}
+		err = s.syncBuckets()
+		if err != nil {
+			return
+		}
+	}
+	err = s.batchf.Truncate(0)
+	if err != nil {
+		return
+	}
+	return s.batchf.Sync()
+}
@@ -67,7 +67,7 @@ func sniperBench(keys [][]byte, N int) {
 	lotsa.Ops(N, runtime.NumCPU(), func(i, _ int) {
 		b := make([]byte, 8)
 		binary.BigEndian.PutUint64(b, uint64(i))
-		err := s.Set(keys[i], b)
+		err := s.Set(keys[i], b, 0)
 		if err == sniper.ErrCollision {
 			fmt.Println("ErrCollision, set:", string(keys[i]), err.Error())
 		}
@@ -104,11 +104,59 @@ func sniperBench(keys [][]byte, N int) {
 	fmt.Println(err)
 }
 
+// readBench - reads of one hot chunk with one and all cpus, readers
+// of chunk share lock. Reads with exclusive lock are compared with
+// BenchmarkHotChunkGet: go test -run - -bench HotChunk -cpu 1,8
+func readBench(keys [][]byte, N int) {
+	lotsa.Output = os.Stdout
+	lotsa.MemUsage = false
+
+	fmt.Println("-- sniper, reads of hot chunk --")
+	sniper.DeleteStore("2")
+	s, err := sniper.Open(sniper.Dir("2"), sniper.ChunksCollision(1), sniper.ChunksTotal(2))
+	if err != nil {
+		panic(err)
+	}
+	N = N / 10
+	for i := 0; i < N; i++ {
+		b := make([]byte, 8)
+		binary.BigEndian.PutUint64(b, uint64(i))
+		err := s.Set(keys[i], b, 0)
+		if err != nil {
+			panic(err)
+		}
+	}
+	threads := []int{1}
+	if runtime.NumCPU() > 1 {
+		threads = append(threads, runtime.NumCPU())
+	}
+	for _, n := range threads {
+		fmt.Printf("get, %d threads: \n", n)
+		lotsa.Ops(N, n, func(i, _ int) {
+			b, err := s.Get(keys[i])
+			if err != nil {
+				panic(err)
+			}
+			if binary.BigEndian.Uint64(b) != uint64(i) {
+				panic("bad news")
+			}
+		})
+	}
+	err = s.Close()
+	if err != nil {
+		panic(err)
+	}
+	err = sniper.DeleteStore("2")
+	fmt.Println(err)
+}
+
 func main() {
 	keys, N := seed()
 
 	sniperBench(keys, N)
 
+	readBench(keys, N)
+
 	//uncomment for badger test
 
 	//budgerBench(keys, N)
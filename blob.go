@@ -0,0 +1,252 @@
+package sniper
+
+import (
+	"encoding/binary"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+const (
+	overflow      = 1        // status of record, which store value in blob file
+	blobExtent    = 64 << 10 // size of extent in blob file
+	blobThreshold = blobExtent
+)
+
+// blob file store big values, each value is splitted to extents
+// of same size, so free extents may be reused by any value.
+// Record in chunk store blob reference instead of value:
+// value size (8), value crc32c (4) and extents addresses (8 each)
+
+func marshalBlobRef(size uint64, crc uint32, extents []uint64) []byte {
+	b := make([]byte, 12+8*len(extents))
+	binary.BigEndian.PutUint64(b[0:8], size)
+	binary.BigEndian.PutUint32(b[8:12], crc)
+	for i, addr := range extents {
+		binary.BigEndian.PutUint64(b[12+8*i:], addr)
+	}
+	return b
+}
+
+func unmarshalBlobRef(b []byte) (size uint64, crc uint32, extents []uint64, err error) {
+	if len(b) < 12 || (len(b)-12)%8 != 0 {
+		return 0, 0, nil, ErrCorrupted
+	}
+	size = binary.BigEndian.Uint64(b[0:8])
+	crc = binary.BigEndian.Uint32(b[8:12])
+	extents = make([]uint64, (len(b)-12)/8)
+	for i := range extents {
+		extents[i] = binary.BigEndian.Uint64(b[12+8*i:])
+	}
+	if uint64(len(extents)) != (size+blobExtent-1)/blobExtent {
+		return 0, 0, nil, ErrCorrupted
+	}
+	return
+}
+
+// marshal return packet with key and value, big value is written in blob file
+func (c *chunk) marshal(k, v []byte, expire uint32, ver uint64) (header *Header, b []byte, err error) {
+	if int(sizeHead)+len(k)+len(v) <= blobThreshold {
+		header, b = packetMarshal(k, v, expire, ver)
+		return
+	}
+	ref, err := c.writeBlob(v)
+	if err != nil {
+		return
+	}
+	header, b = packetMarshal(k, ref, expire, ver)
+	header.status = overflow
+	sealPacket(b, header)
+	return
+}
+
+// openBlob open blob file, if create is false and file not exists, do nothing
+func (c *chunk) openBlob(name string, create bool) (err error) {
+	flag := os.O_RDWR
+	if c.readOnly {
+		flag = os.O_RDONLY
+	}
+	if create {
+		flag |= os.O_CREATE
+	}
+	f, err := c.fs.OpenFile(name, flag, os.FileMode(fileMode))
+	if os.IsNotExist(err) && !create {
+		return nil
+	}
+	if err != nil {
+		return
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return
+	}
+	c.blob = f
+	c.blobEnd = (uint64(fi.Size()) + blobExtent - 1) / blobExtent * blobExtent
+	return
+}
+
+// usedExtents return extents of refs
+func usedExtents(refs [][]byte) map[uint64]bool {
+	used := make(map[uint64]bool)
+	for _, ref := range refs {
+		_, _, extents, err := unmarshalBlobRef(ref)
+		if err != nil {
+			continue
+		}
+		for _, addr := range extents {
+			used[addr] = true
+		}
+	}
+	return used
+}
+
+// usedEnd return end of blob, which cover used extents. Crash may cut
+// unsynced tail of blob file, while record with ref to it survive
+// and will be overwritten by log replay, its extents must stay allocated
+func (c *chunk) usedEnd(used map[uint64]bool) uint64 {
+	end := c.blobEnd
+	for addr := range used {
+		if addr < maxChunkSize && addr+blobExtent > end {
+			end = addr + blobExtent
+		}
+	}
+	return end
+}
+
+// initBlob - find free extents, not used by refs
+func (c *chunk) initBlob(refs [][]byte) {
+	used := usedExtents(refs)
+	c.blobEnd = c.usedEnd(used)
+	c.blobFree = c.blobFree[:0]
+	for addr := uint64(0); addr < c.blobEnd; addr += blobExtent {
+		if !used[addr] {
+			c.blobFree = append(c.blobFree, addr)
+		}
+	}
+}
+
+// reserveBlob - remove extents of refs from free extents
+func (c *chunk) reserveBlob(refs [][]byte) {
+	if len(refs) == 0 {
+		return
+	}
+	used := usedExtents(refs)
+	free := c.blobFree[:0]
+	for _, addr := range c.blobFree {
+		if !used[addr] {
+			free = append(free, addr)
+		}
+	}
+	end := c.usedEnd(used)
+	for addr := c.blobEnd; addr < end; addr += blobExtent {
+		if !used[addr] {
+			free = append(free, addr)
+		}
+	}
+	c.blobFree, c.blobEnd = free, end
+}
+
+// writeBlob write value in free extents, return blob ref
+func (c *chunk) writeBlob(v []byte) (ref []byte, err error) {
+	if c.blob == nil {
+		err = c.openBlob(c.name+".blob", true)
+		if err != nil {
+			return
+		}
+		// new file must survive power loss with records, which refer it
+		err = c.fs.SyncDir(filepath.Dir(c.name))
+		if err != nil {
+			return
+		}
+	}
+	extents := make([]uint64, 0, (len(v)+blobExtent-1)/blobExtent)
+	for off := 0; off < len(v); off += blobExtent {
+		var addr uint64
+		if n := len(c.blobFree); n > 0 {
+			addr = c.blobFree[n-1]
+			c.blobFree = c.blobFree[:n-1]
+		} else {
+			if c.blobEnd > maxChunkSize-blobExtent {
+				c.blobFree = append(c.blobFree, extents...)
+				return nil, ErrChunkFull
+			}
+			addr = c.blobEnd
+			c.blobEnd += blobExtent
+		}
+		extents = append(extents, addr)
+		end := off + blobExtent
+		if end > len(v) {
+			end = len(v)
+		}
+		_, err = c.blob.WriteAt(v[off:end], int64(addr))
+		if err != nil {
+			c.blobFree = append(c.blobFree, extents...)
+			return
+		}
+	}
+	return marshalBlobRef(uint64(len(v)), crc32.Checksum(v, crcTable), extents), nil
+}
+
+// readBlob read value by blob ref
+func (c *chunk) readBlob(ref []byte) (v []byte, err error) {
+	if c.blob == nil {
+		return nil, ErrCorrupted
+	}
+	return readBlob(c.blob, ref)
+}
+
+// readBlob read value of blob ref from blob file f and check it,
+// extent, which is out of file (lost by crash), is damaged value
+func readBlob(f File, ref []byte) (v []byte, err error) {
+	size, crc, extents, err := unmarshalBlobRef(ref)
+	if err != nil {
+		return
+	}
+	v = make([]byte, size)
+	for i, addr := range extents {
+		off := uint64(i) * blobExtent
+		end := off + blobExtent
+		if end > size {
+			end = size
+		}
+		_, err = f.ReadAt(v[off:end], int64(addr))
+		if err == io.EOF {
+			return nil, ErrCorrupted
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	if crc32.Checksum(v, crcTable) != crc {
+		return nil, ErrCorrupted
+	}
+	return
+}
+
+// freeBlob return extents of blob ref to free list
+func (c *chunk) freeBlob(ref []byte) {
+	_, _, extents, err := unmarshalBlobRef(ref)
+	if err != nil {
+		return
+	}
+	c.blobFree = append(c.blobFree, extents...)
+}
+
+// value return record value, read it from blob file for overflow record
+func (c *chunk) value(header *Header, val []byte) ([]byte, error) {
+	if header.status != overflow {
+		return val, nil
+	}
+	return c.readBlob(val)
+}
+
+// sync commit chunk and blob files to stable storage
+func (c *chunk) sync() (err error) {
+	err = c.f.Sync()
+	if err != nil || c.blob == nil {
+		return
+	}
+	return c.blob.Sync()
+}
@@ -0,0 +1,201 @@
+package sniper
+
+import (
+	"bufio"
+	"encoding/binary"
+	"io"
+	"os"
+)
+
+const (
+	bucketPut    = '+'
+	bucketDelete = '-'
+	maxKeyLen    = 1<<16 - 1
+)
+
+// appendBucketOp - encode index operation: op, bucket name and key
+func appendBucketOp(b []byte, op byte, name string, k []byte) []byte {
+	var l [binary.MaxVarintLen64]byte
+	b = append(b, op)
+	n := binary.PutUvarint(l[:], uint64(len(name)))
+	b = append(b, l[:n]...)
+	b = append(b, name...)
+	n = binary.PutUvarint(l[:], uint64(len(k)))
+	b = append(b, l[:n]...)
+	b = append(b, k...)
+	return b
+}
+
+// readBucketKey - decode bucket name and key
+func readBucketKey(r *bufio.Reader) (name string, k []byte, err error) {
+	l, err := binary.ReadUvarint(r)
+	if err != nil {
+		return
+	}
+	if l > maxKeyLen {
+		return "", nil, ErrFormat
+	}
+	bname := make([]byte, l)
+	_, err = io.ReadFull(r, bname)
+	if err != nil {
+		return
+	}
+	l, err = binary.ReadUvarint(r)
+	if err != nil {
+		return
+	}
+	if l > maxKeyLen {
+		return "", nil, ErrFormat
+	}
+	k = make([]byte, l)
+	_, err = io.ReadFull(r, k)
+	return string(bname), k, err
+}
+
+// readBucketOp - decode index operation, return io.EOF at the end of index
+func readBucketOp(r *bufio.Reader) (op byte, name string, k []byte, err error) {
+	op, err = r.ReadByte()
+	if err != nil {
+		return
+	}
+	if op != bucketPut && op != bucketDelete {
+		return 0, "", nil, ErrFormat
+	}
+	name, k, err = readBucketKey(r)
+	if err == io.EOF {
+		// operation without key
+		err = io.ErrUnexpectedEOF
+	}
+	return
+}
+
+// loadBuckets read buckets index into sorted set
+// index is append only log, it will be rewritten
+// if it has deleted keys or damaged tail
+func (s *Store) loadBuckets() (err error) {
+	name := s.filename("buckets.idx")
+	flag := os.O_CREATE | os.O_RDWR
+	if s.readOnly {
+		flag = os.O_RDONLY
+	}
+	f, err := s.fs.OpenFile(name, flag, os.FileMode(fileMode))
+	if s.readOnly && os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return
+	}
+	type bucketKey struct {
+		name string
+		key  string
+	}
+	keys := make(map[bucketKey]bool)
+	order := make([]bucketKey, 0)
+	rewrite := false
+	r := bufio.NewReader(f)
+	for {
+		op, bname, k, errRead := readBucketOp(r)
+		if errRead == io.EOF {
+			break
+		}
+		if errRead != nil {
+			// damaged tail, drop it
+			rewrite = true
+			break
+		}
+		bk := bucketKey{name: bname, key: string(k)}
+		switch op {
+		case bucketPut:
+			if _, ok := keys[bk]; ok {
+				rewrite = true
+			} else {
+				order = append(order, bk)
+			}
+			keys[bk] = true
+			s.ss.Put(bname + string(k))
+		case bucketDelete:
+			rewrite = true
+			keys[bk] = false
+			s.ss.Delete(bname + string(k))
+		}
+	}
+	if s.readOnly {
+		// index is loaded, damaged tail is dropped in memory only
+		return f.Close()
+	}
+	if !rewrite {
+		s.bucketf = f
+		return
+	}
+	f.Close()
+
+	var b []byte
+	for _, bk := range order {
+		if keys[bk] {
+			b = appendBucketOp(b, bucketPut, bk.name, []byte(bk.key))
+			keys[bk] = false
+		}
+	}
+	newname := name + ".new"
+	err = writeFile(s.fs, newname, b)
+	if err != nil {
+		return
+	}
+	err = s.fs.Rename(newname, name)
+	if err != nil {
+		return
+	}
+	s.bucketf, err = s.fs.OpenFile(name, os.O_RDWR, os.FileMode(fileMode))
+	return
+}
+
+// logBucketOp append operation to buckets index, index is synced
+// with syncBuckets before batch log or write ahead log is truncated
+func (s *Store) logBucketOp(op byte, name string, k []byte) (err error) {
+	s.bucketMu.Lock()
+	defer s.bucketMu.Unlock()
+	_, err = s.bucketf.Seek(0, io.SeekEnd)
+	if err != nil {
+		return
+	}
+	s.bucketDirty = true
+	_, err = s.bucketf.Write(appendBucketOp(nil, op, name, k))
+	return
+}
+
+// syncBuckets - fsync buckets index, if it has unsynced operations
+func (s *Store) syncBuckets() (err error) {
+	s.bucketMu.Lock()
+	defer s.bucketMu.Unlock()
+	if !s.bucketDirty || s.bucketf == nil {
+		return
+	}
+	err = s.bucketf.Sync()
+	if err == nil {
+		s.bucketDirty = false
+	}
+	return
+}
+
+// isBucketOp return true for operations with buckets index
+func isBucketOp(op byte) bool {
+	return op == opBucketPut || op == opBucketDelete
+}
+
+// applyBucketOp append batch operation to buckets index and update sorted set
+// repeated operation (on replay of batch) is harmless, index is rewritten on load
+func (s *Store) applyBucketOp(op batchOp) (err error) {
+	name := string(op.key)
+	if op.op == opBucketPut {
+		err = s.logBucketOp(bucketPut, name, op.val)
+		if err == nil {
+			s.ss.Put(name + string(op.val))
+		}
+		return
+	}
+	err = s.logBucketOp(bucketDelete, name, op.val)
+	if err == nil {
+		s.ss.Delete(name + string(op.val))
+	}
+	return
+}
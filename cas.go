@@ -0,0 +1,282 @@
+package sniper
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"math"
+	"strconv"
+)
+
+// conditional writes: value is read and written under lock of chunk,
+// so concurrent writers of same key do not race
+
+// ErrNotNumber value of counter is not decimal integer
+var ErrNotNumber = errors.New("Error, value is not an integer or out of range")
+
+// ErrOverflow counter increment or decrement would overflow
+var ErrOverflow = errors.New("Error, increment or decrement would overflow")
+
+// Meta - metadata of record
+type Meta struct {
+	Version uint64 // version of record, changed on every write of key
+	Expire  uint32 // unix time of expiration, 0 - never expire
+	Size    int    // size of value
+}
+
+// update - write value, returned by fn for current value, guarded by mutex,
+// header is nil if key is absent. Value is not written, if fn return write false
+// or error. Return version of written record
+func (c *chunk) update(k []byte, h uint32, fn func(old []byte, header *Header) (v []byte, expire uint32, write bool, err error)) (ver uint64, written bool, err error) {
+	c.wlock()
+	defer c.wunlock()
+	old, header, err := c.load_key(k, h)
+	if err == ErrNotFound {
+		old, header, err = nil, nil, nil
+	}
+	if err != nil {
+		return
+	}
+	v, expire, write, err := fn(old, header)
+	if err != nil || !write {
+		return
+	}
+	err = c.logOp(batchOp{op: opSet, key: k, val: v, expire: expire})
+	if err != nil {
+		return
+	}
+	err = c.applied(c.write_key(k, v, h, expire, 0))
+	if err != nil {
+		return
+	}
+	// write_key take next version of chunk
+	return c.lastVer, true, nil
+}
+
+// update - run update in chunk of key, collision chunks are used same way as in Set
+func (s *Store) update(k []byte, fn func(old []byte, header *Header) (v []byte, expire uint32, write bool, err error)) (ver uint64, written bool, err error) {
+	err = s.writable()
+	if err != nil {
+		return
+	}
+	s.RLock()
+	defer s.RUnlock()
+	h := hash(k)
+	idx := s.idx(h)
+	ver, written, err = s.chunks[idx].update(k, h, fn)
+	if err == ErrCollision {
+		for i := 0; i < int(s.chunkColCnt); i++ {
+			ver, written, err = s.chunks[i].update(k, h, fn)
+			if err == ErrCollision {
+				continue
+			}
+			break
+		}
+	}
+	return
+}
+
+// swap - write v, if check accept current value, header is nil if key is absent.
+// Return old value, nil if key is absent
+func (s *Store) swap(k, v []byte, expire uint32, check func(old []byte, header *Header) bool) (old []byte, swapped bool, err error) {
+	_, swapped, err = s.update(k, func(cur []byte, header *Header) ([]byte, uint32, bool, error) {
+		old = cur
+		return v, expire, check(cur, header), nil
+	})
+	return
+}
+
+// Update - call fn with current value of key and write value, returned by fn,
+// under lock of chunk, so update is atomic with all other writes of key.
+// meta is nil if key is absent. Value is kept, if fn return write false,
+// error of fn is returned by Update. Return meta of written or current record
+func (s *Store) Update(k []byte, fn func(old []byte, meta *Meta) (v []byte, expire uint32, write bool, err error)) (meta Meta, err error) {
+	ver, written, err := s.update(k, func(old []byte, header *Header) ([]byte, uint32, bool, error) {
+		var cur *Meta
+		if header != nil {
+			cur = &Meta{Version: header.ver, Expire: header.expire, Size: len(old)}
+			meta = *cur
+		}
+		v, expire, write, err := fn(old, cur)
+		if write && err == nil {
+			meta = Meta{Expire: expire, Size: len(v)}
+		}
+		return v, expire, write, err
+	})
+	if err != nil {
+		return Meta{}, err
+	}
+	if written {
+		meta.Version = ver
+	}
+	return
+}
+
+// counters of Incr, Decr and Batch.Incr are 8 bytes big endian, as in older
+// versions. Counters of IncrInt, used by servers and command line tool, are
+// decimal text, same as redis and memcached counters, so they are readable by
+// Get. Both formats are read by all of them, counter is rewritten in format
+// of function, which changed it
+
+// binaryCounter return value of counter in 8 bytes big endian. Value with
+// sign and digits only is decimal text, so decimal counter is never taken for it
+func binaryCounter(v []byte) (n uint64, ok bool) {
+	if len(v) != 8 {
+		return 0, false
+	}
+	for _, c := range v {
+		if (c < '0' || c > '9') && c != '-' && c != '+' {
+			return binary.BigEndian.Uint64(v), true
+		}
+	}
+	return 0, false
+}
+
+// parseUint return value of unsigned counter
+func parseUint(v []byte) (uint64, error) {
+	n, err := strconv.ParseUint(string(v), 10, 64)
+	if err == nil {
+		return n, nil
+	}
+	if n, ok := binaryCounter(v); ok {
+		return n, nil
+	}
+	return 0, ErrNotNumber
+}
+
+// ParseCounter return value of unsigned counter, written by Incr or IncrInt,
+// ErrNotNumber if value is not counter. Servers use it to read counter in
+// any format and rewrite it as decimal
+func ParseCounter(v []byte) (uint64, error) {
+	return parseUint(v)
+}
+
+// binaryUint return counter in 8 bytes big endian
+func binaryUint(n uint64) []byte {
+	b := make([]byte, 8)
+	binary.BigEndian.PutUint64(b, n)
+	return b
+}
+
+// parseInt return value of signed counter
+func parseInt(v []byte) (int64, error) {
+	n, err := strconv.ParseInt(string(v), 10, 64)
+	if err == nil {
+		return n, nil
+	}
+	if n, ok := binaryCounter(v); ok && n <= math.MaxInt64 {
+		return int64(n), nil
+	}
+	return 0, ErrNotNumber
+}
+
+// incrdecr - add or subtract delta from unsigned counter, counter wrap
+// at 2^64. Missing counter start from 0, expire of key is kept
+func (s *Store) incrdecr(k []byte, delta uint64, isIncr bool) (n uint64, err error) {
+	_, err = s.Update(k, func(old []byte, meta *Meta) ([]byte, uint32, bool, error) {
+		n = 0
+		expire := uint32(0)
+		if meta != nil {
+			var errParse error
+			n, errParse = parseUint(old)
+			if errParse != nil {
+				return nil, 0, false, errParse
+			}
+			expire = meta.Expire
+		}
+		if isIncr {
+			n += delta
+		} else {
+			n -= delta
+		}
+		return binaryUint(n), expire, true, nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	return
+}
+
+// IncrInt - add delta to signed counter. Missing counter start from 0,
+// expire of key is kept. Return ErrNotNumber if value is not int64
+// and ErrOverflow on overflow
+func (s *Store) IncrInt(k []byte, delta int64) (n int64, err error) {
+	_, err = s.Update(k, func(old []byte, meta *Meta) ([]byte, uint32, bool, error) {
+		n = 0
+		expire := uint32(0)
+		if meta != nil {
+			var errParse error
+			n, errParse = parseInt(old)
+			if errParse != nil {
+				return nil, 0, false, errParse
+			}
+			expire = meta.Expire
+		}
+		if delta > 0 && n > math.MaxInt64-delta || delta < 0 && n < math.MinInt64-delta {
+			return nil, 0, false, ErrOverflow
+		}
+		n += delta
+		return []byte(strconv.FormatInt(n, 10)), expire, true, nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	return
+}
+
+// CompareAndSwap - set new value, if key exists and its value is equal to old
+func (s *Store) CompareAndSwap(k, old, new []byte, expire uint32) (swapped bool, err error) {
+	_, swapped, err = s.swap(k, new, expire, func(cur []byte, header *Header) bool {
+		return header != nil && bytes.Equal(cur, old)
+	})
+	return
+}
+
+// SetNX - set value, if key not exists
+func (s *Store) SetNX(k, v []byte, expire uint32) (isSet bool, err error) {
+	_, isSet, err = s.swap(k, v, expire, func(cur []byte, header *Header) bool {
+		return header == nil
+	})
+	return
+}
+
+// SetXX - set value, if key exists
+func (s *Store) SetXX(k, v []byte, expire uint32) (isSet bool, err error) {
+	_, isSet, err = s.swap(k, v, expire, func(cur []byte, header *Header) bool {
+		return header != nil
+	})
+	return
+}
+
+// GetAndSet - set value and return previous one, as redis GETSET.
+// Old value is nil with nil error, if key was absent
+func (s *Store) GetAndSet(k, v []byte, expire uint32) (old []byte, err error) {
+	old, _, err = s.swap(k, v, expire, func(cur []byte, header *Header) bool {
+		return true
+	})
+	return
+}
+
+// SetIfVersion - set value, if version of record is equal to ver,
+// ver 0 - key must be absent. Version is returned by GetWithMeta
+func (s *Store) SetIfVersion(k, v []byte, ver uint64, expire uint32) (isSet bool, err error) {
+	_, isSet, err = s.swap(k, v, expire, func(cur []byte, header *Header) bool {
+		if header == nil {
+			return ver == 0
+		}
+		return header.ver == ver
+	})
+	return
+}
+
+// GetWithMeta - return value with version, expire and size of record
+func (s *Store) GetWithMeta(k []byte) (v []byte, meta Meta, err error) {
+	s.RLock()
+	v, header, err := s.get(k)
+	s.RUnlock()
+	if err != nil {
+		return
+	}
+	meta = Meta{Version: header.ver, Expire: header.expire, Size: len(v)}
+	return
+}
@@ -5,20 +5,24 @@ import (
 	"encoding/binary"
 	"errors"
 	"fmt"
+	"hash/crc32"
 	"io"
 	"os"
+	"path/filepath"
+	"sort"
 	"sync"
 	"time"
 )
 
 const (
-	currentChunkVersion = 1
+	currentChunkVersion = 3
 	versionMarker       = 255
-	deleted             = 42 // flag for removed, tribute 2 dbf
+	deleted             = 42        // flag for removed, tribute 2 dbf
+	maxChunkSize        = 1<<59 - 1 // maximum file offset, address is 59 bits in key meta
 )
 
 var (
-	sizeHeaders = map[int]uint32{0: 8, 1: 12}
+	sizeHeaders = map[int]uint32{0: 8, 1: 12, 2: 16, 3: 24}
 	sizeHead    = sizeHeaders[currentChunkVersion]
 	forceexit   bool
 )
@@ -26,10 +30,24 @@ var (
 // chunk - local shard
 type chunk struct {
 	sync.RWMutex
-	f         *os.File          // file storage
-	m         map[uint32]uint64 // keys: hash / key meta info
-	h         map[uint32]byte   // holes: addr / size
+	f         File               // file storage
+	m         map[uint32]keyMeta // keys: hash / key meta info
+	h         map[uint64]byte    // holes: addr / size
 	needFsync bool
+	id        int  // chunk number
+	wal       *wal // write ahead log, nil if disabled
+	fs        VFS
+	name      string
+	blob      File            // big values, nil until first big value
+	blobFree  []uint64        // free extents in blob file
+	blobEnd   uint64          // blob file size
+	readOnly  bool            // files are opened read only, chunk is never modified
+	hinted    bool            // hint file on disk match chunk file
+	changed   bool            // chunk is changed after hint was written
+	lastVer   uint64          // last version of record
+	snaps     []*snapshot     // snapshots of open iterators
+	changes   map[string]bool // keys, changed after chunk was copied by Reshard, nil if chunk is not copied
+	resharded bool            // chunk of unfinished Reshard, torn and damaged records are dropped on init
 }
 
 type Header struct {
@@ -38,21 +56,25 @@ type Header struct {
 	keylen uint16
 	vallen uint32
 	expire uint32
+	crc    uint32 // checksum of record, except status
+	ver    uint64 // version of record, changed on every write
 }
 
-func encodeKeyMeta(addr uint32, size byte, expire uint32) uint64 {
-	return uint64(addr)<<32 | uint64(size)<<24 | uint64(expire)>>9
+// keyMeta - record address in chunk file with record size and expire, 12 bytes:
+// addr<<5 | size (size is 5 bits) in two high words and expire in low word.
+// Index entry (hash and meta) take 16 bytes, same as uint32 hash and uint64 meta
+// of v1 index in swiss table maps, so exact expire and 64-bit addresses cost
+// no memory there (4 bytes per key on older Go maps with separate key/value arrays)
+type keyMeta [3]uint32
+
+func encodeKeyMeta(addr uint64, size byte, expire uint32) keyMeta {
+	packed := addr<<5 | uint64(size&31)
+	return keyMeta{uint32(packed >> 32), uint32(packed), expire}
 }
 
-func decodeKeyMeta(info uint64) (addr uint32, size byte, expire uint32) {
-	addr = uint32(info >> 32)
-	size = byte(info >> 24 & 0xff)
-	expire = uint32(info&0xffffff) << 9
-	// if expire non zero add 1<<9-1 = 511 sec
-	if expire != 0 {
-		expire += 1<<9 - 1
-	}
-	return
+func decodeKeyMeta(meta keyMeta) (addr uint64, size byte, expire uint32) {
+	packed := uint64(meta[0])<<32 | uint64(meta[1])
+	return packed >> 5, byte(packed & 31), meta[2]
 }
 
 // https://github.com/thejerf/gomempool/blob/master/pool.go#L519
@@ -89,7 +111,7 @@ func NextPowerOf2(v uint32) (power byte, val uint32) {
 	return
 }
 
-func detectChunkVersion(file *os.File) (version int, err error) {
+func detectChunkVersion(file File) (version int, err error) {
 	b := make([]byte, 2)
 	n, errRead := file.Read(b)
 	if errRead != nil {
@@ -114,12 +136,13 @@ func detectChunkVersion(file *os.File) (version int, err error) {
 	return -1, nil
 }
 
-func makeHeader(k, v []byte, expire uint32) (header *Header) {
+func makeHeader(k, v []byte, expire uint32, ver uint64) (header *Header) {
 	header = &Header{}
 	header.status = 0
 	header.keylen = uint16(len(k))
 	header.vallen = uint32(len(v))
 	header.expire = expire
+	header.ver = ver
 	sizeb, _ := NextPowerOf2(uint32(header.keylen) + header.vallen + sizeHead)
 	header.sizeb = sizeb
 	return
@@ -134,28 +157,33 @@ func parseHeaderV0(b []byte) (header *Header) {
 	return
 }
 
-func parseHeader(b []byte) (header *Header) {
-	header = &Header{}
-	header.sizeb = b[0]
-	header.status = b[1]
-	header.keylen = binary.BigEndian.Uint16(b[2:4])
-	header.vallen = binary.BigEndian.Uint32(b[4:8])
+func parseHeaderV1(b []byte) (header *Header) {
+	header = parseHeaderV0(b)
 	header.expire = binary.BigEndian.Uint32(b[8:12])
 	return
 }
 
-func readHeader(r io.Reader, version int) (header *Header, err error) {
-	b := make([]byte, sizeHeaders[version])
-	n, err := io.ReadFull(r, b)
-	if n != int(sizeHeaders[version]) {
-		if err == io.EOF {
-			err = nil
-		}
-		return
-	}
+func parseHeaderV2(b []byte) (header *Header) {
+	header = parseHeaderV1(b)
+	header.crc = binary.BigEndian.Uint32(b[12:16])
+	return
+}
+
+func parseHeader(b []byte) (header *Header) {
+	header = parseHeaderV2(b)
+	header.ver = binary.BigEndian.Uint64(b[16:24])
+	return
+}
+
+// parseHeaderOf parse header of chunk version
+func parseHeaderOf(b []byte, version int) (header *Header, err error) {
 	switch version {
 	case 0:
 		header = parseHeaderV0(b)
+	case 1:
+		header = parseHeaderV1(b)
+	case 2:
+		header = parseHeaderV2(b)
 	case currentChunkVersion:
 		header = parseHeader(b)
 	default:
@@ -164,24 +192,86 @@ func readHeader(r io.Reader, version int) (header *Header, err error) {
 	return
 }
 
+func readHeader(r io.Reader, version int) (header *Header, err error) {
+	b := make([]byte, sizeHeaders[version])
+	n, err := io.ReadFull(r, b)
+	if n != int(sizeHeaders[version]) {
+		if err == io.EOF {
+			err = nil
+		}
+		return
+	}
+	return parseHeaderOf(b, version)
+}
+
 func writeHeader(b []byte, header *Header) {
 	b[0] = header.sizeb
 	b[1] = header.status
 	binary.BigEndian.PutUint16(b[2:4], header.keylen)
 	binary.BigEndian.PutUint32(b[4:8], header.vallen)
 	binary.BigEndian.PutUint32(b[8:12], header.expire)
+	binary.BigEndian.PutUint32(b[12:16], header.crc)
+	binary.BigEndian.PutUint64(b[16:24], header.ver)
 	return
 }
 
-func packetMarshal(k, v []byte, expire uint32) (header *Header, b []byte) {
+// checksum return crc32c of record: header without status and crc, val and key.
+// Version of record is covered since chunk version 3
+func checksum(header *Header, body []byte, version int) uint32 {
+	b := make([]byte, 19)
+	b[0] = header.sizeb
+	binary.BigEndian.PutUint16(b[1:3], header.keylen)
+	binary.BigEndian.PutUint32(b[3:7], header.vallen)
+	binary.BigEndian.PutUint32(b[7:11], header.expire)
+	n := 11
+	if version >= 3 {
+		binary.BigEndian.PutUint64(b[11:19], header.ver)
+		n = 19
+	}
+	crc := crc32.Update(0, crcTable, b[:n])
+	return crc32.Update(crc, crcTable, body)
+}
+
+// sealPacket - write header with checksum in packet with val and key
+func sealPacket(b []byte, header *Header) {
+	header.crc = checksum(header, b[sizeHead:sizeHead+header.vallen+uint32(header.keylen)], currentChunkVersion)
+	writeHeader(b, header)
+}
+
+// checkPacket return ErrCorrupted if record damaged
+func checkPacket(packet []byte) error {
+	return checkRecord(packet, currentChunkVersion)
+}
+
+// checkRecord return ErrCorrupted if record of chunk version damaged,
+// records have checksum since version 2
+func checkRecord(packet []byte, version int) error {
+	head := sizeHeaders[version]
+	if len(packet) < int(head) {
+		return ErrCorrupted
+	}
+	header, err := parseHeaderOf(packet, version)
+	if err != nil {
+		return err
+	}
+	if uint64(head)+uint64(header.vallen)+uint64(header.keylen) > uint64(len(packet)) {
+		return ErrCorrupted
+	}
+	if checksum(header, packet[head:head+header.vallen+uint32(header.keylen)], version) != header.crc {
+		return ErrCorrupted
+	}
+	return nil
+}
+
+func packetMarshal(k, v []byte, expire uint32, ver uint64) (header *Header, b []byte) {
 	// write head
-	header = makeHeader(k, v, expire)
+	header = makeHeader(k, v, expire, ver)
 	size := 1 << header.sizeb
 	b = make([]byte, size)
-	writeHeader(b, header)
 	// write body: val and key
 	copy(b[sizeHead:], v)
 	copy(b[sizeHead+header.vallen:], k)
+	sealPacket(b, header)
 	return
 }
 
@@ -197,28 +287,46 @@ func (c *chunk) init(name string) (err error) {
 	forceexit = false
 	defer c.Unlock()
 
-	f, err := os.OpenFile(name, os.O_CREATE|os.O_RDWR, os.FileMode(fileMode))
+	flag := os.O_CREATE | os.O_RDWR
+	if c.readOnly {
+		flag = os.O_RDONLY
+	}
+	f, err := c.fs.OpenFile(name, flag, os.FileMode(fileMode))
 	if err != nil {
 		return
 	}
-	err = f.Sync()
-	if err != nil {
-		return err
+	if !c.readOnly {
+		err = f.Sync()
+		if err != nil {
+			return err
+		}
 	}
 	c.f = f
-	c.m = make(map[uint32]uint64)
-	c.h = make(map[uint32]byte)
+	c.name = name
+	c.m = make(map[uint32]keyMeta)
+	c.h = make(map[uint64]byte)
+	err = c.openBlob(name+".blob", false)
+	if err != nil {
+		return
+	}
 	//read if f not empty
 	if fi, e := c.f.Stat(); e == nil {
 		// new file
 		if fi.Size() == 0 {
-			// write chunk version info
-			c.f.Write([]byte{versionMarker, currentChunkVersion})
+			if c.readOnly {
+				return
+			}
+			// write chunk version info, it must be on disk
+			// before records, written without log
+			_, err = c.f.Write([]byte{versionMarker, currentChunkVersion})
+			if err == nil {
+				err = c.f.Sync()
+			}
 			return
 		}
 
 		//read file
-		var seek uint32
+		var seek uint64
 		// detect chunk version
 		version, errDetect := detectChunkVersion(c.f)
 		if errDetect != nil {
@@ -239,22 +347,22 @@ func (c *chunk) init(name string) (err error) {
 			seek = 2
 		}
 
-		if version > currentChunkVersion {
-			err = fmt.Errorf("chunk %s unsupported version %d", name, version)
-		}
-
 		// if load chunk with old version create file in new format
+		if version < currentChunkVersion && c.readOnly {
+			return fmt.Errorf("chunk %s has version %d, upgrade to v%d: %w", name, version, currentChunkVersion, ErrReadOnly)
+		}
 		if version < currentChunkVersion {
-			var newfile *os.File
+			var newfile File
 			fmt.Printf("Load from old version chunk %s, do inplace upgrade v%d -> v%d\n", name, version, currentChunkVersion)
 			newname := name + ".new"
-			newfile, err = os.OpenFile(newname, os.O_CREATE|os.O_RDWR|os.O_TRUNC, os.FileMode(fileMode))
+			newfile, err = c.fs.OpenFile(newname, os.O_CREATE|os.O_RDWR|os.O_TRUNC, os.FileMode(fileMode))
 			if err != nil {
 				return
 			}
 			// write chunk version info
 			newfile.Write([]byte{versionMarker, currentChunkVersion})
 			seek = 2
+			refs := make(map[uint64][]byte) // addr / blob ref
 			oldsizehead := sizeHeaders[version]
 			sizediff := sizeHead - oldsizehead
 			for {
@@ -268,6 +376,7 @@ func (c *chunk) init(name string) (err error) {
 				if header == nil {
 					break
 				}
+				old := *header
 				oldsizedata := (1 << header.sizeb) - oldsizehead
 				sizeb, size := NextPowerOf2(uint32(sizeHead) + uint32(header.keylen) + header.vallen)
 				header.sizeb = sizeb
@@ -280,11 +389,26 @@ func (c *chunk) init(name string) (err error) {
 				if n != int(oldsizedata) {
 					return fmt.Errorf("n != record length: %w", ErrFormat)
 				}
+				// record is sealed again below, damaged one must not get valid checksum
+				if version >= 2 && header.status != deleted && (uint32(header.keylen)+header.vallen > oldsizedata ||
+					checksum(&old, b[sizeHead:sizeHead+header.vallen+uint32(header.keylen)], version) != old.crc) {
+					newfile.Close()
+					c.fs.Remove(newname)
+					return fmt.Errorf("damaged record in chunk %s, repair it before upgrade: %w", name, ErrFormat)
+				}
 
 				// skip deleted or expired entry
 				if header.status == deleted || (header.expire != 0 && int64(header.expire) < time.Now().Unix()) {
 					continue
 				}
+				// records of old chunk have no version
+				if header.ver == 0 {
+					header.ver = c.nextVersion()
+				}
+				sealPacket(b, header)
+				if header.status == overflow {
+					refs[seek] = b[sizeHead : sizeHead+header.vallen]
+				}
 				keyidx := int(sizeHead) + int(header.vallen)
 				h := hash(b[keyidx : keyidx+int(header.keylen)])
 				c.m[h] = encodeKeyMeta(seek, header.sizeb, header.expire)
@@ -292,7 +416,7 @@ func (c *chunk) init(name string) (err error) {
 				if errRead != nil {
 					return fmt.Errorf("%s: %w", errRead.Error(), ErrFormat)
 				}
-				seek += uint32(n)
+				seek += uint64(n)
 			}
 			// close old chunk file
 			errRead := c.f.Close()
@@ -302,31 +426,86 @@ func (c *chunk) init(name string) (err error) {
 			// set new file for chunk
 			c.f = newfile
 			// remove old chunk file from disk
-			errRead = os.Remove(name)
+			errRead = c.fs.Remove(name)
 			if errRead != nil {
 				return fmt.Errorf("%s: %w", errRead.Error(), ErrFormat)
 			}
 			// rename new file to old file
-			errRead = os.Rename(newname, name)
+			errRead = c.fs.Rename(newname, name)
 			if errRead != nil {
 				return fmt.Errorf("%s: %w", errRead.Error(), ErrFormat)
 			}
+			c.changed = true
+			c.initBlob(c.liveRefs(refs))
 			return
 		}
 
 		var n int
+		refs := make(map[uint64][]byte) // addr / blob ref
+		covered, hinted := c.loadHint(fi.Size())
+		if hinted {
+			// only records appended after hint are scanned
+			seek = covered
+			_, err = c.f.Seek(int64(seek), io.SeekStart)
+			if err != nil {
+				return
+			}
+		}
+		c.changed = seek < uint64(fi.Size()) || !hinted
+		// records, damaged by crash, are restored from log
+		// or copied again by resumed Reshard
+		restored := c.wal != nil || c.resharded
 		for {
 			header, errRead := readHeader(c.f, version)
+			if restored && (errRead == io.ErrUnexpectedEOF || errRead == nil && header != nil && (header.sizeb > 31 || int64(seek)+1<<header.sizeb > fi.Size())) {
+				// torn write at the end of chunk, record will be restored
+				err = c.f.Truncate(int64(seek))
+				if err != nil {
+					return
+				}
+				break
+			}
 			if errRead != nil {
 				return fmt.Errorf("%s: %w", errRead.Error(), ErrFormat)
 			}
 			if header == nil {
 				break
 			}
-			// skip val
-			_, seekerr := c.f.Seek(int64(header.vallen), 1)
-			if seekerr != nil {
-				return fmt.Errorf("%s: %w", seekerr.Error(), ErrFormat)
+			if header.ver > c.lastVer {
+				c.lastVer = header.ver
+			}
+			if restored && header.status != deleted {
+				// record may be torn by crash, damaged record is marked as deleted
+				// and will be restored
+				_, errRead = c.read_packet(seek, header.sizeb)
+				if errRead == ErrCorrupted {
+					errRead = c.markDeleted(seek)
+					header.status = deleted
+				}
+				if errRead != nil {
+					return fmt.Errorf("%s: %w", errRead.Error(), ErrFormat)
+				}
+			} else if restored && header.crc != 0 {
+				// crash between status and checksum writes of delete
+				errRead = c.markDeleted(seek)
+				if errRead != nil {
+					return fmt.Errorf("%s: %w", errRead.Error(), ErrFormat)
+				}
+			}
+			if header.status == overflow {
+				// read blob ref
+				ref := make([]byte, header.vallen)
+				_, errRead = io.ReadFull(c.f, ref)
+				if errRead != nil {
+					return fmt.Errorf("%s: %w", errRead.Error(), ErrFormat)
+				}
+				refs[seek] = ref
+			} else {
+				// skip val
+				_, seekerr := c.f.Seek(int64(header.vallen), 1)
+				if seekerr != nil {
+					return fmt.Errorf("%s: %w", seekerr.Error(), ErrFormat)
+				}
 			}
 			// read key
 			key := make([]byte, header.keylen)
@@ -350,10 +529,37 @@ func (c *chunk) init(name string) (err error) {
 				//deleted blocks store
 				c.h[seek] = header.sizeb // seek / size
 			}
-			seek = uint32(ret)
+			seek = uint64(ret)
 		}
+		if hinted {
+			c.reserveBlob(c.liveRefs(refs))
+		} else {
+			c.initBlob(c.liveRefs(refs))
+		}
+	}
+
+	return
+}
+
+// nextVersion return version for new record, versions grow inside chunk
+// and are not reused after restart, because they start from current time
+func (c *chunk) nextVersion() uint64 {
+	ver := uint64(time.Now().UnixNano())
+	if ver <= c.lastVer {
+		ver = c.lastVer + 1
 	}
+	c.lastVer = ver
+	return ver
+}
 
+// liveRefs return blob refs of live records
+func (c *chunk) liveRefs(refs map[uint64][]byte) (live [][]byte) {
+	for _, meta := range c.m {
+		addr, _, _ := decodeKeyMeta(meta)
+		if ref, ok := refs[addr]; ok {
+			live = append(live, ref)
+		}
+	}
 	return
 }
 
@@ -363,7 +569,7 @@ func (c *chunk) fsync() error {
 		c.Lock()
 		defer c.Unlock()
 		c.needFsync = false
-		return c.f.Sync()
+		return c.sync()
 	}
 	return nil
 }
@@ -438,45 +644,224 @@ func (c *chunk) expirekeys(maxruntime time.Duration) error {
 	return nil
 }
 
-// set - write data to file & in map guarded by mutex
-func (c *chunk) set(k, v []byte, h uint32, expire uint32) (err error) {
+// holeRatio return part of chunk file occupied by holes
+func (c *chunk) holeRatio() (float64, error) {
+	c.RLock()
+	defer c.RUnlock()
+	fi, err := c.f.Stat()
+	if err != nil {
+		return 0, err
+	}
+	if fi.Size() <= 2 {
+		return 0, nil
+	}
+	var holes int64
+	for _, sizeb := range c.h {
+		holes += 1 << sizeb
+	}
+	return float64(holes) / float64(fi.Size()-2), nil
+}
+
+// holes return count and total size of holes
+func (c *chunk) holes() (n int, size int64) {
+	c.RLock()
+	defer c.RUnlock()
+	for _, sizeb := range c.h {
+		size += 1 << sizeb
+	}
+	return len(c.h), size
+}
+
+// compact rewrite chunk into fresh file with live records only
+// and swap it with old file. Chunk, pinned by snapshot, is not compacted
+func (c *chunk) compact() (err error) {
 	c.Lock()
 	defer c.Unlock()
-	err = c.write_key(k, v, h, expire)
+	if len(c.snaps) > 0 {
+		// addresses of records are pinned by iterator
+		return nil
+	}
+
+	name := c.name
+	newname := name + ".compact"
+	newfile, err := c.fs.OpenFile(newname, os.O_CREATE|os.O_RDWR|os.O_TRUNC, os.FileMode(fileMode))
+	if err != nil {
+		return
+	}
+	defer func() {
+		if err != nil {
+			newfile.Close()
+			c.fs.Remove(newname)
+		}
+	}()
+	// write chunk version info
+	_, err = newfile.Write([]byte{versionMarker, currentChunkVersion})
+	if err != nil {
+		return
+	}
+
+	// copy records in address order, for sequential read
+	hashes := make([]uint32, 0, len(c.m))
+	for h := range c.m {
+		hashes = append(hashes, h)
+	}
+	sort.Slice(hashes, func(i, j int) bool {
+		addri, _, _ := decodeKeyMeta(c.m[hashes[i]])
+		addrj, _, _ := decodeKeyMeta(c.m[hashes[j]])
+		return addri < addrj
+	})
+
+	now := time.Now().Unix()
+	seek := uint64(2)
+	m := make(map[uint32]keyMeta, len(c.m))
+	refs := make(map[uint64][]byte) // blob refs are copied as is
+	for _, h := range hashes {
+		addr, size, _ := decodeKeyMeta(c.m[h])
+		// damaged record must not be copied with fresh file, compaction
+		// is aborted and old file is kept for fsck
+		packet, errRead := c.read_packet(addr, size)
+		if errRead == ErrCorrupted {
+			return fmt.Errorf("compact %s: record at %d: %w", name, addr, ErrCorrupted)
+		}
+		if errRead != nil {
+			return errRead
+		}
+		header := parseHeader(packet)
+		// skip expired entry
+		if header.expire != 0 && int64(header.expire) < now {
+			continue
+		}
+		_, err = newfile.Write(packet)
+		if err != nil {
+			return
+		}
+		if header.status == overflow {
+			_, _, refs[seek] = packetUnmarshal(packet)
+		}
+		m[h] = encodeKeyMeta(seek, size, header.expire)
+		seek += uint64(len(packet))
+	}
+	err = newfile.Sync()
+	if err != nil {
+		return
+	}
+	if c.blob != nil {
+		err = c.blob.Sync()
+		if err != nil {
+			return
+		}
+	}
+	err = c.dropHint()
+	if err != nil {
+		return
+	}
+	// close old chunk file and replace it with new one
+	err = c.f.Close()
+	if err != nil {
+		return
+	}
+	err = c.fs.Rename(newname, name)
+	if err != nil {
+		// reopen old file, chunk must stay usable
+		f, errOpen := c.fs.OpenFile(name, os.O_RDWR, os.FileMode(fileMode))
+		if errOpen != nil {
+			err = fmt.Errorf("%s, reopen: %w", err.Error(), errOpen)
+			c.f = errFile{err}
+			return
+		}
+		c.f = f
+		return
+	}
+	c.f = newfile
+	c.m = m
+	c.h = make(map[uint64]byte)
+	c.needFsync = false
+	// extents of deleted and expired values are free now
+	c.initBlob(c.liveRefs(refs))
+	// rename must survive power loss
+	return c.fs.SyncDir(filepath.Dir(name))
+}
+
+// set - write data to file & in map guarded by mutex
+func (c *chunk) set(k, v []byte, h uint32, expire uint32) (err error) {
+	c.wlock()
+	defer c.wunlock()
+	err = c.logOp(batchOp{op: opSet, key: k, val: v, expire: expire})
+	if err != nil {
+		return
+	}
+	err = c.applied(c.write_key(k, v, h, expire, 0))
 	return
 }
 
-// write_key - write data to file & in map
-func (c *chunk) write_key(k, v []byte, h uint32, expire uint32) (err error) {
-	c.needFsync = true
-	header, b := packetMarshal(k, v, expire)
+// write_key - write data to file & in map,
+// ver 0 - record get next version of chunk
+func (c *chunk) write_key(k, v []byte, h uint32, expire uint32, ver uint64) (err error) {
+	c.track(k)
 	// write at file
 	pos := int64(-1)
+	var oldref []byte // blob of old value
 
-	if meta, ok := c.m[h]; ok {
-		addr, size, _ := decodeKeyMeta(meta)
-		packet := make([]byte, 1<<size)
-		_, err = c.f.ReadAt(packet, int64(addr))
+	meta, exists := c.m[h]
+	addr, size, _ := decodeKeyMeta(meta)
+	if exists {
+		packet, errRead := c.read_packet(addr, size)
+		if errRead != nil && errRead != ErrCorrupted {
+			return errRead
+		}
+		// damaged record will be overwritten
+		if errRead == nil {
+			headerold, key, val := packetUnmarshal(packet)
+			if !bytes.Equal(key, k) {
+				//println(string(key), string(k))
+				return ErrCollision
+			}
+			if headerold.status == overflow {
+				oldref = val
+			}
+		}
+	}
+
+	if exists {
+		// record is overwritten or marked as deleted
+		err = c.dropHint()
 		if err != nil {
-			return err
+			return
 		}
-		headerold, key, _ := packetUnmarshal(packet)
-		if !bytes.Equal(key, k) {
-			//println(string(key), string(k))
-			return ErrCollision
+		err = c.syncLog()
+		if err != nil {
+			return
 		}
+	}
+	c.needFsync = true
+	c.changed = true
+	if ver == 0 {
+		ver = c.nextVersion()
+	} else if ver > c.lastVer {
+		c.lastVer = ver
+	}
+	header, b, err := c.marshal(k, v, expire, ver)
+	if err != nil {
+		return
+	}
+	defer func() {
+		if err != nil && header.status == overflow {
+			_, _, ref := packetUnmarshal(b)
+			c.freeBlob(ref)
+		}
+	}()
 
-		if headerold.sizeb == header.sizeb {
+	if exists {
+		if size == header.sizeb {
 			//overwrite
 			pos = int64(addr)
 		} else {
 			// mark old k/v as deleted
-			delb := []byte{deleted}
-			_, err = c.f.WriteAt(delb, int64(addr+1))
+			err = c.markDeleted(addr)
 			if err != nil {
 				return err
 			}
-			c.h[addr] = headerold.sizeb
+			c.h[addr] = size
 
 			// try to find optimal empty hole
 			for addrh, sizeh := range c.h {
@@ -489,26 +874,53 @@ func (c *chunk) write_key(k, v []byte, h uint32, expire uint32) (err error) {
 		}
 	}
 	// write at end or in hole or overwrite
-	if pos < 0 {
+	if pos >= 0 {
+		c.preserve(uint64(pos))
+	} else {
 		pos, err = c.f.Seek(0, 2) // append to the end of file
+		if err != nil {
+			return err
+		}
+		if pos > maxChunkSize-int64(len(b)) {
+			return ErrChunkFull
+		}
 	}
 	_, err = c.f.WriteAt(b, pos)
 	if err != nil {
 		return err
 	}
-	c.m[h] = encodeKeyMeta(uint32(pos), header.sizeb, header.expire)
+	c.m[h] = encodeKeyMeta(uint64(pos), header.sizeb, header.expire)
+	if oldref != nil {
+		c.freeBlob(oldref)
+	}
 	return
 }
 
-// touch - write data to file & in map
+// touch - update expire guarded by mutex
 func (c *chunk) touch(k []byte, h uint32, expire uint32) (err error) {
-	c.Lock()
-	defer c.Unlock()
+	c.wlock()
+	defer c.wunlock()
+	if c.wal != nil {
+		// header is rewritten in place and may be torn on crash,
+		// so whole record is logged, replay will restore it
+		v, _, err := c.load_key(k, h)
+		if err != nil {
+			return err
+		}
+		err = c.logOp(batchOp{op: opSet, key: k, val: v, expire: expire})
+		if err != nil {
+			return err
+		}
+	}
+	return c.applied(c.touch_key(k, h, expire))
+}
 
+// touch_key - write expire to file & in map
+func (c *chunk) touch_key(k []byte, h uint32, expire uint32) (err error) {
+	c.track(k)
 	if meta, ok := c.m[h]; ok {
 		addr, size, _ := decodeKeyMeta(meta)
-		packet := make([]byte, 1<<size)
-		_, err = c.f.ReadAt(packet, int64(addr))
+		packet, err := c.read_packet(addr, size)
 		if err != nil {
 			return err
 		}
@@ -521,12 +933,21 @@ func (c *chunk) touch(k []byte, h uint32, expire uint32) (err error) {
 		}
 
 		header.expire = expire
-		b := make([]byte, sizeHead)
-		writeHeader(b, header)
-		_, err = c.f.WriteAt(b, int64(addr))
+		sealPacket(packet, header)
+		c.preserve(addr)
+		err = c.dropHint()
+		if err != nil {
+			return err
+		}
+		err = c.syncLog()
+		if err != nil {
+			return err
+		}
+		_, err = c.f.WriteAt(packet[:sizeHead], int64(addr))
 		if err != nil {
 			return err
 		}
+		c.m[h] = encodeKeyMeta(addr, size, expire)
 		c.needFsync = true
 
 	} else {
@@ -535,42 +956,115 @@ func (c *chunk) touch(k []byte, h uint32, expire uint32) (err error) {
 	return
 }
 
-// get return val by key guarded by mutex
+// read_packet read record from file, return ErrCorrupted if record is damaged
+func (c *chunk) read_packet(addr uint64, size byte) (packet []byte, err error) {
+	packet = make([]byte, 1<<size)
+	_, err = c.f.ReadAt(packet, int64(addr))
+	if err != nil {
+		return
+	}
+	return packet, checkPacket(packet)
+}
+
+// get return val by key guarded by read lock, so readers of chunk
+// run concurrently. Expired record is removed from index after read lock
+// is released
 func (c *chunk) get(k []byte, h uint32) (v []byte, header *Header, err error) {
-	c.Lock()
-	defer c.Unlock()
-	v, header, err = c.load_key(k, h)
+	c.RLock()
+	v, header, expired, err := c.lookup(k, h)
+	c.RUnlock()
+	if expired {
+		c.Lock()
+		c.dropExpired(k, h)
+		c.Unlock()
+	}
 	return
 }
 
-// load key data from file
+// load key data from file, expired record is removed from index,
+// chunk must be locked for write
 func (c *chunk) load_key(k []byte, h uint32) (v []byte, header *Header, err error) {
-	if meta, ok := c.m[h]; ok {
-		addr, size, expire := decodeKeyMeta(meta)
+	v, header, expired, err := c.lookup(k, h)
+	if expired {
+		c.dropExpired(k, h)
+	}
+	return
+}
 
-		if expire != 0 && int64(expire) < time.Now().Unix() {
-			delete(c.m, h)
-			c.h[addr] = size
-			return nil, nil, ErrNotFound
-		}
-		packet := make([]byte, 1<<size)
-		_, err = c.f.ReadAt(packet, int64(addr))
-		if err != nil {
-			return
-		}
-		var key, val []byte
-		header, key, val = packetUnmarshal(packet)
-		if !bytes.Equal(key, k) {
-			return nil, nil, ErrCollision
-		}
-		if header.expire != 0 && int64(header.expire) < time.Now().Unix() {
-			delete(c.m, h)
-			c.h[addr] = size
-			return nil, nil, ErrNotFound
-		}
-		v = val
-	} else {
-		return nil, nil, ErrNotFound
+// lookup read key data from file, index is not changed, so lookup may run
+// under read lock. expired is true, if record of key is expired
+// and must be removed with dropExpired
+func (c *chunk) lookup(k []byte, h uint32) (v []byte, header *Header, expired bool, err error) {
+	meta, ok := c.m[h]
+	if !ok {
+		return nil, nil, false, ErrNotFound
+	}
+	addr, size, expire := decodeKeyMeta(meta)
+	if expire != 0 && int64(expire) < time.Now().Unix() {
+		return nil, nil, !c.readOnly, ErrNotFound
+	}
+	packet, err := c.read_packet(addr, size)
+	if err != nil {
+		return
+	}
+	header, key, val := packetUnmarshal(packet)
+	if !bytes.Equal(key, k) {
+		return nil, nil, false, ErrCollision
+	}
+	if header.expire != 0 && int64(header.expire) < time.Now().Unix() {
+		return nil, nil, !c.readOnly, ErrNotFound
+	}
+	v, err = c.value(header, val)
+	return
+}
+
+// dropExpired remove expired record of key from index, record is checked
+// again, because it may be changed after lookup. Chunk must be locked for write
+func (c *chunk) dropExpired(k []byte, h uint32) {
+	meta, ok := c.m[h]
+	if !ok {
+		return
+	}
+	addr, size, expire := decodeKeyMeta(meta)
+	packet, err := c.read_packet(addr, size)
+	if err != nil {
+		return
+	}
+	header, key, val := packetUnmarshal(packet)
+	if !bytes.Equal(key, k) {
+		return
+	}
+	now := time.Now().Unix()
+	if (expire == 0 || int64(expire) >= now) && (header.expire == 0 || int64(header.expire) >= now) {
+		return
+	}
+	if header.status == overflow {
+		c.preserve(addr)
+		c.freeBlob(val)
+	}
+	delete(c.m, h)
+	c.h[addr] = size
+}
+
+// ttl return expire of key guarded by read lock, value is not read
+func (c *chunk) ttl(k []byte, h uint32) (expire uint32, err error) {
+	c.RLock()
+	defer c.RUnlock()
+	meta, ok := c.m[h]
+	if !ok {
+		return 0, ErrNotFound
+	}
+	addr, size, expire := decodeKeyMeta(meta)
+	if expire != 0 && int64(expire) < time.Now().Unix() {
+		return 0, ErrNotFound
+	}
+	packet, err := c.read_packet(addr, size)
+	if err != nil {
+		return
+	}
+	_, key, _ := packetUnmarshal(packet)
+	if !bytes.Equal(key, k) {
+		return 0, ErrCollision
 	}
 	return
 }
@@ -589,6 +1083,17 @@ func (c *chunk) close() (err error) {
 	c.Lock()
 	defer c.Unlock()
 
+	err = c.writeHint()
+	if err != nil {
+		return
+	}
+
+	if c.blob != nil {
+		err = c.blob.Close()
+		if err != nil {
+			return
+		}
+	}
 	return c.f.Close()
 }
 
@@ -599,70 +1104,82 @@ func (c *chunk) fileSize() (int64, error) {
 	if err != nil {
 		return -1, err
 	}
-	return is.Size(), nil
+	size := is.Size()
+	if c.blob != nil {
+		is, err = c.blob.Stat()
+		if err != nil {
+			return -1, err
+		}
+		size += is.Size()
+	}
+	return size, nil
 }
 
-// delete mark item as deleted at specified position
+// delete mark item as deleted guarded by mutex
 func (c *chunk) delete(k []byte, h uint32) (isDeleted bool, err error) {
-	c.Lock()
-	defer c.Unlock()
+	c.wlock()
+	defer c.wunlock()
+	if _, ok := c.m[h]; !ok {
+		return
+	}
+	err = c.logOp(batchOp{op: opDelete, key: k})
+	if err != nil {
+		return
+	}
+	isDeleted, err = c.delete_key(k, h)
+	return isDeleted, c.applied(err)
+}
+
+// delete_key mark item as deleted at specified position
+func (c *chunk) delete_key(k []byte, h uint32) (isDeleted bool, err error) {
+	c.track(k)
 	if meta, ok := c.m[h]; ok {
 		addr, size, _ := decodeKeyMeta(meta)
-		packet := make([]byte, 1<<size)
-		_, err = c.f.ReadAt(packet, int64(addr))
-		if err != nil {
-			return
+		packet, errRead := c.read_packet(addr, size)
+		if errRead != nil && errRead != ErrCorrupted {
+			return false, errRead
 		}
-		header, key, _ := packetUnmarshal(packet)
-		if !bytes.Equal(key, k) {
-			return false, ErrCollision
+		var ref []byte
+		// damaged record may be deleted
+		if errRead == nil {
+			header, key, val := packetUnmarshal(packet)
+			if !bytes.Equal(key, k) {
+				return false, ErrCollision
+			}
+			if header.status == overflow {
+				ref = val
+			}
 		}
 
-		delb := []byte{deleted}
-		_, err = c.f.WriteAt(delb, int64(addr+1))
+		err = c.dropHint()
+		if err != nil {
+			return
+		}
+		err = c.markDeleted(addr)
 		if err != nil {
 			return
 		}
 		delete(c.m, h)
-		c.h[addr] = header.sizeb
+		c.h[addr] = size
+		if ref != nil {
+			c.freeBlob(ref)
+		}
+		c.needFsync = true
 		isDeleted = true
 	}
 	return
 }
 
-// TODO - optimize
-func (c *chunk) incrdecr(k []byte, h uint32, v uint64, isIncr bool) (counter uint64, err error) {
-	c.Lock()
-	defer c.Unlock()
-	old, header, err := c.load_key(k, h)
-	expire := uint32(0)
-	if header != nil {
-		expire = header.expire
-	}
-
-	if err == ErrNotFound {
-		//create empty counter
-		old = make([]byte, 8)
-		err = nil
-	}
-	if len(old) != 8 {
-		//better, then panic
-		return 0, errors.New("Unexpected value format")
-	}
+// markDeleted mark record as deleted and clear its checksum: status is not
+// covered by checksum, so torn write of new record in this hole must not
+// bring deleted record back
+func (c *chunk) markDeleted(addr uint64) (err error) {
+	c.preserve(addr)
+	_, err = c.f.WriteAt([]byte{deleted}, int64(addr+1))
 	if err != nil {
 		return
 	}
-	counter = binary.BigEndian.Uint64(old)
-	if isIncr {
-		counter += v
-	} else {
-		//decr
-		counter -= v
-	}
-	new := make([]byte, 8)
-	binary.BigEndian.PutUint64(new, counter)
-	err = c.write_key(k, new, h, expire)
-
+	_, err = c.f.WriteAt(make([]byte, 4), int64(addr+12))
 	return
 }
 
@@ -705,6 +1222,19 @@ func (c *chunk) backup(w io.Writer) (err error) {
 		if header.status == deleted || (header.expire != 0 && int64(header.expire) < time.Now().Unix()) {
 			continue
 		}
+		if header.status == overflow {
+			// big value is written inline
+			_, key, ref := packetUnmarshal(b)
+			val, errRead := c.readBlob(ref)
+			if errRead != nil {
+				return errRead
+			}
+			header = makeHeader(key, val, header.expire, header.ver)
+			b = make([]byte, int(sizeHead)+len(val)+len(key))
+			copy(b[sizeHead:], val)
+			copy(b[sizeHead+header.vallen:], key)
+			sealPacket(b, header)
+		}
 		n, errRead = w.Write(b)
 		if errRead != nil {
 			return fmt.Errorf("%s: %w", errRead.Error(), ErrFormat)
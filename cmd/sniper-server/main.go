@@ -0,0 +1,220 @@
+// Command sniper-server - network server for sniper store
+// with redis protocol (RESP2 and RESP3), memcached protocol (text and binary)
+// and HTTP/JSON API
+//
+// usage:
+//
+//	sniper-server [-dir dir] [-redis addr] [-memcache addr] [-http addr] [-durability mode]
+//
+// test with redis-cli:
+//
+//	redis-cli -p 6380 set hello world ex 60
+//	redis-cli -p 6380 get hello
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"hash/crc32"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"syscall"
+
+	"github.com/recoilme/sniper"
+	"github.com/recoilme/sniper/httpserver"
+)
+
+// maxKeyLen - key length is stored in 16 bits
+const maxKeyLen = 1<<16 - 1
+
+// lockStripes - count of locks for read-modify-write commands
+const lockStripes = 1024
+
+type server struct {
+	s        *sniper.Store
+	locks    [lockStripes]sync.Mutex
+	wg       sync.WaitGroup
+	mu       sync.Mutex
+	conns    map[net.Conn]struct{}
+	isClosed int32
+}
+
+// stripe return lock number of key
+func stripe(k []byte) int {
+	return int(crc32.ChecksumIEEE(k) % lockStripes)
+}
+
+// lock key for read-modify-write, all writes of key hold lock,
+// so they do not interleave with read-modify-write
+func (srv *server) lock(k []byte) {
+	srv.locks[stripe(k)].Lock()
+}
+
+func (srv *server) unlock(k []byte) {
+	srv.locks[stripe(k)].Unlock()
+}
+
+// lockKeys lock keys in stripe order, without deadlocks
+func (srv *server) lockKeys(keys [][]byte) {
+	for _, i := range stripes(keys) {
+		srv.locks[i].Lock()
+	}
+}
+
+func (srv *server) unlockKeys(keys [][]byte) {
+	for _, i := range stripes(keys) {
+		srv.locks[i].Unlock()
+	}
+}
+
+// stripes return sorted unique stripes of keys
+func stripes(keys [][]byte) []int {
+	seen := make(map[int]bool, len(keys))
+	idxs := make([]int, 0, len(keys))
+	for _, k := range keys {
+		i := stripe(k)
+		if !seen[i] {
+			seen[i] = true
+			idxs = append(idxs, i)
+		}
+	}
+	sort.Ints(idxs)
+	return idxs
+}
+
+// listen accept connections and serve them with serve
+func (srv *server) listen(l net.Listener, serve func(net.Conn)) {
+	defer srv.wg.Done()
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			if !srv.closed() {
+				fmt.Printf("Error accept:%s\n", err)
+			}
+			return
+		}
+		srv.mu.Lock()
+		if srv.closed() {
+			srv.mu.Unlock()
+			conn.Close()
+			return
+		}
+		srv.conns[conn] = struct{}{}
+		srv.wg.Add(1)
+		srv.mu.Unlock()
+		go func() {
+			defer srv.wg.Done()
+			serve(conn)
+			srv.mu.Lock()
+			delete(srv.conns, conn)
+			srv.mu.Unlock()
+		}()
+	}
+}
+
+func (srv *server) closed() bool {
+	return atomic.LoadInt32(&srv.isClosed) == 1
+}
+
+// shutdown close listeners and connections, wait until handlers are done
+func (srv *server) shutdown(listeners []net.Listener) {
+	srv.mu.Lock()
+	atomic.StoreInt32(&srv.isClosed, 1)
+	for _, l := range listeners {
+		l.Close()
+	}
+	for conn := range srv.conns {
+		conn.Close()
+	}
+	srv.mu.Unlock()
+	srv.wg.Wait()
+}
+
+func main() {
+	dir := flag.String("dir", ".", "database directory")
+	redisAddr := flag.String("redis", ":6380", "redis protocol listen address, empty - disabled")
+	memcacheAddr := flag.String("memcache", "", "memcached protocol listen address, empty - disabled")
+	httpAddr := flag.String("http", "", "HTTP/JSON API listen address, empty - disabled")
+	durability := flag.String("durability", "", "write ahead log mode: sync, group or interval, default - disabled")
+	hints := flag.Duration("hints", 0, "interval of index hints writing, store is opened fast after crash, 0 - on close only")
+	flag.Parse()
+
+	opts := []sniper.OptStore{sniper.Dir(*dir), sniper.HintInterval(*hints)}
+	switch *durability {
+	case "":
+	case "sync":
+		opts = append(opts, sniper.Durability(sniper.SyncEveryWrite))
+	case "group":
+		opts = append(opts, sniper.Durability(sniper.GroupCommit))
+	case "interval":
+		opts = append(opts, sniper.Durability(sniper.Interval))
+	default:
+		fmt.Fprintf(os.Stderr, "unknown durability mode %s\n", *durability)
+		os.Exit(2)
+	}
+	s, err := sniper.Open(opts...)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	srv := &server{s: s, conns: make(map[net.Conn]struct{})}
+
+	var listeners []net.Listener
+	frontends := []struct {
+		name  string
+		addr  string
+		serve func(net.Conn)
+	}{
+		{"redis", *redisAddr, srv.serveRedis},
+		{"memcached", *memcacheAddr, srv.serveMemcache},
+	}
+	for _, fe := range frontends {
+		if fe.addr == "" {
+			continue
+		}
+		l, err := net.Listen("tcp", fe.addr)
+		if err != nil {
+			srv.shutdown(listeners)
+			s.Close()
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		listeners = append(listeners, l)
+		srv.wg.Add(1)
+		go srv.listen(l, fe.serve)
+		fmt.Printf("%s protocol on %s\n", fe.name, l.Addr())
+	}
+
+	var hs *http.Server
+	if *httpAddr != "" {
+		l, err := net.Listen("tcp", *httpAddr)
+		if err != nil {
+			srv.shutdown(listeners)
+			s.Close()
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		hs = &http.Server{Handler: httpserver.New(s)}
+		go hs.Serve(l)
+		fmt.Printf("http api on %s\n", l.Addr())
+	}
+
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
+	<-sig
+	if hs != nil {
+		hs.Shutdown(context.Background())
+	}
+	srv.shutdown(listeners)
+	err = s.Close()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
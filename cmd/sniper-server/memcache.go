@@ -0,0 +1,592 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"time"
+
+	"github.com/recoilme/sniper"
+)
+
+// values are shared with redis protocol, counters are decimal strings.
+// Nonzero memcached item flags are stored in value record, value is prefixed
+// with header: mcMagic and flags (4 bytes big endian). Value and flags are
+// written at once, item, changed by redis or HTTP, is returned with flags 0.
+// Value with flags 0 is stored as is, if it do not start with mcMagic
+
+const (
+	mcMaxKeyLen   = 250
+	mcRelativeMax = 60 * 60 * 24 * 30 // exptime up to 30 days is relative
+	mcHeaderLen   = 8
+)
+
+var mcMagic = []byte{0xfe, 'm', 'c', 0x01}
+
+// mcStatus - result of memcached operation
+type mcStatus int
+
+const (
+	mcOK mcStatus = iota
+	mcNotFound
+	mcExists
+	mcNotStored
+	mcNonNumeric
+	mcError
+)
+
+// store modes
+const (
+	mcSet = iota
+	mcAdd
+	mcReplace
+	mcCas
+)
+
+// mcExpire convert memcached exptime to store expire:
+// 0 - never, up to 30 days - relative, bigger - unix time,
+// negative - already expired
+func mcExpire(exptime int64) (expire uint32, expired bool) {
+	switch {
+	case exptime == 0:
+		return 0, false
+	case exptime < 0:
+		return 0, true
+	case exptime <= mcRelativeMax:
+		exptime += time.Now().Unix()
+	}
+	if exptime < time.Now().Unix() {
+		return 0, true
+	}
+	if exptime > 1<<32-1 {
+		exptime = 1<<32 - 1
+	}
+	return uint32(exptime), false
+}
+
+// mcEncode return value with flags header, value with flags 0 is not changed
+func mcEncode(v []byte, flags uint32) []byte {
+	if flags == 0 && !bytes.HasPrefix(v, mcMagic) {
+		return v
+	}
+	b := make([]byte, mcHeaderLen+len(v))
+	copy(b, mcMagic)
+	binary.BigEndian.PutUint32(b[len(mcMagic):], flags)
+	copy(b[mcHeaderLen:], v)
+	return b
+}
+
+// mcDecode return value and flags of stored value
+func mcDecode(b []byte) (v []byte, flags uint32) {
+	if len(b) < mcHeaderLen || !bytes.HasPrefix(b, mcMagic) {
+		return b, 0
+	}
+	return b[mcHeaderLen:], binary.BigEndian.Uint32(b[len(mcMagic):])
+}
+
+// mcGet return value, flags and cas unique, cas unique is version of record
+func (srv *server) mcGet(k []byte) (v []byte, flags uint32, cas uint64, err error) {
+	b, meta, err := srv.s.GetWithMeta(k)
+	if err != nil {
+		return
+	}
+	v, flags = mcDecode(b)
+	return v, flags, meta.Version, nil
+}
+
+// mcCas return cas unique of stored item, must be called with locked key
+func (srv *server) mcCas(k []byte) (uint64, error) {
+	_, meta, err := srv.s.GetWithMeta(k)
+	return meta.Version, err
+}
+
+// mcStore - set, add, replace or cas with flags, return cas unique of stored item
+func (srv *server) mcStore(mode int, k, v []byte, flags uint32, exptime int64, cas uint64) (mcStatus, uint64, error) {
+	srv.lock(k)
+	defer srv.unlock(k)
+	return srv.mcStoreValue(mode, k, mcEncode(v, flags), exptime, cas)
+}
+
+// mcStoreValue store value with flags header, must be called with locked key
+func (srv *server) mcStoreValue(mode int, k, v []byte, exptime int64, cas uint64) (mcStatus, uint64, error) {
+	expire, expired := mcExpire(exptime)
+	if !expired && mode != mcSet {
+		var isSet bool
+		var err error
+		switch mode {
+		case mcAdd:
+			isSet, err = srv.s.SetNX(k, v, expire)
+		case mcReplace:
+			isSet, err = srv.s.SetXX(k, v, expire)
+		case mcCas:
+			if cas != 0 {
+				isSet, err = srv.s.SetIfVersion(k, v, cas, expire)
+			}
+		}
+		if err != nil {
+			return mcError, 0, err
+		}
+		if !isSet && mode == mcCas {
+			// item is missing or changed
+			_, err = srv.mcCas(k)
+			if err == sniper.ErrNotFound {
+				return mcNotFound, 0, nil
+			}
+			if err != nil {
+				return mcError, 0, err
+			}
+			return mcExists, 0, nil
+		}
+		if !isSet {
+			return mcNotStored, 0, nil
+		}
+		cas, err = srv.mcCas(k)
+		if err != nil {
+			return mcError, 0, err
+		}
+		return mcOK, cas, nil
+	}
+	if mode != mcSet {
+		cur, err := srv.mcCas(k)
+		if err != nil && err != sniper.ErrNotFound {
+			return mcError, 0, err
+		}
+		exists := err == nil
+		switch {
+		case mode == mcAdd && exists, mode == mcReplace && !exists:
+			return mcNotStored, 0, nil
+		case mode == mcCas && !exists:
+			return mcNotFound, 0, nil
+		case mode == mcCas && cur != cas:
+			return mcExists, 0, nil
+		}
+	}
+	if expired {
+		// item is stored and expired at once
+		_, err := srv.s.Delete(k)
+		if err != nil && err != sniper.ErrNotFound {
+			return mcError, 0, err
+		}
+		return mcOK, 0, nil
+	}
+	err := srv.s.Set(k, v, expire)
+	if err != nil {
+		return mcError, 0, err
+	}
+	cas, err = srv.mcCas(k)
+	if err != nil {
+		return mcError, 0, err
+	}
+	return mcOK, cas, nil
+}
+
+// mcDelete delete key, if cas is not 0 it must match
+func (srv *server) mcDelete(k []byte, cas uint64) (mcStatus, error) {
+	srv.lock(k)
+	defer srv.unlock(k)
+	if cas != 0 {
+		cur, err := srv.mcCas(k)
+		if err == sniper.ErrNotFound {
+			return mcNotFound, nil
+		}
+		if err != nil {
+			return mcError, err
+		}
+		if cur != cas {
+			return mcExists, nil
+		}
+	}
+	isDeleted, err := srv.s.Delete(k)
+	if err != nil && err != sniper.ErrNotFound {
+		return mcError, err
+	}
+	if !isDeleted {
+		return mcNotFound, nil
+	}
+	return mcOK, nil
+}
+
+// mcIncr incr or decr counter, decr stop at 0, incr wrap at 2^64
+// if initial is not nil, missing counter is created with it.
+// Counter is written as decimal string, counter of Store.Incr is read too.
+// It is read and written with Store.Update,
+// so it is atomic with IncrInt of redis, HTTP and command line.
+// counter keep flags, cas unique of counter is returned
+func (srv *server) mcIncr(k []byte, delta uint64, incr bool, initial *uint64, exptime int64) (n, cas uint64, status mcStatus, err error) {
+	srv.lock(k)
+	defer srv.unlock(k)
+	status = mcOK
+	meta, err := srv.s.Update(k, func(old []byte, meta *sniper.Meta) ([]byte, uint32, bool, error) {
+		if meta == nil {
+			if initial == nil {
+				status = mcNotFound
+				return nil, 0, false, nil
+			}
+			expire, expired := mcExpire(exptime)
+			if expired {
+				status = mcNotFound
+				return nil, 0, false, nil
+			}
+			n = *initial
+			return []byte(strconv.FormatUint(n, 10)), expire, true, nil
+		}
+		old, flags := mcDecode(old)
+		var errParse error
+		n, errParse = sniper.ParseCounter(old)
+		if errParse != nil {
+			status = mcNonNumeric
+			return nil, 0, false, nil
+		}
+		if incr {
+			n += delta
+		} else if delta > n {
+			n = 0
+		} else {
+			n -= delta
+		}
+		return mcEncode([]byte(strconv.FormatUint(n, 10)), flags), meta.Expire, true, nil
+	})
+	if err != nil {
+		return 0, 0, mcError, err
+	}
+	if status != mcOK {
+		return 0, 0, status, nil
+	}
+	return n, meta.Version, mcOK, nil
+}
+
+// mcTouch update expire of key
+func (srv *server) mcTouch(k []byte, exptime int64) (mcStatus, error) {
+	srv.lock(k)
+	defer srv.unlock(k)
+	expire, expired := mcExpire(exptime)
+	var err error
+	if expired {
+		var isDeleted bool
+		isDeleted, err = srv.s.Delete(k)
+		if err == nil && !isDeleted {
+			err = sniper.ErrNotFound
+		}
+	} else {
+		err = srv.s.Touch(k, expire)
+	}
+	switch err {
+	case nil:
+		return mcOK, nil
+	case sniper.ErrNotFound:
+		return mcNotFound, nil
+	default:
+		return mcError, err
+	}
+}
+
+// mcFlush delete all keys, now or after delay in seconds
+func (srv *server) mcFlush(delay int64) error {
+	if delay > 0 {
+		time.AfterFunc(time.Duration(delay)*time.Second, func() {
+			if srv.closed() {
+				return
+			}
+			err := srv.mcFlush(0)
+			if err != nil {
+				fmt.Printf("Error flush_all:%s\n", err)
+			}
+		})
+		return nil
+	}
+	var keys [][]byte
+	err := srv.s.Range(func(k, v []byte, expire uint32) bool {
+		keys = append(keys, append([]byte(nil), k...))
+		return true
+	})
+	if err != nil {
+		return err
+	}
+	for _, k := range keys {
+		srv.lock(k)
+		_, err = srv.s.Delete(k)
+		srv.unlock(k)
+		if err != nil && err != sniper.ErrNotFound {
+			return err
+		}
+	}
+	return nil
+}
+
+// serveMemcache serve one memcached client, protocol is detected by first byte
+func (srv *server) serveMemcache(conn net.Conn) {
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	w := bufio.NewWriter(conn)
+	magic, err := r.Peek(1)
+	if err != nil {
+		return
+	}
+	if magic[0] == mcReqMagic {
+		err = srv.serveMemcacheBinary(r, w)
+	} else {
+		err = srv.serveMemcacheText(r, w)
+	}
+	if err != nil && err != io.EOF && !srv.closed() {
+		fmt.Printf("Error memcache:%s\n", err)
+	}
+}
+
+// mcValidKey - key without spaces and control chars, up to 250 bytes
+func mcValidKey(k []byte) bool {
+	if len(k) == 0 || len(k) > mcMaxKeyLen {
+		return false
+	}
+	for _, c := range k {
+		if c <= ' ' || c == 0x7f {
+			return false
+		}
+	}
+	return true
+}
+
+// serveMemcacheText serve memcached text protocol
+func (srv *server) serveMemcacheText(r *bufio.Reader, w *bufio.Writer) error {
+	for {
+		line, err := readLine(r)
+		if err == errProtocol {
+			w.WriteString("CLIENT_ERROR line too long\r\n")
+			w.Flush()
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		args := bytes.Fields(line)
+		if len(args) == 0 {
+			w.WriteString("ERROR\r\n")
+		} else if quit := srv.mcTextCommand(r, w, copyArgs(args)); quit {
+			return w.Flush()
+		}
+		if r.Buffered() == 0 {
+			err = w.Flush()
+			if err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// copyArgs copy args from reader buffer
+func copyArgs(args [][]byte) [][]byte {
+	res := make([][]byte, len(args))
+	for i, a := range args {
+		res[i] = append([]byte(nil), a...)
+	}
+	return res
+}
+
+// noreply check last argument, return args without it
+func noreply(args [][]byte) ([][]byte, bool) {
+	if len(args) > 0 && string(args[len(args)-1]) == "noreply" {
+		return args[:len(args)-1], true
+	}
+	return args, false
+}
+
+// mcTextCommand execute text command, return true on quit
+func (srv *server) mcTextCommand(r *bufio.Reader, w *bufio.Writer, args [][]byte) (quit bool) {
+	reply := func(s string) {
+		w.WriteString(s)
+		w.WriteString("\r\n")
+	}
+	serverError := func(err error) {
+		reply("SERVER_ERROR " + err.Error())
+	}
+	cmd := string(args[0])
+	switch cmd {
+	case "get", "gets":
+		if len(args) < 2 {
+			reply("ERROR")
+			return
+		}
+		for _, k := range args[1:] {
+			v, flags, cas, err := srv.mcGet(k)
+			if err == sniper.ErrNotFound {
+				continue
+			}
+			if err != nil {
+				serverError(err)
+				return
+			}
+			if cmd == "gets" {
+				fmt.Fprintf(w, "VALUE %s %d %d %d\r\n", k, flags, len(v), cas)
+			} else {
+				fmt.Fprintf(w, "VALUE %s %d %d\r\n", k, flags, len(v))
+			}
+			w.Write(v)
+			reply("")
+		}
+		reply("END")
+
+	case "set", "add", "replace", "cas":
+		args, silent := noreply(args)
+		mode := map[string]int{"set": mcSet, "add": mcAdd, "replace": mcReplace, "cas": mcCas}[cmd]
+		want := 5
+		if mode == mcCas {
+			want = 6
+		}
+		if len(args) != want {
+			reply("ERROR")
+			return
+		}
+		flags, errFlags := strconv.ParseUint(string(args[2]), 10, 32)
+		exptime, errExp := strconv.ParseInt(string(args[3]), 10, 64)
+		size, errSize := strconv.Atoi(string(args[4]))
+		var cas uint64
+		var errCas error
+		if mode == mcCas {
+			cas, errCas = strconv.ParseUint(string(args[5]), 10, 64)
+		}
+		if errFlags != nil || errExp != nil || errSize != nil || errCas != nil || size < 0 || size > maxBulkLen {
+			reply("CLIENT_ERROR bad command line format")
+			return
+		}
+		v := make([]byte, size+2)
+		_, err := io.ReadFull(r, v)
+		if err != nil {
+			return true
+		}
+		if v[size] != '\r' || v[size+1] != '\n' {
+			reply("CLIENT_ERROR bad data chunk")
+			return
+		}
+		if !mcValidKey(args[1]) {
+			reply("CLIENT_ERROR bad command line format")
+			return
+		}
+		status, _, err := srv.mcStore(mode, args[1], v[:size], uint32(flags), exptime, cas)
+		if silent && err == nil {
+			return
+		}
+		switch status {
+		case mcOK:
+			reply("STORED")
+		case mcNotStored:
+			reply("NOT_STORED")
+		case mcExists:
+			reply("EXISTS")
+		case mcNotFound:
+			reply("NOT_FOUND")
+		default:
+			serverError(err)
+		}
+
+	case "delete":
+		args, silent := noreply(args)
+		// delete <key> [0], time argument is deprecated
+		if len(args) != 2 && !(len(args) == 3 && string(args[2]) == "0") {
+			reply("CLIENT_ERROR bad command line format")
+			return
+		}
+		status, err := srv.mcDelete(args[1], 0)
+		if silent && err == nil {
+			return
+		}
+		switch status {
+		case mcOK:
+			reply("DELETED")
+		case mcNotFound:
+			reply("NOT_FOUND")
+		default:
+			serverError(err)
+		}
+
+	case "incr", "decr":
+		args, silent := noreply(args)
+		if len(args) != 3 {
+			reply("ERROR")
+			return
+		}
+		delta, err := strconv.ParseUint(string(args[2]), 10, 64)
+		if err != nil {
+			reply("CLIENT_ERROR invalid numeric delta argument")
+			return
+		}
+		n, _, status, err := srv.mcIncr(args[1], delta, cmd == "incr", nil, 0)
+		if silent && err == nil {
+			return
+		}
+		switch status {
+		case mcOK:
+			reply(strconv.FormatUint(n, 10))
+		case mcNotFound:
+			reply("NOT_FOUND")
+		case mcNonNumeric:
+			reply("CLIENT_ERROR cannot increment or decrement non-numeric value")
+		default:
+			serverError(err)
+		}
+
+	case "touch":
+		args, silent := noreply(args)
+		if len(args) != 3 {
+			reply("ERROR")
+			return
+		}
+		exptime, err := strconv.ParseInt(string(args[2]), 10, 64)
+		if err != nil {
+			reply("CLIENT_ERROR invalid exptime argument")
+			return
+		}
+		status, err := srv.mcTouch(args[1], exptime)
+		if silent && err == nil {
+			return
+		}
+		switch status {
+		case mcOK:
+			reply("TOUCHED")
+		case mcNotFound:
+			reply("NOT_FOUND")
+		default:
+			serverError(err)
+		}
+
+	case "flush_all":
+		args, silent := noreply(args)
+		var delay int64
+		if len(args) > 2 {
+			reply("ERROR")
+			return
+		}
+		if len(args) == 2 {
+			var err error
+			delay, err = strconv.ParseInt(string(args[1]), 10, 64)
+			if err != nil {
+				reply("CLIENT_ERROR bad command line format")
+				return
+			}
+		}
+		err := srv.mcFlush(delay)
+		if silent && err == nil {
+			return
+		}
+		if err != nil {
+			serverError(err)
+			return
+		}
+		reply("OK")
+
+	case "version":
+		reply("VERSION " + sniper.Version)
+
+	case "verbosity":
+		reply("OK")
+
+	case "quit":
+		return true
+
+	default:
+		reply("ERROR")
+	}
+	return
+}
@@ -0,0 +1,305 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"io"
+
+	"github.com/recoilme/sniper"
+)
+
+// memcached binary protocol
+// https://github.com/memcached/memcached/wiki/BinaryProtocolRevamped
+
+const (
+	mcReqMagic = 0x80
+	mcResMagic = 0x81
+	mcHeadLen  = 24
+)
+
+// binary opcodes
+const (
+	opGet       = 0x00
+	opSet       = 0x01
+	opAdd       = 0x02
+	opReplace   = 0x03
+	opDelete    = 0x04
+	opIncrement = 0x05
+	opDecrement = 0x06
+	opQuit      = 0x07
+	opFlush     = 0x08
+	opGetQ      = 0x09
+	opNoop      = 0x0a
+	opVersion   = 0x0b
+	opGetK      = 0x0c
+	opGetKQ     = 0x0d
+	opSetQ      = 0x11
+	opAddQ      = 0x12
+	opReplaceQ  = 0x13
+	opDeleteQ   = 0x14
+	opIncrQ     = 0x15
+	opDecrQ     = 0x16
+	opQuitQ     = 0x17
+	opFlushQ    = 0x18
+	opTouch     = 0x1c
+)
+
+// binary response status
+const (
+	stOK         = 0x00
+	stNotFound   = 0x01
+	stExists     = 0x02
+	stTooLarge   = 0x03
+	stInvalid    = 0x04
+	stNotStored  = 0x05
+	stNonNumeric = 0x06
+	stUnknown    = 0x81
+	stInternal   = 0x84
+)
+
+// mcRequest - binary request
+type mcRequest struct {
+	opcode byte
+	opaque uint32
+	cas    uint64
+	extras []byte
+	key    []byte
+	value  []byte
+}
+
+// readRequest read binary request
+func readRequest(r *bufio.Reader) (req *mcRequest, err error) {
+	head := make([]byte, mcHeadLen)
+	_, err = io.ReadFull(r, head)
+	if err != nil {
+		return
+	}
+	if head[0] != mcReqMagic {
+		return nil, errProtocol
+	}
+	keylen := int(binary.BigEndian.Uint16(head[2:4]))
+	extlen := int(head[4])
+	total := int(binary.BigEndian.Uint32(head[8:12]))
+	if total < keylen+extlen || total > maxBulkLen {
+		return nil, errProtocol
+	}
+	body := make([]byte, total)
+	_, err = io.ReadFull(r, body)
+	if err != nil {
+		return
+	}
+	req = &mcRequest{
+		opcode: head[1],
+		opaque: binary.BigEndian.Uint32(head[12:16]),
+		cas:    binary.BigEndian.Uint64(head[16:24]),
+		extras: body[:extlen],
+		key:    body[extlen : extlen+keylen],
+		value:  body[extlen+keylen:],
+	}
+	return
+}
+
+// writeResponse write binary response
+func writeResponse(w *bufio.Writer, req *mcRequest, status uint16, cas uint64, extras, key, value []byte) {
+	head := make([]byte, mcHeadLen)
+	head[0] = mcResMagic
+	head[1] = req.opcode
+	binary.BigEndian.PutUint16(head[2:4], uint16(len(key)))
+	head[4] = byte(len(extras))
+	binary.BigEndian.PutUint16(head[6:8], status)
+	binary.BigEndian.PutUint32(head[8:12], uint32(len(extras)+len(key)+len(value)))
+	binary.BigEndian.PutUint32(head[12:16], req.opaque)
+	binary.BigEndian.PutUint64(head[16:24], cas)
+	w.Write(head)
+	w.Write(extras)
+	w.Write(key)
+	w.Write(value)
+}
+
+// binaryStatus convert status of operation to binary status
+func binaryStatus(status mcStatus) uint16 {
+	switch status {
+	case mcOK:
+		return stOK
+	case mcNotFound:
+		return stNotFound
+	case mcExists:
+		return stExists
+	case mcNotStored:
+		return stNotStored
+	case mcNonNumeric:
+		return stNonNumeric
+	}
+	return stInternal
+}
+
+// serveMemcacheBinary serve memcached binary protocol
+func (srv *server) serveMemcacheBinary(r *bufio.Reader, w *bufio.Writer) error {
+	for {
+		req, err := readRequest(r)
+		if err != nil {
+			return err
+		}
+		if quit := srv.mcBinaryCommand(w, req); quit {
+			return w.Flush()
+		}
+		if r.Buffered() == 0 {
+			err = w.Flush()
+			if err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// mcBinaryCommand execute binary command, return true on quit
+func (srv *server) mcBinaryCommand(w *bufio.Writer, req *mcRequest) (quit bool) {
+	// quiet commands do not reply on success
+	quiet := false
+	reply := func(status uint16, cas uint64, extras, key, value []byte) {
+		if quiet && status == stOK {
+			return
+		}
+		writeResponse(w, req, status, cas, extras, key, value)
+	}
+	fail := func(status uint16, msg string) {
+		writeResponse(w, req, status, 0, nil, nil, []byte(msg))
+	}
+	if req.opcode != opNoop && req.opcode != opVersion && req.opcode != opQuit && req.opcode != opQuitQ &&
+		req.opcode != opFlush && req.opcode != opFlushQ && !mcValidKey(req.key) {
+		fail(stInvalid, "Invalid arguments")
+		return
+	}
+
+	switch req.opcode {
+	case opGet, opGetQ, opGetK, opGetKQ:
+		v, flags, cas, err := srv.mcGet(req.key)
+		if err == sniper.ErrNotFound {
+			// quiet get do not reply on miss
+			if req.opcode == opGet || req.opcode == opGetK {
+				fail(stNotFound, "Not found")
+			}
+			return
+		}
+		if err != nil {
+			fail(stInternal, err.Error())
+			return
+		}
+		var key []byte
+		if req.opcode == opGetK || req.opcode == opGetKQ {
+			key = req.key
+		}
+		extras := make([]byte, 4)
+		binary.BigEndian.PutUint32(extras, flags)
+		writeResponse(w, req, stOK, cas, extras, key, v)
+
+	case opSet, opSetQ, opAdd, opAddQ, opReplace, opReplaceQ:
+		quiet = req.opcode == opSetQ || req.opcode == opAddQ || req.opcode == opReplaceQ
+		if len(req.extras) != 8 {
+			fail(stInvalid, "Invalid arguments")
+			return
+		}
+		flags := binary.BigEndian.Uint32(req.extras[0:4])
+		exptime := int64(binary.BigEndian.Uint32(req.extras[4:8]))
+		mode := mcSet
+		switch {
+		case req.cas != 0:
+			mode = mcCas
+		case req.opcode == opAdd || req.opcode == opAddQ:
+			mode = mcAdd
+		case req.opcode == opReplace || req.opcode == opReplaceQ:
+			mode = mcReplace
+		}
+		status, cas, err := srv.mcStore(mode, req.key, req.value, flags, exptime, req.cas)
+		if err != nil {
+			fail(stInternal, err.Error())
+			return
+		}
+		// binary protocol report reason, why item is not stored
+		if status == mcNotStored && mode == mcAdd {
+			status = mcExists
+		} else if status == mcNotStored && mode == mcReplace {
+			status = mcNotFound
+		}
+		reply(binaryStatus(status), cas, nil, nil, nil)
+
+	case opDelete, opDeleteQ:
+		quiet = req.opcode == opDeleteQ
+		status, err := srv.mcDelete(req.key, req.cas)
+		if err != nil {
+			fail(stInternal, err.Error())
+			return
+		}
+		reply(binaryStatus(status), 0, nil, nil, nil)
+
+	case opIncrement, opDecrement, opIncrQ, opDecrQ:
+		quiet = req.opcode == opIncrQ || req.opcode == opDecrQ
+		if len(req.extras) != 20 {
+			fail(stInvalid, "Invalid arguments")
+			return
+		}
+		delta := binary.BigEndian.Uint64(req.extras[0:8])
+		initial := binary.BigEndian.Uint64(req.extras[8:16])
+		exptime := binary.BigEndian.Uint32(req.extras[16:20])
+		init := &initial
+		if exptime == 0xffffffff {
+			// do not create missing counter
+			init = nil
+		}
+		incr := req.opcode == opIncrement || req.opcode == opIncrQ
+		n, cas, status, err := srv.mcIncr(req.key, delta, incr, init, int64(exptime))
+		if err != nil {
+			fail(stInternal, err.Error())
+			return
+		}
+		if status != mcOK {
+			fail(binaryStatus(status), "Incr/decr failed")
+			return
+		}
+		value := make([]byte, 8)
+		binary.BigEndian.PutUint64(value, n)
+		reply(stOK, cas, nil, nil, value)
+
+	case opTouch:
+		if len(req.extras) != 4 {
+			fail(stInvalid, "Invalid arguments")
+			return
+		}
+		status, err := srv.mcTouch(req.key, int64(binary.BigEndian.Uint32(req.extras)))
+		if err != nil {
+			fail(stInternal, err.Error())
+			return
+		}
+		reply(binaryStatus(status), 0, nil, nil, nil)
+
+	case opFlush, opFlushQ:
+		quiet = req.opcode == opFlushQ
+		var delay int64
+		if len(req.extras) == 4 {
+			delay = int64(binary.BigEndian.Uint32(req.extras))
+		}
+		err := srv.mcFlush(delay)
+		if err != nil {
+			fail(stInternal, err.Error())
+			return
+		}
+		reply(stOK, 0, nil, nil, nil)
+
+	case opNoop:
+		reply(stOK, 0, nil, nil, nil)
+
+	case opVersion:
+		reply(stOK, 0, nil, nil, []byte(sniper.Version))
+
+	case opQuit:
+		reply(stOK, 0, nil, nil, nil)
+		return true
+
+	case opQuitQ:
+		return true
+
+	default:
+		fail(stUnknown, "Unknown command")
+	}
+	return
+}
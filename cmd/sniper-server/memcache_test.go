@@ -0,0 +1,113 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/recoilme/sniper"
+	"github.com/stretchr/testify/assert"
+)
+
+func newTestServer(t *testing.T) *server {
+	s, err := sniper.Open(sniper.FS(sniper.NewMemFS()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &server{s: s, conns: make(map[net.Conn]struct{})}
+}
+
+// mcText execute text command with data block and return reply
+func mcText(srv *server, line, data string) string {
+	var out bytes.Buffer
+	w := bufio.NewWriter(&out)
+	r := bufio.NewReader(strings.NewReader(data))
+	var args [][]byte
+	for _, a := range strings.Fields(line) {
+		args = append(args, []byte(a))
+	}
+	srv.mcTextCommand(r, w, args)
+	w.Flush()
+	return out.String()
+}
+
+// mcBinary execute binary command and return status, extras and value of reply
+func mcBinary(srv *server, req *mcRequest) (status uint16, extras, value []byte) {
+	var out bytes.Buffer
+	w := bufio.NewWriter(&out)
+	srv.mcBinaryCommand(w, req)
+	w.Flush()
+	res := out.Bytes()
+	if len(res) < mcHeadLen {
+		return 0, nil, nil
+	}
+	status = binary.BigEndian.Uint16(res[6:8])
+	extLen := int(res[4])
+	keyLen := int(binary.BigEndian.Uint16(res[2:4]))
+	body := res[mcHeadLen:]
+	return status, body[:extLen], body[extLen+keyLen:]
+}
+
+func TestMemcacheFlags(t *testing.T) {
+	srv := newTestServer(t)
+	defer srv.s.Close()
+
+	assert.Equal(t, "STORED\r\n", mcText(srv, "set k 42 0 1", "v\r\n"))
+	assert.Equal(t, "VALUE k 42 1\r\nv\r\nEND\r\n", mcText(srv, "get k", ""))
+	assert.Contains(t, mcText(srv, "gets k", ""), "VALUE k 42 1 ")
+
+	// binary get return flags in extras
+	status, extras, value := mcBinary(srv, &mcRequest{opcode: opGetK, key: []byte("k")})
+	assert.Equal(t, uint16(stOK), status)
+	assert.Equal(t, []byte{0, 0, 0, 42}, extras)
+	assert.Equal(t, "v", string(value))
+
+	// binary set store flags for text get
+	setExtras := []byte{0xde, 0xad, 0xbe, 0xef, 0, 0, 0, 0}
+	status, _, _ = mcBinary(srv, &mcRequest{opcode: opSet, key: []byte("b"), extras: setExtras, value: []byte("x")})
+	assert.Equal(t, uint16(stOK), status)
+	assert.Equal(t, "VALUE b 3735928559 1\r\nx\r\nEND\r\n", mcText(srv, "get b", ""))
+
+	// touch and incr keep flags
+	assert.Equal(t, "STORED\r\n", mcText(srv, "set n 7 0 1", "1\r\n"))
+	assert.Equal(t, "TOUCHED\r\n", mcText(srv, "touch n 100", ""))
+	assert.Equal(t, "3\r\n", mcText(srv, "incr n 2", ""))
+	assert.Equal(t, "VALUE n 7 1\r\n3\r\nEND\r\n", mcText(srv, "get n", ""))
+
+	// set with flags 0 and write from other frontend reset flags
+	assert.Equal(t, "STORED\r\n", mcText(srv, "set k 0 0 1", "w\r\n"))
+	assert.Equal(t, "VALUE k 0 1\r\nw\r\nEND\r\n", mcText(srv, "get k", ""))
+	assert.Equal(t, "STORED\r\n", mcText(srv, "set b 5 0 1", "y\r\n"))
+	assert.NoError(t, srv.s.Set([]byte("b"), []byte("z"), 0))
+	assert.Equal(t, "VALUE b 0 1\r\nz\r\nEND\r\n", mcText(srv, "get b", ""))
+
+	// cas keep new flags, delete remove them
+	_, _, cas, err := srv.mcGet([]byte("n"))
+	assert.NoError(t, err)
+	st, cas, err := srv.mcStore(mcCas, []byte("n"), []byte("9"), 11, 0, cas)
+	assert.NoError(t, err)
+	assert.Equal(t, mcOK, st)
+	v, flags, cur, err := srv.mcGet([]byte("n"))
+	assert.NoError(t, err)
+	assert.Equal(t, "9", string(v))
+	assert.Equal(t, uint32(11), flags)
+	assert.Equal(t, cas, cur)
+	assert.Equal(t, "DELETED\r\n", mcText(srv, "delete n", ""))
+
+	// flags are kept in value record, no other records are written
+	assert.Equal(t, 2, srv.s.Count())
+	var keys []string
+	srv.s.Range(func(k, v []byte, expire uint32) bool {
+		keys = append(keys, string(k))
+		return true
+	})
+	assert.ElementsMatch(t, []string{"k", "b"}, keys)
+
+	// value, which look like header, round trip with flags 0
+	fake := string(mcMagic) + "\x00\x00\x00\x01v"
+	assert.Equal(t, "STORED\r\n", mcText(srv, "set m 0 0 9", fake+"\r\n"))
+	assert.Equal(t, "VALUE m 0 9\r\n"+fake+"\r\nEND\r\n", mcText(srv, "get m", ""))
+}
@@ -0,0 +1,490 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/recoilme/sniper"
+)
+
+// redis command handler, args[0] is command name
+type redisHandler func(srv *server, rw *respWriter, args [][]byte)
+
+// redisCommand - handler and arity, negative arity is minimum
+type redisCommand struct {
+	handler redisHandler
+	arity   int
+}
+
+var redisCommands map[string]redisCommand
+
+func init() {
+	redisCommands = map[string]redisCommand{
+		"ping":    {cmdPing, -1},
+		"echo":    {cmdEcho, 2},
+		"hello":   {cmdHello, -1},
+		"select":  {cmdSelect, 2},
+		"command": {cmdCommand, -1},
+		"client":  {cmdClient, -2},
+		"get":     {cmdGet, 2},
+		"set":     {cmdSet, -3},
+		"del":     {cmdDel, -2},
+		"exists":  {cmdExists, -2},
+		"incr":    {cmdIncr, 2},
+		"decr":    {cmdDecr, 2},
+		"incrby":  {cmdIncrBy, 3},
+		"decrby":  {cmdDecrBy, 3},
+		"expire":  {cmdExpire, 3},
+		"ttl":     {cmdTTL, 2},
+		"pttl":    {cmdPTTL, 2},
+		"dbsize":  {cmdDBSize, 1},
+		"mget":    {cmdMGet, -2},
+		"mset":    {cmdMSet, -3},
+	}
+}
+
+// serveRedis serve one redis client
+func (srv *server) serveRedis(conn net.Conn) {
+	defer conn.Close()
+	rr := &respReader{r: bufio.NewReader(conn)}
+	rw := &respWriter{w: bufio.NewWriter(conn), proto: 2}
+	for {
+		args, err := rr.readCommand()
+		if err != nil {
+			if err == errProtocol {
+				rw.error(err.Error())
+				rw.w.Flush()
+			} else if err != io.EOF && !srv.closed() {
+				fmt.Printf("Error read:%s\n", err)
+			}
+			return
+		}
+		name := strings.ToLower(string(args[0]))
+		if name == "quit" {
+			rw.simple("OK")
+			rw.w.Flush()
+			return
+		}
+		cmd, ok := redisCommands[name]
+		switch {
+		case !ok:
+			rw.error(fmt.Sprintf("ERR unknown command '%s'", args[0]))
+		case cmd.arity > 0 && len(args) != cmd.arity || cmd.arity < 0 && len(args) < -cmd.arity:
+			rw.error(fmt.Sprintf("ERR wrong number of arguments for '%s' command", name))
+		default:
+			cmd.handler(srv, rw, args)
+		}
+		// flush, when all pipelined commands are done
+		if rr.r.Buffered() == 0 {
+			if rw.w.Flush() != nil {
+				return
+			}
+		}
+	}
+}
+
+// storeError write store error
+func storeError(rw *respWriter, err error) {
+	rw.error("ERR " + err.Error())
+}
+
+func cmdPing(srv *server, rw *respWriter, args [][]byte) {
+	switch len(args) {
+	case 1:
+		rw.simple("PONG")
+	case 2:
+		rw.bulk(args[1])
+	default:
+		rw.error("ERR wrong number of arguments for 'ping' command")
+	}
+}
+
+func cmdEcho(srv *server, rw *respWriter, args [][]byte) {
+	rw.bulk(args[1])
+}
+
+// cmdHello - HELLO [protover [AUTH username password] [SETNAME clientname]]
+func cmdHello(srv *server, rw *respWriter, args [][]byte) {
+	if len(args) > 1 {
+		proto, err := strconv.Atoi(string(args[1]))
+		if err != nil {
+			rw.error("ERR Protocol version is not an integer or out of range")
+			return
+		}
+		if proto != 2 && proto != 3 {
+			rw.error("NOPROTO unsupported protocol version")
+			return
+		}
+		rw.proto = proto
+	}
+	rw.dict(7)
+	rw.bulk([]byte("server"))
+	rw.bulk([]byte("sniper"))
+	rw.bulk([]byte("version"))
+	rw.bulk([]byte(sniper.Version))
+	rw.bulk([]byte("proto"))
+	rw.integer(int64(rw.proto))
+	rw.bulk([]byte("id"))
+	rw.integer(0)
+	rw.bulk([]byte("mode"))
+	rw.bulk([]byte("standalone"))
+	rw.bulk([]byte("role"))
+	rw.bulk([]byte("master"))
+	rw.bulk([]byte("modules"))
+	rw.array(0)
+}
+
+// cmdSelect - only database 0 exists
+func cmdSelect(srv *server, rw *respWriter, args [][]byte) {
+	if string(args[1]) != "0" {
+		rw.error("ERR DB index is out of range")
+		return
+	}
+	rw.simple("OK")
+}
+
+// cmdCommand - empty command list, clients fall back to defaults
+func cmdCommand(srv *server, rw *respWriter, args [][]byte) {
+	rw.array(0)
+}
+
+// cmdClient - accept client setname/setinfo
+func cmdClient(srv *server, rw *respWriter, args [][]byte) {
+	rw.simple("OK")
+}
+
+func cmdGet(srv *server, rw *respWriter, args [][]byte) {
+	v, err := srv.s.Get(args[1])
+	switch err {
+	case nil:
+		rw.bulk(v)
+	case sniper.ErrNotFound:
+		rw.null()
+	default:
+		storeError(rw, err)
+	}
+}
+
+// cmdSet - SET key value [EX seconds|PX milliseconds|EXAT timestamp|PXAT timestamp|KEEPTTL] [NX|XX]
+func cmdSet(srv *server, rw *respWriter, args [][]byte) {
+	k, v := args[1], args[2]
+	var expire uint32
+	var nx, xx, keepttl, hasExpire bool
+	for i := 3; i < len(args); i++ {
+		opt := strings.ToLower(string(args[i]))
+		switch opt {
+		case "nx":
+			nx = true
+		case "xx":
+			xx = true
+		case "keepttl":
+			keepttl = true
+		case "ex", "px", "exat", "pxat":
+			if hasExpire || i+1 >= len(args) {
+				rw.error("ERR syntax error")
+				return
+			}
+			i++
+			n, err := strconv.ParseInt(string(args[i]), 10, 64)
+			if err != nil {
+				rw.error("ERR value is not an integer or out of range")
+				return
+			}
+			expire, err = expireAt(opt, n)
+			if err != nil {
+				rw.error("ERR invalid expire time in 'set' command")
+				return
+			}
+			hasExpire = true
+		default:
+			rw.error("ERR syntax error")
+			return
+		}
+	}
+	if nx && xx || keepttl && hasExpire {
+		rw.error("ERR syntax error")
+		return
+	}
+	if len(k) > maxKeyLen {
+		rw.error("ERR key is too long")
+		return
+	}
+
+	srv.lock(k)
+	defer srv.unlock(k)
+	if (nx || xx) && !keepttl {
+		setIf := srv.s.SetNX
+		if xx {
+			setIf = srv.s.SetXX
+		}
+		isSet, err := setIf(k, v, expire)
+		if err != nil {
+			storeError(rw, err)
+			return
+		}
+		if !isSet {
+			rw.null()
+			return
+		}
+		rw.simple("OK")
+		return
+	}
+	if nx || xx || keepttl {
+		ttl, err := srv.s.TTL(k)
+		if err != nil && err != sniper.ErrNotFound {
+			storeError(rw, err)
+			return
+		}
+		exists := err == nil
+		if nx && exists || xx && !exists {
+			rw.null()
+			return
+		}
+		if keepttl && exists {
+			expire = expireFromTTL(ttl)
+		}
+	}
+	err := srv.s.Set(k, v, expire)
+	if err != nil {
+		storeError(rw, err)
+		return
+	}
+	rw.simple("OK")
+}
+
+// expireAt convert redis expire option to unix time in seconds
+// milliseconds are rounded up, store keep expire in seconds
+func expireAt(opt string, n int64) (uint32, error) {
+	now := time.Now()
+	var at int64
+	switch opt {
+	case "ex":
+		if n <= 0 || n > math.MaxUint32 {
+			return 0, errors.New("bad expire")
+		}
+		at = now.Unix() + n
+	case "px":
+		if n <= 0 || n/1000 > math.MaxUint32 {
+			return 0, errors.New("bad expire")
+		}
+		at = (now.UnixMilli() + n + 999) / 1000
+	case "exat":
+		at = n
+	case "pxat":
+		at = (n + 999) / 1000
+	}
+	if at <= 0 || at > math.MaxUint32 {
+		return 0, errors.New("bad expire")
+	}
+	return uint32(at), nil
+}
+
+// expireFromTTL return unix time of expire, 0 if key has no expire
+func expireFromTTL(ttl time.Duration) uint32 {
+	if ttl < 0 {
+		return 0
+	}
+	return uint32(time.Now().Add(ttl).Round(time.Second).Unix())
+}
+
+func cmdDel(srv *server, rw *respWriter, args [][]byte) {
+	var n int64
+	for _, k := range args[1:] {
+		srv.lock(k)
+		isDeleted, err := srv.s.Delete(k)
+		srv.unlock(k)
+		if err != nil && err != sniper.ErrNotFound {
+			storeError(rw, err)
+			return
+		}
+		if isDeleted {
+			n++
+		}
+	}
+	rw.integer(n)
+}
+
+func cmdExists(srv *server, rw *respWriter, args [][]byte) {
+	var n int64
+	for _, k := range args[1:] {
+		// TTL do not read value
+		_, err := srv.s.TTL(k)
+		if err == sniper.ErrNotFound {
+			continue
+		}
+		if err != nil {
+			storeError(rw, err)
+			return
+		}
+		n++
+	}
+	rw.integer(n)
+}
+
+func cmdIncr(srv *server, rw *respWriter, args [][]byte) {
+	srv.incrBy(rw, args[1], 1)
+}
+
+func cmdDecr(srv *server, rw *respWriter, args [][]byte) {
+	srv.incrBy(rw, args[1], -1)
+}
+
+func cmdIncrBy(srv *server, rw *respWriter, args [][]byte) {
+	delta, err := strconv.ParseInt(string(args[2]), 10, 64)
+	if err != nil {
+		rw.error("ERR value is not an integer or out of range")
+		return
+	}
+	srv.incrBy(rw, args[1], delta)
+}
+
+func cmdDecrBy(srv *server, rw *respWriter, args [][]byte) {
+	delta, err := strconv.ParseInt(string(args[2]), 10, 64)
+	if err != nil || delta == math.MinInt64 {
+		rw.error("ERR value is not an integer or out of range")
+		return
+	}
+	srv.incrBy(rw, args[1], -delta)
+}
+
+// incrBy - counters are stored as decimal strings, same as in redis,
+// so they are readable by GET. Counter is changed with Store.IncrInt,
+// same as by memcached, HTTP and command line incr. Expire of key is kept
+func (srv *server) incrBy(rw *respWriter, k []byte, delta int64) {
+	if len(k) > maxKeyLen {
+		rw.error("ERR key is too long")
+		return
+	}
+	srv.lock(k)
+	defer srv.unlock(k)
+	n, err := srv.s.IncrInt(k, delta)
+	switch err {
+	case nil:
+		rw.integer(n)
+	case sniper.ErrNotNumber:
+		rw.error("ERR value is not an integer or out of range")
+	case sniper.ErrOverflow:
+		rw.error("ERR increment or decrement would overflow")
+	default:
+		storeError(rw, err)
+	}
+}
+
+// cmdExpire - EXPIRE key seconds, not positive seconds delete key
+func cmdExpire(srv *server, rw *respWriter, args [][]byte) {
+	sec, err := strconv.ParseInt(string(args[2]), 10, 64)
+	if err != nil {
+		rw.error("ERR value is not an integer or out of range")
+		return
+	}
+	k := args[1]
+	srv.lock(k)
+	defer srv.unlock(k)
+	if sec <= 0 {
+		isDeleted, err := srv.s.Delete(k)
+		if err != nil && err != sniper.ErrNotFound {
+			storeError(rw, err)
+			return
+		}
+		if isDeleted {
+			rw.integer(1)
+		} else {
+			rw.integer(0)
+		}
+		return
+	}
+	expire, err := expireAt("ex", sec)
+	if err != nil {
+		rw.error("ERR invalid expire time in 'expire' command")
+		return
+	}
+	err = srv.s.Touch(k, expire)
+	switch err {
+	case nil:
+		rw.integer(1)
+	case sniper.ErrNotFound:
+		rw.integer(0)
+	default:
+		storeError(rw, err)
+	}
+}
+
+func cmdTTL(srv *server, rw *respWriter, args [][]byte) {
+	ttl(srv, rw, args[1], time.Second)
+}
+
+func cmdPTTL(srv *server, rw *respWriter, args [][]byte) {
+	ttl(srv, rw, args[1], time.Millisecond)
+}
+
+// ttl write remaining time in units, -2 if key not exists, -1 if key has no expire
+func ttl(srv *server, rw *respWriter, k []byte, unit time.Duration) {
+	d, err := srv.s.TTL(k)
+	switch {
+	case err == sniper.ErrNotFound:
+		rw.integer(-2)
+	case err != nil:
+		storeError(rw, err)
+	case d < 0:
+		rw.integer(-1)
+	default:
+		rw.integer(int64(d.Round(unit) / unit))
+	}
+}
+
+func cmdDBSize(srv *server, rw *respWriter, args [][]byte) {
+	rw.integer(int64(srv.s.Count()))
+}
+
+func cmdMGet(srv *server, rw *respWriter, args [][]byte) {
+	values, errs := srv.s.GetMulti(args[1:])
+	// redis return nil for missing keys, other errors fail
+	// whole command, same as for GET
+	for _, err := range errs {
+		if err != nil && err != sniper.ErrNotFound {
+			storeError(rw, err)
+			return
+		}
+	}
+	rw.array(len(values))
+	for i, v := range values {
+		if errs[i] != nil {
+			rw.null()
+			continue
+		}
+		rw.bulk(v)
+	}
+}
+
+// cmdMSet - all keys are set atomically
+func cmdMSet(srv *server, rw *respWriter, args [][]byte) {
+	if len(args)%2 != 1 {
+		rw.error("ERR wrong number of arguments for 'mset' command")
+		return
+	}
+	var b sniper.Batch
+	keys := make([][]byte, 0, len(args)/2)
+	for i := 1; i < len(args); i += 2 {
+		if len(args[i]) > maxKeyLen {
+			rw.error("ERR key is too long")
+			return
+		}
+		b.Set(args[i], args[i+1], 0)
+		keys = append(keys, args[i])
+	}
+	srv.lockKeys(keys)
+	defer srv.unlockKeys(keys)
+	err := srv.s.Write(&b)
+	if err != nil {
+		storeError(rw, err)
+		return
+	}
+	rw.simple("OK")
+}
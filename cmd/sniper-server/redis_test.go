@@ -0,0 +1,137 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/recoilme/sniper"
+	"github.com/recoilme/sniper/httpserver"
+	"github.com/stretchr/testify/assert"
+)
+
+// redisClient - client side of connection, served by serveRedis
+type redisClient struct {
+	conn net.Conn
+	r    *bufio.Reader
+}
+
+func newRedisClient(srv *server) *redisClient {
+	client, conn := net.Pipe()
+	go srv.serveRedis(conn)
+	return &redisClient{conn: client, r: bufio.NewReader(client)}
+}
+
+// do send command and return first line of reply
+func (c *redisClient) do(args ...string) string {
+	cmd := fmt.Sprintf("*%d\r\n", len(args))
+	for _, a := range args {
+		cmd += fmt.Sprintf("$%d\r\n%s\r\n", len(a), a)
+	}
+	go c.conn.Write([]byte(cmd))
+	return c.next()
+}
+
+// httpDo execute HTTP request and return status and body
+func httpDo(h http.Handler, method, path, body string) (int, string) {
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(method, path, strings.NewReader(body)))
+	return rec.Code, strings.TrimSpace(rec.Body.String())
+}
+
+func TestIncrAcrossFrontends(t *testing.T) {
+	srv := newTestServer(t)
+	defer srv.s.Close()
+	rc := newRedisClient(srv)
+	defer rc.conn.Close()
+	hs := httpserver.New(srv.s)
+
+	// INCR over RESP, read through HTTP
+	assert.Equal(t, ":1", rc.do("INCR", "cnt"))
+	assert.Equal(t, ":11", rc.do("INCRBY", "cnt", "10"))
+	code, body := httpDo(hs, http.MethodGet, "/kv/cnt", "")
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, "11", body)
+
+	// incr through HTTP, read over RESP
+	code, body = httpDo(hs, http.MethodPost, "/incr/cnt?by=5", "")
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, `{"value":16}`, body)
+	assert.Equal(t, "16", rc.do("GET", "cnt"))
+	assert.Equal(t, ":15", rc.do("DECR", "cnt"))
+
+	// value, set by HTTP, is counter for redis and memcached
+	code, _ = httpDo(hs, http.MethodPut, "/kv/n", "41")
+	assert.Equal(t, http.StatusNoContent, code)
+	assert.Equal(t, ":42", rc.do("INCR", "n"))
+	assert.Equal(t, "43\r\n", mcText(srv, "incr n 1", ""))
+	code, body = httpDo(hs, http.MethodPost, "/incr/n", "")
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, `{"value":44}`, body)
+
+	// counter of Store.Incr (8 bytes big endian) is rewritten as decimal
+	_, err := srv.s.Incr([]byte("lib"), 41)
+	assert.NoError(t, err)
+	assert.Equal(t, ":42", rc.do("INCR", "lib"))
+	assert.Equal(t, "42", rc.do("GET", "lib"))
+	_, err = srv.s.Incr([]byte("lib2"), 41)
+	assert.NoError(t, err)
+	assert.Equal(t, "42\r\n", mcText(srv, "incr lib2 1", ""))
+	assert.Equal(t, "VALUE lib2 0 2\r\n42\r\nEND\r\n", mcText(srv, "get lib2", ""))
+
+	// not a number for every frontend
+	assert.Equal(t, "+OK", rc.do("SET", "s", "abc"))
+	assert.True(t, strings.HasPrefix(rc.do("INCR", "s"), "-ERR"))
+	code, _ = httpDo(hs, http.MethodPost, "/incr/s", "")
+	assert.Equal(t, http.StatusConflict, code)
+	assert.True(t, strings.HasPrefix(mcText(srv, "incr s 1", ""), "CLIENT_ERROR"))
+}
+
+func TestMGetError(t *testing.T) {
+	fs := sniper.NewMemFS()
+	s, err := sniper.Open(sniper.FS(fs), sniper.ChunksCollision(0), sniper.ChunksTotal(1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	srv := &server{s: s, conns: make(map[net.Conn]struct{})}
+	rc := newRedisClient(srv)
+	defer rc.conn.Close()
+
+	assert.Equal(t, "+OK", rc.do("SET", "key", "value"))
+	assert.Equal(t, "*2", rc.do("MGET", "key", "missing"))
+	assert.Equal(t, "value", rc.next())
+	assert.Equal(t, "$-1", rc.next())
+
+	// damaged record is error, not missing key
+	f, err := fs.OpenFile("0", os.O_RDWR, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := make([]byte, 1)
+	f.ReadAt(b, 26)
+	b[0] ^= 1
+	f.WriteAt(b, 26)
+	f.Close()
+	assert.True(t, strings.HasPrefix(rc.do("GET", "key"), "-ERR"))
+	assert.True(t, strings.HasPrefix(rc.do("MGET", "missing", "key"), "-ERR"))
+}
+
+// next read next element of reply, value of bulk string
+func (c *redisClient) next() string {
+	line, err := c.r.ReadString('\n')
+	if err != nil {
+		return err.Error()
+	}
+	line = strings.TrimSuffix(line, "\r\n")
+	if strings.HasPrefix(line, "$") && line != "$-1" {
+		v, _ := c.r.ReadString('\n')
+		return strings.TrimSuffix(v, "\r\n")
+	}
+	return line
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"io"
+	"strconv"
+)
+
+const (
+	maxBulkLen  = 512 << 20 // same as redis proto-max-bulk-len
+	maxArrayLen = 1 << 20
+	maxInline   = 64 << 10
+)
+
+var errProtocol = errors.New("ERR Protocol error")
+
+// respReader read commands in RESP and inline format
+type respReader struct {
+	r *bufio.Reader
+}
+
+// readLine read line without \r\n
+func readLine(r *bufio.Reader) ([]byte, error) {
+	line, err := r.ReadSlice('\n')
+	if err == bufio.ErrBufferFull {
+		// long inline command
+		buf := append([]byte(nil), line...)
+		for err == bufio.ErrBufferFull && len(buf) <= maxInline {
+			line, err = r.ReadSlice('\n')
+			buf = append(buf, line...)
+		}
+		if err == bufio.ErrBufferFull {
+			return nil, errProtocol
+		}
+		line = buf
+	}
+	if err != nil {
+		return nil, err
+	}
+	line = line[:len(line)-1]
+	if len(line) > 0 && line[len(line)-1] == '\r' {
+		line = line[:len(line)-1]
+	}
+	return line, nil
+}
+
+func (rr *respReader) readLine() ([]byte, error) {
+	return readLine(rr.r)
+}
+
+// readCommand return command name and arguments
+func (rr *respReader) readCommand() (args [][]byte, err error) {
+	for len(args) == 0 {
+		var line []byte
+		line, err = rr.readLine()
+		if err != nil {
+			return
+		}
+		if len(line) == 0 {
+			continue
+		}
+		if line[0] != '*' {
+			// inline command: ping, quit and others from telnet
+			for _, f := range bytes.Fields(line) {
+				args = append(args, append([]byte(nil), f...))
+			}
+			continue
+		}
+		var n int
+		n, err = strconv.Atoi(string(line[1:]))
+		if err != nil || n < -1 || n > maxArrayLen {
+			return nil, errProtocol
+		}
+		if n <= 0 {
+			// null or empty array is skipped, same as in redis
+			continue
+		}
+		// array length is not trusted, args grow with read arguments
+		if n < 64 {
+			args = make([][]byte, 0, n)
+		}
+		for i := 0; i < n; i++ {
+			line, err = rr.readLine()
+			if err != nil {
+				return nil, err
+			}
+			if len(line) == 0 || line[0] != '$' {
+				return nil, errProtocol
+			}
+			var size int
+			size, err = strconv.Atoi(string(line[1:]))
+			if err != nil || size < 0 || size > maxBulkLen {
+				return nil, errProtocol
+			}
+			arg := make([]byte, size+2)
+			_, err = io.ReadFull(rr.r, arg)
+			if err != nil {
+				return nil, err
+			}
+			if arg[size] != '\r' || arg[size+1] != '\n' {
+				return nil, errProtocol
+			}
+			args = append(args, arg[:size])
+		}
+	}
+	return
+}
+
+// respWriter write replies in RESP2 or RESP3
+type respWriter struct {
+	w     *bufio.Writer
+	proto int
+}
+
+func (rw *respWriter) simple(s string) {
+	rw.w.WriteByte('+')
+	rw.w.WriteString(s)
+	rw.w.WriteString("\r\n")
+}
+
+func (rw *respWriter) error(s string) {
+	rw.w.WriteByte('-')
+	rw.w.WriteString(s)
+	rw.w.WriteString("\r\n")
+}
+
+func (rw *respWriter) integer(n int64) {
+	rw.w.WriteByte(':')
+	rw.w.WriteString(strconv.FormatInt(n, 10))
+	rw.w.WriteString("\r\n")
+}
+
+func (rw *respWriter) bulk(b []byte) {
+	rw.w.WriteByte('$')
+	rw.w.WriteString(strconv.Itoa(len(b)))
+	rw.w.WriteString("\r\n")
+	rw.w.Write(b)
+	rw.w.WriteString("\r\n")
+}
+
+func (rw *respWriter) null() {
+	if rw.proto == 3 {
+		rw.w.WriteString("_\r\n")
+		return
+	}
+	rw.w.WriteString("$-1\r\n")
+}
+
+func (rw *respWriter) array(n int) {
+	rw.w.WriteByte('*')
+	rw.w.WriteString(strconv.Itoa(n))
+	rw.w.WriteString("\r\n")
+}
+
+// dict - map in RESP3, flat array of key and values in RESP2
+func (rw *respWriter) dict(n int) {
+	if rw.proto == 3 {
+		rw.w.WriteByte('%')
+		rw.w.WriteString(strconv.Itoa(n))
+		rw.w.WriteString("\r\n")
+		return
+	}
+	rw.array(n * 2)
+}
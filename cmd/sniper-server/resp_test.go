@@ -0,0 +1,42 @@
+package main
+
+import (
+	"bufio"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func readCommand(s string) ([][]byte, error) {
+	rr := &respReader{r: bufio.NewReader(strings.NewReader(s))}
+	return rr.readCommand()
+}
+
+func TestReadCommand(t *testing.T) {
+	args, err := readCommand("*2\r\n$3\r\nget\r\n$1\r\nk\r\n")
+	assert.NoError(t, err)
+	assert.Equal(t, [][]byte{[]byte("get"), []byte("k")}, args)
+
+	// null and empty arrays are skipped
+	args, err = readCommand("*-1\r\n*0\r\n*1\r\n$4\r\nping\r\n")
+	assert.NoError(t, err)
+	assert.Equal(t, [][]byte{[]byte("ping")}, args)
+
+	// negative and oversized lengths are protocol errors, not panics
+	for _, s := range []string{
+		"*-2\r\n",
+		"*99999999999\r\n",
+		"*1\r\n$-1\r\n",
+		"*1\r\n$-2\r\n",
+		"*1\r\n$99999999999\r\n",
+		"*x\r\n",
+	} {
+		_, err = readCommand(s)
+		assert.Equal(t, errProtocol, err, s)
+	}
+
+	// array length is not trusted
+	_, err = readCommand("*1048576\r\n$1\r\nk\r\n")
+	assert.Error(t, err)
+}
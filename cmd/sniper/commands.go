@@ -0,0 +1,341 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/recoilme/sniper"
+)
+
+// command - cli command, operating on open store
+type command func(s *sniper.Store, args []string) error
+
+var commands map[string]command
+
+func init() {
+	commands = map[string]command{
+		"get":     cmdGet,
+		"set":     cmdSet,
+		"del":     cmdDel,
+		"incr":    cmdIncr,
+		"count":   cmdCount,
+		"ttl":     cmdTTL,
+		"keys":    cmdKeys,
+		"backup":  cmdBackup,
+		"restore": cmdRestore,
+		"stats":   cmdStats,
+		"reshard": cmdReshard,
+	}
+}
+
+var errUsage = errors.New("wrong arguments, see sniper -h")
+
+// stdin and stdout of commands, tests replace them
+var (
+	stdin  io.Reader = os.Stdin
+	stdout io.Writer = os.Stdout
+)
+
+// run execute command
+func run(s *sniper.Store, cmd string, args []string) error {
+	c, ok := commands[cmd]
+	if !ok {
+		return fmt.Errorf("unknown command %q", cmd)
+	}
+	return c(s, args)
+}
+
+func cmdGet(s *sniper.Store, args []string) error {
+	if len(args) != 1 {
+		return errUsage
+	}
+	v, err := s.Get([]byte(args[0]))
+	if err != nil {
+		return err
+	}
+	stdout.Write(v)
+	fmt.Fprintln(stdout)
+	return nil
+}
+
+func cmdSet(s *sniper.Store, args []string) error {
+	fs := flag.NewFlagSet("set", flag.ContinueOnError)
+	ttl := fs.Uint("ttl", 0, "time to live in seconds, 0 - no expire")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() != 2 {
+		return errUsage
+	}
+	v := []byte(fs.Arg(1))
+	if fs.Arg(1) == "-" {
+		var err error
+		v, err = io.ReadAll(stdin)
+		if err != nil {
+			return err
+		}
+	}
+	var expire uint32
+	if *ttl > 0 {
+		expire = uint32(time.Now().Unix()) + uint32(*ttl)
+	}
+	return s.Set([]byte(fs.Arg(0)), v, expire)
+}
+
+func cmdDel(s *sniper.Store, args []string) error {
+	if len(args) != 1 {
+		return errUsage
+	}
+	isDeleted, err := s.Delete([]byte(args[0]))
+	if err != nil {
+		return err
+	}
+	if !isDeleted {
+		return sniper.ErrNotFound
+	}
+	return nil
+}
+
+// cmdIncr - counter is decimal string, changed with Store.IncrInt,
+// same as by servers
+func cmdIncr(s *sniper.Store, args []string) error {
+	if len(args) < 1 || len(args) > 2 {
+		return errUsage
+	}
+	by := int64(1)
+	if len(args) == 2 {
+		var err error
+		by, err = strconv.ParseInt(args[1], 10, 64)
+		if err != nil {
+			return err
+		}
+	}
+	n, err := s.IncrInt([]byte(args[0]), by)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintln(stdout, n)
+	return nil
+}
+
+func cmdCount(s *sniper.Store, args []string) error {
+	if len(args) != 0 {
+		return errUsage
+	}
+	fmt.Fprintln(stdout, s.Count())
+	return nil
+}
+
+func cmdTTL(s *sniper.Store, args []string) error {
+	if len(args) != 1 {
+		return errUsage
+	}
+	ttl, err := s.TTL([]byte(args[0]))
+	if err != nil {
+		return err
+	}
+	if ttl < 0 {
+		fmt.Fprintln(stdout, -1)
+		return nil
+	}
+	fmt.Fprintln(stdout, int64(ttl.Round(time.Second)/time.Second))
+	return nil
+}
+
+func cmdKeys(s *sniper.Store, args []string) error {
+	fs := flag.NewFlagSet("keys", flag.ContinueOnError)
+	bucketName := fs.String("bucket", "", "bucket name")
+	limit := fs.Int("limit", 0, "maximum keys, 0 - all")
+	offset := fs.Int("offset", 0, "skip keys")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() > 1 {
+		return errUsage
+	}
+	prefix := []byte(fs.Arg(0))
+	if *bucketName != "" {
+		bucket, err := s.LookupBucket(*bucketName)
+		if err == sniper.ErrNotFound {
+			return fmt.Errorf("unknown bucket %s", *bucketName)
+		}
+		if err != nil {
+			return err
+		}
+		for _, k := range s.Keys(bucket, *limit, *offset) {
+			if bytes.HasPrefix([]byte(k), prefix) {
+				fmt.Fprintln(stdout, k)
+			}
+		}
+		return nil
+	}
+	n, skip := 0, *offset
+	return s.Range(func(k, v []byte, expire uint32) bool {
+		if !bytes.HasPrefix(k, prefix) {
+			return true
+		}
+		if skip > 0 {
+			skip--
+			return true
+		}
+		stdout.Write(k)
+		fmt.Fprintln(stdout)
+		n++
+		return *limit == 0 || n < *limit
+	})
+}
+
+func cmdBackup(s *sniper.Store, args []string) (err error) {
+	if len(args) != 1 {
+		return errUsage
+	}
+	f, err := os.Create(args[0])
+	if err != nil {
+		return
+	}
+	if strings.HasSuffix(args[0], ".gz") {
+		err = s.BackupGZ(f)
+	} else {
+		err = s.Backup(f)
+	}
+	if err == nil {
+		err = f.Sync()
+	}
+	if errClose := f.Close(); err == nil {
+		err = errClose
+	}
+	return
+}
+
+func cmdRestore(s *sniper.Store, args []string) error {
+	if len(args) != 1 {
+		return errUsage
+	}
+	f, err := os.Open(args[0])
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if strings.HasSuffix(args[0], ".gz") {
+		return s.RestoreGZ(f)
+	}
+	return s.Restore(bufio.NewReader(f))
+}
+
+func cmdStats(s *sniper.Store, args []string) error {
+	if len(args) != 0 {
+		return errUsage
+	}
+	size, err := s.FileSize()
+	if err != nil {
+		return err
+	}
+	// counters of opened store, store may be used by other process,
+	// so files are not scanned, use fsck for it
+	holes, holeBytes := s.Holes()
+	fmt.Fprintf(stdout, "keys: %d\n", s.Count())
+	fmt.Fprintf(stdout, "size: %d bytes\n", size)
+	fmt.Fprintf(stdout, "holes: %d (%d bytes)\n", holes, holeBytes)
+	buckets, err := s.Buckets()
+	if err != nil {
+		return err
+	}
+	for _, name := range buckets {
+		bucket, err := s.LookupBucket(name)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(stdout, "bucket %s: %d keys\n", name, len(s.Keys(bucket, 0, 0)))
+	}
+	return nil
+}
+
+// cmdReshard - move records in new chunks, store stay available for other
+// commands of repl, interrupted reshard is resumed by same command
+func cmdReshard(s *sniper.Store, args []string) error {
+	if len(args) != 2 {
+		return errUsage
+	}
+	chunks, err := strconv.Atoi(args[0])
+	if err != nil {
+		return errUsage
+	}
+	collision, err := strconv.Atoi(args[1])
+	if err != nil {
+		return errUsage
+	}
+	return s.Reshard(chunks, collision)
+}
+
+// repl read commands from stdin and execute them until EOF or quit
+func repl(s *sniper.Store) error {
+	sc := bufio.NewScanner(stdin)
+	sc.Buffer(make([]byte, 64<<10), 64<<20)
+	for {
+		fmt.Fprint(stdout, "sniper> ")
+		if !sc.Scan() {
+			fmt.Fprintln(stdout)
+			return sc.Err()
+		}
+		args, err := splitArgs(sc.Text())
+		if err != nil {
+			fmt.Fprintln(stdout, "error:", err)
+			continue
+		}
+		if len(args) == 0 {
+			continue
+		}
+		switch args[0] {
+		case "quit", "exit":
+			return nil
+		case "help":
+			for name := range commands {
+				fmt.Fprint(stdout, name, " ")
+			}
+			fmt.Fprintln(stdout, "quit")
+			continue
+		}
+		err = run(s, args[0], args[1:])
+		if err != nil {
+			fmt.Fprintln(stdout, "error:", err)
+		}
+	}
+}
+
+// splitArgs split line by spaces, double quoted arguments
+// may contain spaces and go escapes
+func splitArgs(line string) (args []string, err error) {
+	line = strings.TrimSpace(line)
+	for line != "" {
+		if line[0] == '"' {
+			var arg string
+			arg, err = strconv.QuotedPrefix(line)
+			if err != nil {
+				return nil, fmt.Errorf("bad quoted argument: %s", line)
+			}
+			line = line[len(arg):]
+			arg, err = strconv.Unquote(arg)
+			if err != nil {
+				return nil, err
+			}
+			args = append(args, arg)
+		} else {
+			i := strings.IndexAny(line, " \t")
+			if i < 0 {
+				i = len(line)
+			}
+			args = append(args, line[:i])
+			line = line[i:]
+		}
+		line = strings.TrimLeft(line, " \t")
+	}
+	return
+}
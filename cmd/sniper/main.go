@@ -0,0 +1,138 @@
+// Command sniper - tool for sniper store inspection and maintenance
+//
+// usage:
+//
+//	sniper [-dir dir] [-chunks n] [-collision n] [-prefix p] [-readonly] <command> [arguments]
+//	sniper fsck [-repair] [-salvage] <dir>
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/recoilme/sniper"
+)
+
+func usage() {
+	fmt.Fprintf(os.Stderr, `usage: sniper [-dir dir] [-chunks n] [-collision n] [-prefix p] [-readonly] <command> [arguments]
+
+commands:
+  get <key>                        print value
+  set [-ttl sec] <key> <value>     store value, value "-" is read from stdin
+  del <key>                        delete key
+  incr <key> [n]                   incr counter by n (decr if n < 0), default 1
+  count                            print count of keys
+  ttl <key>                        print time to live in seconds, -1 if key has no expire
+  keys [-bucket name] [-limit n] [-offset n] [prefix]
+                                   print keys, all or stored in bucket
+  backup <file>                    write backup, gzipped if file ends with .gz
+  restore <file>                   restore backup, gzipped if file ends with .gz
+  stats                            print store statistics
+  repl                             read commands from stdin
+  reshard <chunks> <collision>     move records in new chunks, interrupted reshard
+                                   is resumed by same command
+  fsck [-repair] [-salvage] <dir>  verify chunk files, optionally repair them
+
+store options are read from store manifest, if omitted
+-readonly opens store with shared lock, commands which modify store fail
+`)
+	os.Exit(2)
+}
+
+func main() {
+	dir := flag.String("dir", ".", "store directory")
+	chunks := flag.Int("chunks", 0, "chunks total, 0 - from manifest")
+	collision := flag.Int("collision", -1, "collision chunks, -1 - from manifest")
+	prefix := flag.String("prefix", "", "chunks prefix")
+	readOnly := flag.Bool("readonly", false, "open store read only")
+	flag.Usage = usage
+	flag.Parse()
+	if flag.NArg() < 1 {
+		usage()
+	}
+	cmd, args := flag.Arg(0), flag.Args()[1:]
+	switch cmd {
+	case "fsck":
+		err := fsck(args)
+		if err == errUsage {
+			usage()
+		}
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		return
+	}
+	if _, ok := commands[cmd]; !ok && cmd != "repl" {
+		usage()
+	}
+
+	opts := []sniper.OptStore{sniper.Dir(*dir)}
+	if *chunks > 0 {
+		opts = append(opts, sniper.ChunksTotal(*chunks))
+	}
+	if *collision >= 0 {
+		opts = append(opts, sniper.ChunksCollision(*collision))
+	}
+	if *prefix != "" {
+		opts = append(opts, sniper.ChunksPrefix(*prefix))
+	}
+	if *readOnly {
+		opts = append(opts, sniper.ReadOnly())
+	}
+	s, err := sniper.Open(opts...)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	if cmd == "repl" {
+		err = repl(s)
+	} else {
+		err = run(s, cmd, args)
+	}
+	if errClose := s.Close(); err == nil {
+		err = errClose
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
+
+// errProblems - fsck found problems and did not repair them
+var errProblems = errors.New("store has problems, repair it with fsck -repair")
+
+func fsck(args []string) error {
+	fs := flag.NewFlagSet("fsck", flag.ContinueOnError)
+	repair := fs.Bool("repair", false, "truncate damaged tails and mark damaged records as deleted")
+	salvage := fs.Bool("salvage", false, "rewrite damaged chunks with readable live records only")
+	if err := fs.Parse(args); err != nil {
+		return errUsage
+	}
+	if fs.NArg() != 1 {
+		return errUsage
+	}
+	dir := fs.Arg(0)
+
+	var report *sniper.Report
+	var err error
+	if *repair || *salvage {
+		report, err = sniper.Repair(dir, *salvage)
+	} else {
+		report, err = sniper.Verify(dir)
+	}
+	if err != nil {
+		return err
+	}
+	for _, p := range report.Problems {
+		fmt.Fprintln(stdout, p)
+	}
+	fmt.Fprintf(stdout, "files: %d, records: %d, holes: %d (%d bytes), problems: %d\n",
+		report.Files, report.Records, report.Holes, report.HoleBytes, len(report.Problems))
+	if !report.OK() && !*repair && !*salvage {
+		return errProblems
+	}
+	return nil
+}
@@ -0,0 +1,311 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/recoilme/sniper"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSplitArgs(t *testing.T) {
+	tests := []struct {
+		line string
+		args []string
+		err  bool
+	}{
+		{line: "", args: nil},
+		{line: "  \t ", args: nil},
+		{line: "get key", args: []string{"get", "key"}},
+		{line: "  set \t k   v  ", args: []string{"set", "k", "v"}},
+		{line: `set k "hello world"`, args: []string{"set", "k", "hello world"}},
+		{line: `set "a b" "c d"`, args: []string{"set", "a b", "c d"}},
+		{line: `set k ""`, args: []string{"set", "k", ""}},
+		{line: `set k "a\"b"`, args: []string{"set", "k", `a"b`}},
+		{line: `set k "line\nnext\t\x41é"`, args: []string{"set", "k", "line\nnext\tAé"}},
+		{line: `set k a"b`, args: []string{"set", "k", `a"b`}},
+		{line: `set k "abc`, err: true},
+		{line: `set k "abc\"`, err: true},
+		{line: `set k "\q"`, err: true},
+	}
+	for _, tt := range tests {
+		args, err := splitArgs(tt.line)
+		if tt.err {
+			assert.Error(t, err, tt.line)
+			continue
+		}
+		assert.NoError(t, err, tt.line)
+		assert.Equal(t, tt.args, args, tt.line)
+	}
+}
+
+// capture replace stdout of commands, until end of test
+func capture(t *testing.T) *bytes.Buffer {
+	out := &bytes.Buffer{}
+	stdout = out
+	t.Cleanup(func() { stdout = os.Stdout })
+	return out
+}
+
+func openStore(t *testing.T, dir string) *sniper.Store {
+	s, err := sniper.Open(sniper.Dir(dir))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { s.Close() })
+	return s
+}
+
+// exec run command and return its output
+func exec(t *testing.T, s *sniper.Store, line string) (string, error) {
+	out := capture(t)
+	args, err := splitArgs(line)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = run(s, args[0], args[1:])
+	return out.String(), err
+}
+
+func TestCommands(t *testing.T) {
+	s := openStore(t, t.TempDir())
+
+	out, err := exec(t, s, `set k "hello world"`)
+	assert.NoError(t, err)
+	assert.Equal(t, "", out)
+	out, err = exec(t, s, "get k")
+	assert.NoError(t, err)
+	assert.Equal(t, "hello world\n", out)
+	_, err = exec(t, s, "get missing")
+	assert.Equal(t, sniper.ErrNotFound, err)
+	_, err = exec(t, s, "get")
+	assert.Equal(t, errUsage, err)
+	_, err = exec(t, s, "set k")
+	assert.Equal(t, errUsage, err)
+
+	// value from stdin
+	stdin = strings.NewReader("from\nstdin")
+	t.Cleanup(func() { stdin = os.Stdin })
+	_, err = exec(t, s, "set in -")
+	assert.NoError(t, err)
+	out, _ = exec(t, s, "get in")
+	assert.Equal(t, "from\nstdin\n", out)
+
+	// ttl
+	out, err = exec(t, s, "ttl k")
+	assert.NoError(t, err)
+	assert.Equal(t, "-1\n", out)
+	_, err = exec(t, s, "set -ttl 100 t v")
+	assert.NoError(t, err)
+	out, err = exec(t, s, "ttl t")
+	assert.NoError(t, err)
+	ttl, _ := strconv.Atoi(strings.TrimSpace(out))
+	assert.True(t, ttl > 90 && ttl <= 100, out)
+	_, err = exec(t, s, "ttl missing")
+	assert.Equal(t, sniper.ErrNotFound, err)
+
+	// del
+	_, err = exec(t, s, "del t")
+	assert.NoError(t, err)
+	_, err = exec(t, s, "del t")
+	assert.Equal(t, sniper.ErrNotFound, err)
+
+	// incr, counter is decimal as in servers
+	out, err = exec(t, s, "incr c")
+	assert.NoError(t, err)
+	assert.Equal(t, "1\n", out)
+	out, err = exec(t, s, "incr c 10")
+	assert.NoError(t, err)
+	assert.Equal(t, "11\n", out)
+	out, err = exec(t, s, "incr c -5")
+	assert.NoError(t, err)
+	assert.Equal(t, "6\n", out)
+	out, _ = exec(t, s, "get c")
+	assert.Equal(t, "6\n", out)
+	_, err = exec(t, s, "incr c x")
+	assert.Error(t, err)
+
+	// count: k, in, c
+	out, err = exec(t, s, "count")
+	assert.NoError(t, err)
+	assert.Equal(t, "3\n", out)
+	_, err = exec(t, s, "count x")
+	assert.Equal(t, errUsage, err)
+
+	_, err = exec(t, s, "unknown")
+	assert.EqualError(t, err, `unknown command "unknown"`)
+}
+
+func TestCommandKeys(t *testing.T) {
+	s := openStore(t, t.TempDir())
+	for i := 0; i < 5; i++ {
+		assert.NoError(t, s.Set([]byte("a"+strconv.Itoa(i)), []byte("v"), 0))
+	}
+	assert.NoError(t, s.Set([]byte("b"), []byte("v"), 0))
+	bucket, err := s.Bucket("u")
+	assert.NoError(t, err)
+	for _, k := range []string{"1", "2", "3"} {
+		assert.NoError(t, s.Put(bucket, []byte(k), []byte("v")))
+	}
+
+	lines := func(out string) []string {
+		return strings.Fields(out)
+	}
+	out, err := exec(t, s, "keys a")
+	assert.NoError(t, err)
+	assert.ElementsMatch(t, []string{"a0", "a1", "a2", "a3", "a4"}, lines(out))
+	out, err = exec(t, s, "keys -limit 2 a")
+	assert.NoError(t, err)
+	assert.Len(t, lines(out), 2)
+	out, err = exec(t, s, "keys -offset 4 a")
+	assert.NoError(t, err)
+	assert.Len(t, lines(out), 1)
+	out, err = exec(t, s, "keys b")
+	assert.NoError(t, err)
+	assert.Equal(t, "b\n", out)
+
+	out, err = exec(t, s, "keys -bucket u")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"3", "2", "1"}, lines(out))
+	out, err = exec(t, s, "keys -bucket u -limit 1")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"3"}, lines(out))
+	out, err = exec(t, s, "keys -bucket u 2")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"2"}, lines(out))
+	_, err = exec(t, s, "keys -bucket missing")
+	assert.EqualError(t, err, "unknown bucket missing")
+	_, err = exec(t, s, "keys a b")
+	assert.Equal(t, errUsage, err)
+
+	out, err = exec(t, s, "stats")
+	assert.NoError(t, err)
+	// 5 keys a, b, 3 keys of bucket and [buckets]
+	assert.Contains(t, out, "keys: 10\n")
+	assert.Contains(t, out, "holes: ")
+	assert.Contains(t, out, "bucket u: 3 keys\n")
+}
+
+func TestCommandBackup(t *testing.T) {
+	s := openStore(t, t.TempDir())
+	for i := 0; i < 100; i++ {
+		assert.NoError(t, s.Set([]byte(strconv.Itoa(i)), []byte("v"+strconv.Itoa(i)), 0))
+	}
+	dir := t.TempDir()
+	for _, name := range []string{"backup", "backup.gz"} {
+		file := filepath.Join(dir, name)
+		_, err := exec(t, s, "backup "+file)
+		assert.NoError(t, err)
+
+		restored := openStore(t, t.TempDir())
+		_, err = exec(t, restored, "restore "+file)
+		assert.NoError(t, err)
+		out, _ := exec(t, restored, "count")
+		assert.Equal(t, "100\n", out, name)
+		out, _ = exec(t, restored, "get 42")
+		assert.Equal(t, "v42\n", out, name)
+	}
+	_, err := exec(t, s, "restore "+filepath.Join(dir, "missing"))
+	assert.Error(t, err)
+	_, err = exec(t, s, "backup")
+	assert.Equal(t, errUsage, err)
+}
+
+func TestCommandReshard(t *testing.T) {
+	dir := t.TempDir()
+	s := openStore(t, dir)
+	for i := 0; i < 1000; i++ {
+		assert.NoError(t, s.Set([]byte(strconv.Itoa(i)), []byte("v"+strconv.Itoa(i)), 0))
+	}
+	_, err := exec(t, s, "reshard 32 x")
+	assert.Equal(t, errUsage, err)
+	_, err = exec(t, s, "reshard 32 2")
+	assert.NoError(t, err)
+	out, _ := exec(t, s, "count")
+	assert.Equal(t, "1000\n", out)
+	assert.NoError(t, s.Close())
+
+	// manifest keep new layout
+	s = openStore(t, dir)
+	out, _ = exec(t, s, "count")
+	assert.Equal(t, "1000\n", out)
+	out, _ = exec(t, s, "get 999")
+	assert.Equal(t, "v999\n", out)
+}
+
+func TestRepl(t *testing.T) {
+	s := openStore(t, t.TempDir())
+	out := capture(t)
+	stdin = strings.NewReader(`set k "a b"
+
+get k
+get "k
+incr n 2
+nosuch
+quit
+get k
+`)
+	t.Cleanup(func() { stdin = os.Stdin })
+	assert.NoError(t, repl(s))
+	// commands after quit are not executed
+	assert.Equal(t, "sniper> sniper> sniper> a b\n"+
+		"sniper> error: bad quoted argument: \"k\n"+
+		"sniper> 2\n"+
+		"sniper> error: unknown command \"nosuch\"\n"+
+		"sniper> ", out.String())
+
+	// help and EOF
+	out.Reset()
+	stdin = strings.NewReader("help")
+	assert.NoError(t, repl(s))
+	for name := range commands {
+		assert.Contains(t, out.String(), name)
+	}
+	assert.True(t, strings.HasSuffix(out.String(), "quit\nsniper> \n"), out.String())
+}
+
+func TestFsck(t *testing.T) {
+	dir := t.TempDir()
+	s, err := sniper.Open(sniper.Dir(dir))
+	assert.NoError(t, err)
+	for i := 0; i < 100; i++ {
+		assert.NoError(t, s.Set([]byte(strconv.Itoa(i)), []byte("v"), 0))
+	}
+	assert.NoError(t, s.Close())
+
+	out := capture(t)
+	assert.Equal(t, errUsage, fsck(nil))
+	assert.NoError(t, fsck([]string{dir}))
+	assert.Contains(t, out.String(), "records: 100,")
+	assert.Contains(t, out.String(), "problems: 0\n")
+
+	// garbage tail of chunk
+	entries, err := os.ReadDir(dir)
+	assert.NoError(t, err)
+	for _, e := range entries {
+		if _, err := strconv.Atoi(e.Name()); err != nil {
+			continue
+		}
+		f, err := os.OpenFile(filepath.Join(dir, e.Name()), os.O_WRONLY|os.O_APPEND, 0)
+		assert.NoError(t, err)
+		_, err = f.Write([]byte{1, 2, 3})
+		assert.NoError(t, err)
+		assert.NoError(t, f.Close())
+		break
+	}
+	out.Reset()
+	assert.Equal(t, errProblems, fsck([]string{dir}))
+	assert.Contains(t, out.String(), sniper.ProblemTail)
+	assert.Contains(t, out.String(), "problems: 1\n")
+
+	out.Reset()
+	assert.NoError(t, fsck([]string{"-repair", dir}))
+	out.Reset()
+	assert.NoError(t, fsck([]string{dir}))
+	assert.Contains(t, out.String(), "records: 100,")
+	assert.Contains(t, out.String(), "problems: 0\n")
+}
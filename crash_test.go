@@ -0,0 +1,1221 @@
+package sniper
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// crash test harness: store runs on faultFS, which keep last synced
+// content of every file and writes made after it. Crash build new file
+// system from synced content plus random part of unsynced writes,
+// last of them may be torn. Directory entries (created, removed and
+// renamed files) are durable after SyncDir of their directory, crash keep
+// random part of unsynced entries in order of operations. Faults: short
+// reads, ENOSPC with partial write and fsync errors are injected at random
+// file operations.
+
+// fileOp - unsynced write or truncate
+type fileOp struct {
+	off   int64
+	b     []byte
+	trunc bool
+}
+
+// inode - durable state of file
+type inode struct {
+	durable []byte
+	pending []fileOp
+}
+
+// apply op to content, partial write is torn after n bytes
+func (op fileOp) apply(b []byte, n int) []byte {
+	if op.trunc {
+		if op.off < int64(len(b)) {
+			return b[:op.off]
+		}
+		return append(b, make([]byte, op.off-int64(len(b)))...)
+	}
+	end := op.off + int64(n)
+	if end > int64(len(b)) {
+		b = append(b, make([]byte, end-int64(len(b)))...)
+	}
+	copy(b[op.off:], op.b[:n])
+	return b
+}
+
+// dirOp - unsynced directory entry: name is linked to ino or removed (ino is nil)
+type dirOp struct {
+	name string
+	ino  *inode
+}
+
+// faultFS - VFS over MemFS with fault injection and crash simulation
+type faultFS struct {
+	mu      sync.Mutex
+	mem     *MemFS
+	inodes  map[string]*inode  // current directory entries
+	durable map[string]*inode  // synced directory entries
+	dirOps  map[string][]dirOp // unsynced entries by directory
+	rnd     *rand.Rand
+	prob    float64 // fault probability of file operation
+	failed  bool    // write or sync fault was injected, store must crash
+	faults  int
+	// failWrite and failSync, if set, inject write or sync fault
+	// in file name, when they return true
+	failWrite func(name string) bool
+	failSync  func(name string) bool
+}
+
+func newFaultFS(seed int64) *faultFS {
+	return &faultFS{mem: NewMemFS(), inodes: make(map[string]*inode), durable: make(map[string]*inode),
+		dirOps: make(map[string][]dirOp), rnd: rand.New(rand.NewSource(seed))}
+}
+
+// fault return true, if fault must be injected, fs must be locked
+func (fs *faultFS) fault() bool {
+	if fs.prob > 0 && fs.rnd.Float64() < fs.prob {
+		fs.faults++
+		return true
+	}
+	return false
+}
+
+// link add unsynced directory entry, fs must be locked
+func (fs *faultFS) link(name string, ino *inode) {
+	if ino == nil {
+		delete(fs.inodes, name)
+	} else {
+		fs.inodes[name] = ino
+	}
+	dir := filepath.Dir(name)
+	fs.dirOps[dir] = append(fs.dirOps[dir], dirOp{name: name, ino: ino})
+}
+
+// setFailed mark store for crash
+func (fs *faultFS) setFailed() {
+	fs.mu.Lock()
+	fs.failed = true
+	fs.mu.Unlock()
+}
+
+// isFailed return true if write or sync fault was injected
+func (fs *faultFS) isFailed() bool {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	return fs.failed
+}
+
+// setProb set fault probability
+func (fs *faultFS) setProb(prob float64) {
+	fs.mu.Lock()
+	fs.prob = prob
+	fs.mu.Unlock()
+}
+
+// inject set functions, which inject write and sync faults in file by name
+func (fs *faultFS) inject(failWrite, failSync func(name string) bool) {
+	fs.mu.Lock()
+	fs.failWrite, fs.failSync = failWrite, failSync
+	fs.mu.Unlock()
+}
+
+// faultCount return count of injected faults
+func (fs *faultFS) faultCount() int {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	return fs.faults
+}
+
+func (fs *faultFS) OpenFile(name string, flag int, perm os.FileMode) (File, error) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	name = filepath.Clean(name)
+	f, err := fs.mem.OpenFile(name, flag, perm)
+	if err != nil {
+		return nil, err
+	}
+	ino, ok := fs.inodes[name]
+	if !ok {
+		ino = &inode{}
+		fs.link(name, ino)
+	}
+	if flag&os.O_TRUNC != 0 {
+		ino.pending = append(ino.pending, fileOp{trunc: true})
+	}
+	return &faultFile{File: f, fs: fs, ino: ino, name: name}, nil
+}
+
+func (fs *faultFS) Stat(name string) (os.FileInfo, error) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	return fs.mem.Stat(name)
+}
+
+// Remove and Rename are durable after SyncDir
+func (fs *faultFS) Remove(name string) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	err := fs.mem.Remove(name)
+	if err == nil {
+		fs.link(filepath.Clean(name), nil)
+	}
+	return err
+}
+
+func (fs *faultFS) Rename(oldname, newname string) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	err := fs.mem.Rename(oldname, newname)
+	if err == nil {
+		oldname, newname = filepath.Clean(oldname), filepath.Clean(newname)
+		// new entry first: file is not lost, if only part of entries is on disk
+		fs.link(newname, fs.inodes[oldname])
+		fs.link(oldname, nil)
+	}
+	return err
+}
+
+// MkdirAll - directories are durable at once
+func (fs *faultFS) MkdirAll(path string, perm os.FileMode) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	return fs.mem.MkdirAll(path, perm)
+}
+
+func (fs *faultFS) ReadDir(dir string) ([]os.DirEntry, error) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	return fs.mem.ReadDir(dir)
+}
+
+func (fs *faultFS) SyncDir(dir string) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	dir = filepath.Clean(dir)
+	for _, op := range fs.dirOps[dir] {
+		if op.ino == nil {
+			delete(fs.durable, op.name)
+		} else {
+			fs.durable[op.name] = op.ino
+		}
+	}
+	delete(fs.dirOps, dir)
+	return nil
+}
+
+func (fs *faultFS) Lock(name string, exclusive bool) (io.Closer, error) {
+	return fs.mem.Lock(name, exclusive)
+}
+
+// crash drop unsynced writes and directory entries, except random
+// prefix of them, and replace file system with durable state. Store on old
+// file system must be abandoned, its background work stopped by abandon
+func (fs *faultFS) crash() {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	dirs := make([]string, 0, len(fs.dirOps))
+	for dir := range fs.dirOps {
+		dirs = append(dirs, dir)
+	}
+	sort.Strings(dirs)
+	for _, dir := range dirs {
+		ops := fs.dirOps[dir]
+		for _, op := range ops[:fs.rnd.Intn(len(ops)+1)] {
+			if op.ino == nil {
+				delete(fs.durable, op.name)
+			} else {
+				fs.durable[op.name] = op.ino
+			}
+		}
+	}
+	mem := NewMemFS()
+	names := make([]string, 0, len(fs.durable))
+	for name := range fs.durable {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	content := make(map[*inode][]byte)
+	for _, name := range names {
+		ino := fs.durable[name]
+		b, ok := content[ino]
+		if !ok {
+			b = append([]byte(nil), ino.durable...)
+			n := fs.rnd.Intn(len(ino.pending) + 1)
+			for i, op := range ino.pending[:n] {
+				size := len(op.b)
+				if i == n-1 && size > 0 && fs.rnd.Intn(2) == 0 {
+					// torn write
+					size = fs.rnd.Intn(size)
+				}
+				b = op.apply(b, size)
+			}
+			content[ino] = b
+		}
+		mem.MkdirAll(filepath.Dir(name), os.FileMode(dirMode))
+		f, _ := mem.OpenFile(name, os.O_CREATE|os.O_RDWR, os.FileMode(fileMode))
+		f.Write(b)
+		f.Close()
+	}
+	// files get new inodes, old store can't change them
+	inodes := make(map[string]*inode, len(names))
+	durable := make(map[string]*inode, len(names))
+	for _, name := range names {
+		ino := &inode{durable: content[fs.durable[name]]}
+		inodes[name], durable[name] = ino, ino
+	}
+	fs.inodes, fs.durable = inodes, durable
+	fs.mem = mem
+	fs.dirOps = make(map[string][]dirOp)
+	fs.failed = false
+}
+
+// faultFile - file of faultFS
+type faultFile struct {
+	File
+	fs   *faultFS
+	ino  *inode
+	name string
+}
+
+var errFault = errors.New("injected fault")
+
+// shortRead return size of short read and true, if read fault is injected
+func (f *faultFile) shortRead(size int) (int, bool) {
+	f.fs.mu.Lock()
+	defer f.fs.mu.Unlock()
+	if size > 0 && f.fs.fault() {
+		return f.fs.rnd.Intn(size), true
+	}
+	return size, false
+}
+
+func (f *faultFile) Read(b []byte) (n int, err error) {
+	if size, ok := f.shortRead(len(b)); ok {
+		n, _ = f.File.Read(b[:size])
+		return n, io.ErrUnexpectedEOF
+	}
+	return f.File.Read(b)
+}
+
+func (f *faultFile) ReadAt(b []byte, off int64) (n int, err error) {
+	if size, ok := f.shortRead(len(b)); ok {
+		n, _ = f.File.ReadAt(b[:size], off)
+		return n, io.ErrUnexpectedEOF
+	}
+	return f.File.ReadAt(b, off)
+}
+
+func (f *faultFile) Write(b []byte) (n int, err error) {
+	f.fs.mu.Lock()
+	defer f.fs.mu.Unlock()
+	off, err := f.File.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return
+	}
+	return f.writeAt(b, off, true)
+}
+
+func (f *faultFile) WriteAt(b []byte, off int64) (n int, err error) {
+	f.fs.mu.Lock()
+	defer f.fs.mu.Unlock()
+	return f.writeAt(b, off, false)
+}
+
+// writeAt write b at off, fs must be locked
+func (f *faultFile) writeAt(b []byte, off int64, seq bool) (n int, err error) {
+	size := len(b)
+	if size > 0 && (f.fs.fault() || (f.fs.failWrite != nil && f.fs.failWrite(f.name))) {
+		// disk is full, part of data is written
+		f.fs.failed = true
+		size = f.fs.rnd.Intn(size)
+		err = &os.PathError{Op: "write", Path: "fault", Err: syscall.ENOSPC}
+	}
+	if seq {
+		n, errWrite := f.File.Write(b[:size])
+		if err == nil {
+			err = errWrite
+		}
+		f.ino.pending = append(f.ino.pending, fileOp{off: off, b: append([]byte(nil), b[:n]...)})
+		return n, err
+	}
+	n, errWrite := f.File.WriteAt(b[:size], off)
+	if err == nil {
+		err = errWrite
+	}
+	f.ino.pending = append(f.ino.pending, fileOp{off: off, b: append([]byte(nil), b[:n]...)})
+	return n, err
+}
+
+func (f *faultFile) Truncate(size int64) error {
+	f.fs.mu.Lock()
+	defer f.fs.mu.Unlock()
+	err := f.File.Truncate(size)
+	if err == nil {
+		f.ino.pending = append(f.ino.pending, fileOp{off: size, trunc: true})
+	}
+	return err
+}
+
+func (f *faultFile) Sync() error {
+	f.fs.mu.Lock()
+	defer f.fs.mu.Unlock()
+	if f.fs.fault() || (f.fs.failSync != nil && f.fs.failSync(f.name)) {
+		// fsync failed, nothing is known about unsynced data
+		f.fs.failed = true
+		return &os.PathError{Op: "sync", Path: "fault", Err: errFault}
+	}
+	err := f.File.Sync()
+	if err != nil {
+		return err
+	}
+	for _, op := range f.ino.pending {
+		f.ino.durable = op.apply(f.ino.durable, len(op.b))
+	}
+	f.ino.pending = nil
+	return nil
+}
+
+// abandon stop background work of store, which is left without Close
+// before crash: timers of store and hints, log sync and background checkpoint
+func abandon(s *Store) {
+	if s.syncInterval > 0 {
+		s.iv.Clear()
+	}
+	if s.expireInterval > 0 {
+		s.expiv.Clear()
+	}
+	if s.compactInterval > 0 {
+		s.compactiv.Clear()
+	}
+	if !s.readOnly && s.hintInterval > 0 {
+		s.hintiv.Clear()
+	}
+	if s.wal == nil {
+		return
+	}
+	if s.durability == Interval {
+		s.wal.iv.Clear()
+	}
+	// running checkpoint is finished, new one is not started
+	for !atomic.CompareAndSwapInt32(&s.wal.inckpt, 0, 1) {
+		time.Sleep(time.Millisecond)
+	}
+}
+
+// crashModel - possible values of keys, nil - key is absent.
+// Acknowledged operation leave one value, failed operation
+// may be applied or not, so it add value
+type crashModel map[string][][]byte
+
+func (m crashModel) ack(k string, v []byte) {
+	m[k] = [][]byte{v}
+}
+
+func (m crashModel) maybe(k string, v []byte) {
+	if vals, ok := m[k]; ok {
+		m[k] = append(vals, v)
+	} else {
+		m[k] = [][]byte{nil, v}
+	}
+}
+
+func (m crashModel) has(k string, v []byte) bool {
+	vals, ok := m[k]
+	if !ok {
+		return v == nil
+	}
+	for _, val := range vals {
+		if (val == nil) == (v == nil) && bytes.Equal(val, v) {
+			return true
+		}
+	}
+	return false
+}
+
+// counterValue return value of counter, written by Incr
+func counterValue(n uint64) []byte {
+	return binaryUint(n)
+}
+
+// crashRun run random workload on store, crashing it at random points
+// and after every write or sync fault, store is checked after every reopen.
+// In Interval mode acknowledged writes may be lost, but old value must stay.
+// Without log (mode 0) chunks are repaired after crash, as by fsck -repair,
+// and key, changed after last sync, may be lost
+func crashRun(t *testing.T, seed int64, steps int, mode DurabilityMode) {
+	fs := newFaultFS(seed)
+	rnd := rand.New(rand.NewSource(seed))
+	model := make(crashModel)
+	far := uint32(time.Now().Unix()) + 24*3600
+	opts := []OptStore{Dir("crash"), FS(fs), ChunksTotal(8), ChunksCollision(1)}
+	if mode != 0 {
+		opts = append(opts, Durability(mode))
+	}
+	ack := model.ack
+	if mode == Interval || mode == 0 {
+		ack = model.maybe
+	}
+	dirty := make(map[string]bool) // keys, changed after last sync, for mode 0
+
+	open := func() *Store {
+		fs.setProb(0)
+		s, err := Open(opts...)
+		if err != nil {
+			t.Fatalf("seed %d: open: %s", seed, err)
+		}
+		// check all keys and collapse model to store state
+		for k := range model {
+			v, err := s.Get([]byte(k))
+			if err == ErrNotFound {
+				v, err = nil, nil
+			}
+			if err != nil {
+				t.Fatalf("seed %d: get %s after reopen: %s", seed, k, err)
+			}
+			if !model.has(k, v) && !(dirty[k] && v == nil) {
+				t.Fatalf("seed %d: key %s has value %q, possible %q", seed, k, v, model[k])
+			}
+			model.ack(k, v)
+		}
+		dirty = make(map[string]bool)
+		err = s.Range(func(k, v []byte, expire uint32) bool {
+			if _, ok := model[string(k)]; !ok {
+				t.Fatalf("seed %d: phantom key %s", seed, k)
+			}
+			return true
+		})
+		if err != nil {
+			t.Fatalf("seed %d: range: %s", seed, err)
+		}
+		fs.setProb(0.002)
+		return s
+	}
+
+	s := open()
+	for step := 0; step < steps; step++ {
+		k := "k" + strconv.Itoa(rnd.Intn(40))
+		faults := fs.faultCount()
+		var err error
+		op := rnd.Intn(100)
+		if mode == 0 && op < 85 {
+			dirty[k] = true
+		}
+		switch {
+		case op < 45:
+			v := make([]byte, 1+rnd.Intn(300))
+			if rnd.Intn(40) == 0 {
+				// blob
+				v = make([]byte, blobThreshold+rnd.Intn(3*blobExtent))
+			}
+			rnd.Read(v)
+			expire := uint32(0)
+			if rnd.Intn(4) == 0 {
+				expire = far
+			}
+			err = s.Set([]byte(k), v, expire)
+			if err == nil {
+				ack(k, v)
+			} else {
+				model.maybe(k, v)
+			}
+		case op < 60:
+			_, err = s.Delete([]byte(k))
+			if err == nil {
+				ack(k, nil)
+			} else {
+				model.maybe(k, nil)
+			}
+		case op < 75:
+			k = "c" + strconv.Itoa(rnd.Intn(5))
+			dirty[k] = mode == 0
+			by := uint64(1 + rnd.Intn(10))
+			var n uint64
+			n, err = s.Incr([]byte(k), by)
+			if err == nil {
+				ack(k, counterValue(n))
+				break
+			}
+			// incr may be applied to any possible value
+			vals, ok := model[k]
+			if !ok {
+				vals = [][]byte{nil}
+			}
+			for _, v := range vals {
+				old := uint64(0)
+				if v != nil {
+					old, _ = parseUint(v)
+				}
+				model.maybe(k, counterValue(old+by))
+			}
+		case op < 85:
+			err = s.Touch([]byte(k), far)
+			if err == ErrNotFound {
+				err = nil
+			}
+		case op < 97:
+			var v []byte
+			v, err = s.Get([]byte(k))
+			if err == ErrNotFound {
+				v, err = nil, nil
+			}
+			if err == nil && !model.has(k, v) {
+				t.Fatalf("seed %d step %d: get %s return %q, possible %q", seed, step, k, v, model[k])
+			}
+		case op < 98:
+			err = s.Compact()
+		default:
+			// clean restart
+			err = s.Close()
+			if err == nil {
+				s = open()
+				continue
+			}
+			fs.setFailed()
+		}
+		if err != nil && fs.faultCount() == faults {
+			t.Fatalf("seed %d step %d: %s", seed, step, err)
+		}
+		if errors.Is(err, ErrFailed) {
+			// logged write is not applied after read fault, store must be reopened
+			fs.setFailed()
+		}
+		if fs.isFailed() || rnd.Intn(150) == 0 {
+			abandon(s)
+			fs.crash()
+			if mode == 0 {
+				repairChunks(t, fs)
+			}
+			s = open()
+		}
+	}
+	if err := s.Close(); err != nil {
+		// fault may be injected in close
+		abandon(s)
+		fs.crash()
+		if mode == 0 {
+			repairChunks(t, fs)
+		}
+	}
+	s = open()
+	fs.setProb(0)
+	if err := s.Close(); err != nil {
+		t.Fatalf("seed %d: close: %s", seed, err)
+	}
+}
+
+// repairChunks repair chunk files of crashed store, as sniper fsck -repair
+func repairChunks(t *testing.T, fs *faultFS) {
+	fs.setProb(0)
+	var files []string
+	for _, name := range fs.mem.Names() {
+		if chunkName.MatchString(filepath.Base(name)) {
+			files = append(files, name)
+		}
+	}
+	if _, err := verifyFiles(fs, files, true, false); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCrash(t *testing.T) {
+	seeds := 20
+	if testing.Short() {
+		seeds = 3
+	}
+	for _, mode := range []DurabilityMode{0, SyncEveryWrite, GroupCommit, Interval} {
+		for seed := int64(1); seed <= int64(seeds); seed++ {
+			t.Run(fmt.Sprintf("%d/%d", mode, seed), func(t *testing.T) {
+				crashRun(t, seed, 1500, mode)
+			})
+		}
+	}
+}
+
+// TestWALSyncFail - error of background fsync is returned by next write and Close
+func TestWALSyncFail(t *testing.T) {
+	fs := newFaultFS(1)
+	opts := []OptStore{Dir("crash"), FS(fs), ChunksTotal(2), ChunksCollision(1), Durability(Interval), SyncInterval(10 * time.Millisecond)}
+	s, err := Open(opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = s.Set([]byte("k"), []byte("v"), 0); err != nil {
+		t.Fatal(err)
+	}
+	fs.inject(nil, func(name string) bool {
+		return name == filepath.Join("crash", "wal.log")
+	})
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		err = s.Set([]byte("k"), []byte("v2"), 0)
+		if err != nil || time.Now().After(deadline) {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if !errors.Is(err, ErrFailed) {
+		t.Fatalf("write after failed log fsync: %v", err)
+	}
+	fs.inject(nil, nil)
+	if err = s.Close(); !errors.Is(err, ErrFailed) {
+		t.Fatalf("close after failed log fsync: %v", err)
+	}
+	// store is closed and may be opened again
+	s, err = Open(opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = s.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// TestBucketCrash - bucket value and index must survive crash together
+func TestBucketCrash(t *testing.T) {
+	for _, mode := range []DurabilityMode{0, SyncEveryWrite} {
+		for seed := int64(1); seed <= 5; seed++ {
+			fs := newFaultFS(seed)
+			opts := []OptStore{Dir("crash"), FS(fs), ChunksTotal(8), ChunksCollision(1)}
+			if mode != 0 {
+				opts = append(opts, Durability(mode))
+			}
+			s, err := Open(opts...)
+			if err != nil {
+				t.Fatal(err)
+			}
+			// new store and bucket list are synced on close
+			if _, err = s.Bucket("b"); err != nil {
+				t.Fatal(err)
+			}
+			if err = s.Close(); err != nil {
+				t.Fatal(err)
+			}
+			s, err = Open(opts...)
+			if err != nil {
+				t.Fatal(err)
+			}
+			bucket, err := s.Bucket("b")
+			if err != nil {
+				t.Fatal(err)
+			}
+			for i := 0; i < 20; i++ {
+				if err = s.Put(bucket, []byte("k"+strconv.Itoa(i)), []byte("v")); err != nil {
+					t.Fatal(err)
+				}
+			}
+			for i := 0; i < 20; i += 3 {
+				if _, err = s.DeleteFromBucket(bucket, []byte("k"+strconv.Itoa(i))); err != nil {
+					t.Fatal(err)
+				}
+			}
+			abandon(s)
+			fs.crash()
+
+			s, err = Open(opts...)
+			if err != nil {
+				t.Fatalf("mode %d seed %d: open: %s", mode, seed, err)
+			}
+			bucket, err = s.Bucket("b")
+			if err != nil {
+				t.Fatal(err)
+			}
+			keys := make(map[string]bool)
+			for _, k := range s.Keys(bucket, 0, 0) {
+				keys[k] = true
+			}
+			for i := 0; i < 20; i++ {
+				k := "k" + strconv.Itoa(i)
+				_, err = s.Get([]byte("b" + k))
+				if i%3 == 0 {
+					if err != ErrNotFound || keys[k] {
+						t.Fatalf("mode %d seed %d: deleted key %s: %v, in index %v", mode, seed, k, err, keys[k])
+					}
+					continue
+				}
+				if err != nil || !keys[k] {
+					t.Fatalf("mode %d seed %d: key %s: %v, in index %v", mode, seed, k, err, keys[k])
+				}
+			}
+			if err = s.Close(); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+}
+
+// TestBatchApplyFail - batch, which failed in the middle of apply, is rolled
+// forward or store refuse writes, so batch can't be lost or overwritten
+func TestBatchApplyFail(t *testing.T) {
+	for _, retry := range []bool{true, false} {
+		fs := newFaultFS(1)
+		opts := []OptStore{Dir("batch"), FS(fs), ChunksTotal(2), ChunksCollision(1)}
+		s, err := Open(opts...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, k := range []string{"a", "b", "c"} {
+			if err = s.Set([]byte(k), []byte("old"), 0); err != nil {
+				t.Fatal(err)
+			}
+		}
+		// second write in chunks fail, on retry - only once
+		writes := 0
+		fs.inject(func(name string) bool {
+			if name != filepath.Join("batch", "1") {
+				return false
+			}
+			writes++
+			return writes == 2 || (!retry && writes > 2)
+		}, nil)
+		b := &Batch{}
+		b.Set([]byte("a"), []byte("new"), 0)
+		b.Set([]byte("b"), []byte("new"), 0)
+		err = s.Write(b)
+		fs.inject(nil, nil)
+		if retry {
+			if err != nil {
+				t.Fatalf("batch is not rolled forward: %s", err)
+			}
+		} else {
+			if !errors.Is(err, ErrFailed) {
+				t.Fatalf("batch apply fail: %v", err)
+			}
+			b.Reset()
+			b.Set([]byte("c"), []byte("new"), 0)
+			if err = s.Write(b); !errors.Is(err, ErrFailed) {
+				t.Fatalf("write after failed batch: %v", err)
+			}
+			if err = s.Set([]byte("c"), []byte("new"), 0); !errors.Is(err, ErrFailed) {
+				t.Fatalf("set after failed batch: %v", err)
+			}
+			s.Close()
+			s, err = Open(opts...)
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		for k, want := range map[string]string{"a": "new", "b": "new", "c": "old"} {
+			v, err := s.Get([]byte(k))
+			if err != nil || string(v) != want {
+				t.Fatalf("retry %v: key %s = %q, %v, want %q", retry, k, v, err, want)
+			}
+		}
+		if err = s.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// TestLoggedWriteFail - write, which failed after it was logged, put store
+// in failed state and is finished by log replay, so it can't come back as phantom
+func TestLoggedWriteFail(t *testing.T) {
+	fs := newFaultFS(1)
+	opts := []OptStore{Dir("wal"), FS(fs), ChunksTotal(1), ChunksCollision(0), Durability(SyncEveryWrite)}
+	s, err := Open(opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = s.Set([]byte("k"), []byte("old"), 0); err != nil {
+		t.Fatal(err)
+	}
+	fs.inject(func(name string) bool {
+		return name == filepath.Join("wal", "0")
+	}, nil)
+	err = s.Set([]byte("k"), []byte("new"), 0)
+	fs.inject(nil, nil)
+	if !errors.Is(err, ErrFailed) {
+		t.Fatalf("set with failed apply: %v", err)
+	}
+	if err = s.Set([]byte("other"), []byte("v"), 0); !errors.Is(err, ErrFailed) {
+		t.Fatalf("set after failed apply: %v", err)
+	}
+	s.Close()
+	s, err = Open(opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	v, err := s.Get([]byte("k"))
+	if err != nil || string(v) != "new" {
+		t.Fatalf("logged write after reopen: %q, %v", v, err)
+	}
+	if err = s.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestLoggedMultiFail(t *testing.T) {
+	fs := newFaultFS(1)
+	opts := []OptStore{Dir("wal"), FS(fs), ChunksTotal(1), ChunksCollision(0), Durability(SyncEveryWrite)}
+	s, err := Open(opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keys := [][]byte{[]byte("k1"), []byte("k2")}
+	for _, err = range s.SetMulti([]KV{{Key: keys[0], Value: []byte("old")}, {Key: keys[1], Value: []byte("old")}}) {
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	failChunk := func(name string) bool {
+		return name == filepath.Join("wal", "0")
+	}
+	// reopen store and check values of keys
+	reopen := func(want string) {
+		s.Close()
+		s, err = Open(opts...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, k := range keys {
+			v, err := s.Get(k)
+			if want == "" && err != ErrNotFound || want != "" && (err != nil || string(v) != want) {
+				t.Fatalf("logged write of %s after reopen: %q, %v", k, v, err)
+			}
+		}
+	}
+
+	fs.inject(failChunk, nil)
+	errs := s.SetMulti([]KV{{Key: keys[0], Value: []byte("new")}, {Key: keys[1], Value: []byte("new")}})
+	fs.inject(nil, nil)
+	if !errors.Is(errs[0], ErrFailed) {
+		t.Fatalf("set multi with failed apply: %v", errs)
+	}
+	if err = s.Set([]byte("other"), []byte("v"), 0); !errors.Is(err, ErrFailed) {
+		t.Fatalf("set after failed apply: %v", err)
+	}
+	reopen("new")
+
+	fs.inject(failChunk, nil)
+	_, errs = s.DeleteMulti(keys)
+	fs.inject(nil, nil)
+	if !errors.Is(errs[0], ErrFailed) {
+		t.Fatalf("delete multi with failed apply: %v", errs)
+	}
+	reopen("")
+	if err = s.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// TestHintCrash - hints are written periodically, store, which was not
+// closed, is opened from them after crash
+func TestHintCrash(t *testing.T) {
+	fs := newFaultFS(1)
+	opts := []OptStore{Dir("hint"), FS(fs), ChunksTotal(1), ChunksCollision(0), HintInterval(10 * time.Millisecond)}
+	s, err := Open(opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 100; i++ {
+		if err = s.Set([]byte("k"+strconv.Itoa(i)), []byte("v"), 0); err != nil {
+			t.Fatal(err)
+		}
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		c := &s.chunks[0]
+		c.RLock()
+		hinted := c.hinted && !c.changed
+		c.RUnlock()
+		if hinted {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("hint is not written")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	abandon(s)
+	fs.crash()
+
+	s, err = Open(opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !s.chunks[0].hinted {
+		t.Fatal("chunk is not opened from hint")
+	}
+	for i := 0; i < 100; i++ {
+		v, err := s.Get([]byte("k" + strconv.Itoa(i)))
+		if err != nil || string(v) != "v" {
+			t.Fatalf("key %d after crash: %q, %v", i, v, err)
+		}
+	}
+	if err = s.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// TestReshardCrash - Reshard run together with writes, write or sync fault is
+// injected at random point of it, then store crash. Store must be opened with
+// old or new chunks (new ones, if Reshard succeed) and keep acknowledged writes.
+// Unfinished Reshard is resumed and must keep values and versions of records
+func TestReshardCrash(t *testing.T) {
+	seeds := 30
+	if testing.Short() {
+		seeds = 5
+	}
+	for seed := int64(1); seed <= int64(seeds); seed++ {
+		fs := newFaultFS(seed)
+		opts := []OptStore{Dir("reshard"), FS(fs), Durability(SyncEveryWrite)}
+		s, err := Open(append(opts, ChunksTotal(8), ChunksCollision(1))...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		const keys = 500
+		model := make(crashModel)
+		for i := 0; i < keys; i++ {
+			k := "k" + strconv.Itoa(i)
+			if err = s.Set([]byte(k), []byte("0"), 0); err != nil {
+				t.Fatal(err)
+			}
+			model.ack(k, []byte("0"))
+		}
+		// fault in n-th write or sync, hooks are called under lock of fs
+		n, limit := 0, rand.New(rand.NewSource(seed)).Intn(800)+1
+		fault := func(name string) bool {
+			n++
+			return n == limit
+		}
+		fs.inject(fault, fault)
+
+		done := make(chan struct{})
+		stopped := make(chan struct{})
+		go func() {
+			defer close(stopped)
+			for i := 1; ; i++ {
+				select {
+				case <-done:
+					return
+				default:
+				}
+				k, v := "k"+strconv.Itoa(i%keys), []byte(strconv.Itoa(i))
+				if err := s.Set([]byte(k), v, 0); err != nil {
+					model.maybe(k, v)
+					return
+				}
+				model.ack(k, v)
+			}
+		}()
+		errReshard := s.Reshard(32, 2)
+		close(done)
+		<-stopped
+		abandon(s)
+		fs.crash()
+		fs.inject(nil, nil)
+
+		s, err = Open(opts...)
+		if err != nil {
+			t.Fatalf("seed %d, reshard %v: open: %v", seed, errReshard, err)
+		}
+		if errReshard == nil && s.chunksCnt != 32 {
+			t.Fatalf("seed %d: resharded store is opened with %d chunks", seed, s.chunksCnt)
+		}
+		if s.chunksCnt != 8 && s.chunksCnt != 32 {
+			t.Fatalf("seed %d: store has %d chunks", seed, s.chunksCnt)
+		}
+		for k := range model {
+			v, err := s.Get([]byte(k))
+			if err != nil && err != ErrNotFound {
+				t.Fatalf("seed %d: get %s: %v", seed, k, err)
+			}
+			if !model.has(k, v) {
+				t.Fatalf("seed %d, reshard %v: key %s has %q, expected one of %q", seed, errReshard, k, v, model[k])
+			}
+		}
+		if s.chunksCnt == 8 {
+			// unfinished reshard is resumed, keys changed meanwhile are copied
+			for i := 0; i < 20; i++ {
+				k := []byte("k" + strconv.Itoa(i))
+				if i%2 == 0 {
+					_, err = s.Delete(k)
+				} else {
+					err = s.Set(k, []byte("resumed"), 0)
+				}
+				if err != nil && err != ErrNotFound {
+					t.Fatal(err)
+				}
+			}
+			want := make(map[string]Meta)
+			vals := make(map[string][]byte)
+			for k := range model {
+				v, meta, err := s.GetWithMeta([]byte(k))
+				if err != nil && err != ErrNotFound {
+					t.Fatal(err)
+				}
+				want[k], vals[k] = meta, v
+			}
+			if err = s.Reshard(32, 2); err != nil {
+				t.Fatalf("seed %d: resume reshard: %v", seed, err)
+			}
+			if s.chunksCnt != 32 {
+				t.Fatalf("seed %d: resumed reshard has %d chunks", seed, s.chunksCnt)
+			}
+			for k := range model {
+				v, meta, err := s.GetWithMeta([]byte(k))
+				if err != nil && err != ErrNotFound {
+					t.Fatal(err)
+				}
+				if !bytes.Equal(v, vals[k]) || meta.Version != want[k].Version {
+					t.Fatalf("seed %d: key %s has %q version %d, expected %q version %d", seed, k, v, meta.Version, vals[k], want[k].Version)
+				}
+			}
+		}
+		// chunks of other generations are removed
+		for _, name := range fs.mem.Names() {
+			base := filepath.Base(name)
+			if chunkName.MatchString(base) && strings.HasSuffix(base, ".g1") != (s.chunksGen == 1) {
+				t.Fatalf("seed %d: chunk %s of other generation", seed, name)
+			}
+		}
+		if err = s.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// TestReshardResume - Reshard is interrupted by write fault in new chunks
+// and crash. Resumed Reshard must not write copied records again and must
+// copy keys, changed while it was interrupted
+func TestReshardResume(t *testing.T) {
+	opts := []OptStore{Dir("resume"), Durability(SyncEveryWrite)}
+	open := func(fs *faultFS) *Store {
+		s, err := Open(append(opts, FS(fs), ChunksTotal(8), ChunksCollision(1))...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return s
+	}
+	fill := func(s *Store) {
+		big := make([]byte, 1<<20)
+		for i := 0; i < 64; i++ {
+			big[0] = byte(i)
+			if err := s.Set([]byte("big"+strconv.Itoa(i)), big, 0); err != nil {
+				t.Fatal(err)
+			}
+		}
+		for i := 0; i < 500; i++ {
+			if err := s.Set([]byte("k"+strconv.Itoa(i)), []byte(strconv.Itoa(i)), 0); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	// writes in new chunks, counted under lock of fs
+	writes, limit := 0, -1
+	count := func(name string) bool {
+		if !strings.Contains(name, ".g1") {
+			return false
+		}
+		writes++
+		return writes == limit
+	}
+
+	fs := newFaultFS(1)
+	s := open(fs)
+	fill(s)
+	fs.inject(count, nil)
+	if err := s.Reshard(32, 2); err != nil {
+		t.Fatal(err)
+	}
+	fs.inject(nil, nil)
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+	total := writes
+
+	fs = newFaultFS(1)
+	s = open(fs)
+	fill(s)
+	// log replay after crash write records with new versions,
+	// checkpoint leave nothing to replay
+	if err := s.checkpoint(); err != nil {
+		t.Fatal(err)
+	}
+	metas := make(map[string]Meta)
+	for i := 0; i < 500; i++ {
+		k := "k" + strconv.Itoa(i)
+		_, metas[k], _ = s.GetWithMeta([]byte(k))
+	}
+	writes, limit = 0, total*3/4
+	fs.inject(count, nil)
+	if err := s.Reshard(32, 2); err == nil {
+		t.Fatal("reshard is not interrupted")
+	}
+	abandon(s)
+	fs.crash()
+	fs.inject(nil, nil)
+
+	s, err := Open(append(opts, FS(fs))...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.chunksCnt != 8 || s.resharding == nil {
+		t.Fatalf("store has %d chunks, unfinished reshard %v", s.chunksCnt, s.resharding)
+	}
+	if _, err = s.Delete([]byte("k0")); err != nil {
+		t.Fatal(err)
+	}
+	if err = s.Set([]byte("k1"), []byte("changed"), 0); err != nil {
+		t.Fatal(err)
+	}
+	_, metas["k1"], _ = s.GetWithMeta([]byte("k1"))
+	writes, limit = 0, -1
+	fs.inject(count, nil)
+	if err = s.Reshard(32, 2); err != nil {
+		t.Fatal(err)
+	}
+	fs.inject(nil, nil)
+	if writes > total*2/3 {
+		t.Fatalf("resumed reshard made %d writes, full one %d", writes, total)
+	}
+	if err = s.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	s, err = Open(append(opts, FS(fs))...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.chunksCnt != 32 {
+		t.Fatalf("store has %d chunks", s.chunksCnt)
+	}
+	if _, err = s.Get([]byte("k0")); err != ErrNotFound {
+		t.Fatalf("deleted key: %v", err)
+	}
+	for i := 1; i < 500; i++ {
+		k := "k" + strconv.Itoa(i)
+		v, meta, err := s.GetWithMeta([]byte(k))
+		if err != nil {
+			t.Fatal(err)
+		}
+		want := strconv.Itoa(i)
+		if i == 1 {
+			want = "changed"
+		}
+		if string(v) != want || meta.Version != metas[k].Version {
+			t.Fatalf("key %s has %q version %d, expected %q version %d", k, v, meta.Version, want, metas[k].Version)
+		}
+	}
+	for i := 0; i < 64; i++ {
+		v, err := s.Get([]byte("big" + strconv.Itoa(i)))
+		if err != nil || len(v) != 1<<20 || v[0] != byte(i) {
+			t.Fatalf("big%d: %v", i, err)
+		}
+	}
+	if err = s.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,284 @@
+package sniper
+
+import (
+	"encoding/binary"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/tidwall/interval"
+)
+
+const (
+	hintVersion = 3
+	hintTail    = 4096 // bytes at the end of covered part of chunk, checked on load
+)
+
+// hint file keep chunk index: key hashes with meta, holes and free
+// extents of blob file, so chunk may be opened without full scan.
+// Hint cover chunk file from begin to covered length, records appended
+// after it are scanned on open. Hint is removed before chunk is changed
+// inside covered part (record overwritten, deleted or touched).
+// Layout, big endian:
+// hint version (1), chunk version (1), covered length (8), crc32c of covered tail (4),
+// last record version (8),
+// keys count (4), keys: hash (4), addr<<5 | size (8), expire (4),
+// holes count (4), holes: addr (8), size (1),
+// blob file length (8), free extents count (4), free extents: addr (8),
+// crc32c of all above (4)
+
+// HintInterval - how often hints of changed chunks are written, so store,
+// which was not closed (process crash), is opened without full scan of chunks
+// changed before last hint. With write ahead log it is checkpoint. Hint of
+// chunk is written under its lock and chunk is synced before, so reads and
+// writes of chunk wait for it. Default 0 - hints are written only on Close
+// and checkpoint of log
+func HintInterval(interv time.Duration) OptStore {
+	return func(s *Store) error {
+		s.hintInterval = interv
+		return nil
+	}
+}
+
+// startHints - start periodic writing of hints
+func (s *Store) startHints() {
+	if s.hintInterval <= 0 {
+		return
+	}
+	s.hintiv = interval.Set(func(t time.Time) {
+		// error is returned by next write and Close
+		if err := s.writeHints(); err != nil {
+			s.fail(err)
+		}
+	}, s.hintInterval)
+}
+
+// writeHints write hints of changed chunks, chunk is synced before.
+// With write ahead log it is checkpoint, log is truncated
+func (s *Store) writeHints() (err error) {
+	if s.wal != nil {
+		return s.checkpoint()
+	}
+	err = s.writable()
+	if err != nil {
+		return
+	}
+	s.RLock()
+	defer s.RUnlock()
+	for i := range s.chunks {
+		c := &s.chunks[i]
+		c.Lock()
+		err = c.writeHint()
+		c.Unlock()
+		if err != nil {
+			return
+		}
+	}
+	return
+}
+
+// hintName return hint file name of chunk
+func hintName(name string) string {
+	return name + ".hint"
+}
+
+// tailCRC return checksum of last bytes of chunk file before size
+func tailCRC(f io.ReaderAt, size int64) (crc uint32, err error) {
+	off := size - hintTail
+	if off < 0 {
+		off = 0
+	}
+	b := make([]byte, size-off)
+	_, err = f.ReadAt(b, off)
+	if err != nil {
+		return
+	}
+	return crc32.Checksum(b, crcTable), nil
+}
+
+// marshalHint encode chunk index
+func (c *chunk) marshalHint(size int64, crc uint32) []byte {
+	b := make([]byte, 0, 42+16*len(c.m)+9*len(c.h)+8*len(c.blobFree))
+	b = append(b, hintVersion, currentChunkVersion)
+	b = binary.BigEndian.AppendUint64(b, uint64(size))
+	b = binary.BigEndian.AppendUint32(b, crc)
+	b = binary.BigEndian.AppendUint64(b, c.lastVer)
+	b = binary.BigEndian.AppendUint32(b, uint32(len(c.m)))
+	for h, meta := range c.m {
+		addr, size, expire := decodeKeyMeta(meta)
+		b = binary.BigEndian.AppendUint32(b, h)
+		b = binary.BigEndian.AppendUint64(b, addr<<5|uint64(size))
+		b = binary.BigEndian.AppendUint32(b, expire)
+	}
+	b = binary.BigEndian.AppendUint32(b, uint32(len(c.h)))
+	for addr, size := range c.h {
+		b = binary.BigEndian.AppendUint64(b, addr)
+		b = append(b, size)
+	}
+	b = binary.BigEndian.AppendUint64(b, c.blobEnd)
+	b = binary.BigEndian.AppendUint32(b, uint32(len(c.blobFree)))
+	for _, addr := range c.blobFree {
+		b = binary.BigEndian.AppendUint64(b, addr)
+	}
+	return binary.BigEndian.AppendUint32(b, crc32.Checksum(b, crcTable))
+}
+
+// hintReader - bounds checked reader of hint file
+type hintReader struct {
+	b   []byte
+	bad bool
+}
+
+func (r *hintReader) next(n int) []byte {
+	if r.bad || n < 0 || n > len(r.b) {
+		r.bad = true
+		return make([]byte, 8)
+	}
+	v := r.b[:n]
+	r.b = r.b[n:]
+	return v
+}
+
+func (r *hintReader) uint32() uint32 { return binary.BigEndian.Uint32(r.next(4)) }
+func (r *hintReader) uint64() uint64 { return binary.BigEndian.Uint64(r.next(8)) }
+func (r *hintReader) byte() byte     { return r.next(1)[0] }
+
+// hintData - decoded hint file
+type hintData struct {
+	covered uint64 // covered length of chunk
+	crc     uint32 // checksum of covered tail
+	lastVer uint64
+	keys    map[uint32]keyMeta
+	holes   map[uint64]byte
+	blobEnd uint64
+	free    []uint64
+}
+
+// parseHint decode hint file, ok is false if hint is corrupted
+// or has other version
+func parseHint(b []byte) (hd *hintData, ok bool) {
+	if len(b) < 46 {
+		return
+	}
+	if crc32.Checksum(b[:len(b)-4], crcTable) != binary.BigEndian.Uint32(b[len(b)-4:]) {
+		return
+	}
+	r := &hintReader{b: b[:len(b)-4]}
+	if r.byte() != hintVersion || r.byte() != currentChunkVersion {
+		return
+	}
+	hd = &hintData{keys: make(map[uint32]keyMeta), holes: make(map[uint64]byte)}
+	hd.covered = r.uint64()
+	hd.crc = r.uint32()
+	hd.lastVer = r.uint64()
+	for i := r.uint32(); i > 0 && !r.bad; i-- {
+		hash, packed, expire := r.uint32(), r.uint64(), r.uint32()
+		hd.keys[hash] = encodeKeyMeta(packed>>5, byte(packed&31), expire)
+	}
+	for i := r.uint32(); i > 0 && !r.bad; i-- {
+		addr := r.uint64()
+		hd.holes[addr] = r.byte()
+	}
+	hd.blobEnd = r.uint64()
+	for i := r.uint32(); i > 0 && !r.bad; i-- {
+		hd.free = append(hd.free, r.uint64())
+	}
+	if r.bad || len(r.b) != 0 {
+		return nil, false
+	}
+	return hd, true
+}
+
+// matchHint return true if hint cover existing part of chunk file
+func matchHint(f io.ReaderAt, hd *hintData, size int64) bool {
+	if hd.covered < 2 || hd.covered > uint64(size) {
+		return false
+	}
+	tail, err := tailCRC(f, int64(hd.covered))
+	return err == nil && tail == hd.crc
+}
+
+// loadHint load chunk index and free blob extents from hint file,
+// return covered length of chunk. ok is false if hint is missing, corrupted
+// or do not match chunk file, then chunk must be scanned from begin
+func (c *chunk) loadHint(size int64) (covered uint64, ok bool) {
+	b, err := readFile(c.fs, hintName(c.name))
+	if err != nil {
+		return
+	}
+	hd, ok := parseHint(b)
+	if !ok || !matchHint(c.f, hd, size) || hd.blobEnd > c.blobEnd {
+		return 0, false
+	}
+	now := time.Now().Unix()
+	for hash, meta := range hd.keys {
+		addr, size, expire := decodeKeyMeta(meta)
+		if expire != 0 && int64(expire) < now {
+			hd.holes[addr] = size
+			delete(hd.keys, hash)
+		}
+	}
+	// extents, allocated after hint, are free until used by appended records
+	free := hd.free
+	for addr := hd.blobEnd; addr < c.blobEnd; addr += blobExtent {
+		free = append(free, addr)
+	}
+	c.m, c.h, c.blobFree = hd.keys, hd.holes, free
+	if hd.lastVer > c.lastVer {
+		c.lastVer = hd.lastVer
+	}
+	c.hinted = true
+	return hd.covered, true
+}
+
+// writeHint write hint file of changed chunk, chunk is synced before,
+// so hint never cover records which are not on disk
+func (c *chunk) writeHint() (err error) {
+	if c.readOnly || !c.changed {
+		return nil
+	}
+	err = c.sync()
+	if err != nil {
+		return
+	}
+	fi, err := c.f.Stat()
+	if err != nil {
+		return
+	}
+	crc, err := tailCRC(c.f, fi.Size())
+	if err != nil {
+		return
+	}
+	name := hintName(c.name)
+	tmp := name + ".tmp"
+	err = writeFile(c.fs, tmp, c.marshalHint(fi.Size(), crc))
+	if err != nil {
+		c.fs.Remove(tmp)
+		return
+	}
+	err = c.fs.Rename(tmp, name)
+	if err != nil {
+		return
+	}
+	c.hinted = true
+	c.changed = false
+	// hint must survive crash, if store is not closed
+	return c.fs.SyncDir(filepath.Dir(c.name))
+}
+
+// dropHint remove hint file before chunk is changed in covered part,
+// removal must be on disk before change
+func (c *chunk) dropHint() (err error) {
+	c.changed = true
+	if !c.hinted {
+		return nil
+	}
+	err = c.fs.Remove(hintName(c.name))
+	if err != nil && !os.IsNotExist(err) {
+		return
+	}
+	c.hinted = false
+	return c.fs.SyncDir(filepath.Dir(c.name))
+}
@@ -0,0 +1,273 @@
+// Package httpserver - HTTP/JSON API for sniper store
+//
+//	PUT    /kv/{key}                      store request body, optional headers
+//	                                      X-TTL (seconds) or X-Expire (unix time)
+//	GET    /kv/{key}                      return value, X-TTL and X-Expire headers
+//	DELETE /kv/{key}                      delete key
+//	POST   /incr/{key}?by=n               incr counter by n (decr if n < 0)
+//	GET    /buckets/{name}?limit=&offset= return keys of bucket
+//	GET    /backup                        stream gzipped backup
+//
+// usage:
+//
+//	http.ListenAndServe(":8080", httpserver.New(s))
+package httpserver
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/recoilme/sniper"
+)
+
+// DefaultMaxValueSize - maximum size of value in PUT request
+const DefaultMaxValueSize = 512 << 20
+
+// Server - http handler for store
+type Server struct {
+	s            *sniper.Store
+	MaxValueSize int64
+}
+
+// New return handler for store
+func New(s *sniper.Store) *Server {
+	return &Server{s: s, MaxValueSize: DefaultMaxValueSize}
+}
+
+// ServeHTTP route request to handler
+func (srv *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	path := r.URL.Path
+	switch {
+	case strings.HasPrefix(path, "/kv/"):
+		k := []byte(strings.TrimPrefix(path, "/kv/"))
+		switch r.Method {
+		case http.MethodGet, http.MethodHead:
+			srv.get(w, r, k)
+		case http.MethodPut:
+			srv.put(w, r, k)
+		case http.MethodDelete:
+			srv.delete(w, r, k)
+		default:
+			methodNotAllowed(w, "GET, HEAD, PUT, DELETE")
+		}
+	case strings.HasPrefix(path, "/incr/"):
+		if r.Method != http.MethodPost {
+			methodNotAllowed(w, "POST")
+			return
+		}
+		srv.incr(w, r, []byte(strings.TrimPrefix(path, "/incr/")))
+	case strings.HasPrefix(path, "/buckets/"):
+		if r.Method != http.MethodGet {
+			methodNotAllowed(w, "GET")
+			return
+		}
+		srv.bucket(w, r, strings.TrimPrefix(path, "/buckets/"))
+	case path == "/backup":
+		if r.Method != http.MethodGet {
+			methodNotAllowed(w, "GET")
+			return
+		}
+		srv.backup(w, r)
+	default:
+		writeError(w, http.StatusNotFound, "not found")
+	}
+}
+
+// writeJSON write v as json with status
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+// writeError write error as json {"error": msg}
+func writeError(w http.ResponseWriter, status int, msg string) {
+	writeJSON(w, status, map[string]string{"error": msg})
+}
+
+// storeError write store error with matching status
+func storeError(w http.ResponseWriter, err error) {
+	switch err {
+	case sniper.ErrNotFound:
+		writeError(w, http.StatusNotFound, "key not found")
+	case sniper.ErrCollision:
+		writeError(w, http.StatusConflict, err.Error())
+	default:
+		writeError(w, http.StatusInternalServerError, err.Error())
+	}
+}
+
+func methodNotAllowed(w http.ResponseWriter, allow string) {
+	w.Header().Set("Allow", allow)
+	writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+}
+
+// validKey check key, store keep key length in 16 bits
+func validKey(w http.ResponseWriter, k []byte) bool {
+	if len(k) == 0 || len(k) > math.MaxUint16 {
+		writeError(w, http.StatusBadRequest, "bad key")
+		return false
+	}
+	return true
+}
+
+// expireFromHeaders read X-TTL or X-Expire header
+func expireFromHeaders(r *http.Request) (expire uint32, err error) {
+	if ttl := r.Header.Get("X-TTL"); ttl != "" {
+		sec, err := strconv.ParseUint(ttl, 10, 32)
+		if err != nil || sec == 0 {
+			return 0, fmt.Errorf("bad X-TTL %q", ttl)
+		}
+		at := uint64(time.Now().Unix()) + sec
+		if at > math.MaxUint32 {
+			return 0, fmt.Errorf("bad X-TTL %q", ttl)
+		}
+		return uint32(at), nil
+	}
+	if at := r.Header.Get("X-Expire"); at != "" {
+		sec, err := strconv.ParseUint(at, 10, 32)
+		if err != nil {
+			return 0, fmt.Errorf("bad X-Expire %q", at)
+		}
+		return uint32(sec), nil
+	}
+	return 0, nil
+}
+
+// get - value and expire are read in one call, so headers match body
+func (srv *Server) get(w http.ResponseWriter, r *http.Request, k []byte) {
+	v, meta, err := srv.s.GetWithMeta(k)
+	if err != nil {
+		storeError(w, err)
+		return
+	}
+	if meta.Expire > 0 {
+		ttl := int64(time.Until(time.Unix(int64(meta.Expire), 0)).Round(time.Second) / time.Second)
+		if ttl < 0 {
+			// expire in current second
+			ttl = 0
+		}
+		w.Header().Set("X-TTL", strconv.FormatInt(ttl, 10))
+		w.Header().Set("X-Expire", strconv.FormatUint(uint64(meta.Expire), 10))
+	}
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Content-Length", strconv.Itoa(len(v)))
+	w.WriteHeader(http.StatusOK)
+	if r.Method != http.MethodHead {
+		w.Write(v)
+	}
+}
+
+func (srv *Server) put(w http.ResponseWriter, r *http.Request, k []byte) {
+	if !validKey(w, k) {
+		return
+	}
+	expire, err := expireFromHeaders(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	v, err := io.ReadAll(http.MaxBytesReader(w, r.Body, srv.MaxValueSize))
+	if err != nil {
+		writeError(w, http.StatusRequestEntityTooLarge, err.Error())
+		return
+	}
+	err = srv.s.Set(k, v, expire)
+	if err != nil {
+		storeError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (srv *Server) delete(w http.ResponseWriter, r *http.Request, k []byte) {
+	isDeleted, err := srv.s.Delete(k)
+	if err != nil {
+		storeError(w, err)
+		return
+	}
+	if !isDeleted {
+		storeError(w, sniper.ErrNotFound)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// incr - counter is stored as decimal string with Store.IncrInt,
+// same as by redis and memcached servers
+func (srv *Server) incr(w http.ResponseWriter, r *http.Request, k []byte) {
+	if !validKey(w, k) {
+		return
+	}
+	by := int64(1)
+	if s := r.URL.Query().Get("by"); s != "" {
+		var err error
+		by, err = strconv.ParseInt(s, 10, 64)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, fmt.Sprintf("bad by %q", s))
+			return
+		}
+	}
+	n, err := srv.s.IncrInt(k, by)
+	if err == sniper.ErrNotNumber || err == sniper.ErrOverflow {
+		writeError(w, http.StatusConflict, err.Error())
+		return
+	}
+	if err != nil {
+		storeError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]int64{"value": n})
+}
+
+func (srv *Server) bucket(w http.ResponseWriter, r *http.Request, name string) {
+	q := r.URL.Query()
+	var limit, offset int
+	var err error
+	if s := q.Get("limit"); s != "" {
+		limit, err = strconv.Atoi(s)
+		if err != nil || limit < 0 {
+			writeError(w, http.StatusBadRequest, fmt.Sprintf("bad limit %q", s))
+			return
+		}
+	}
+	if s := q.Get("offset"); s != "" {
+		offset, err = strconv.Atoi(s)
+		if err != nil || offset < 0 {
+			writeError(w, http.StatusBadRequest, fmt.Sprintf("bad offset %q", s))
+			return
+		}
+	}
+	// do not create bucket on read
+	bucket, err := srv.s.LookupBucket(name)
+	if err == sniper.ErrNotFound {
+		writeError(w, http.StatusNotFound, "bucket not found")
+		return
+	}
+	if err != nil {
+		storeError(w, err)
+		return
+	}
+	keys := srv.s.Keys(bucket, limit, offset)
+	if keys == nil {
+		keys = []string{}
+	}
+	writeJSON(w, http.StatusOK, keys)
+}
+
+// backup stream gzipped backup, restore it with Store.RestoreGZ
+func (srv *Server) backup(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/gzip")
+	w.Header().Set("Content-Disposition", `attachment; filename="sniper.backup.gz"`)
+	err := srv.s.BackupGZ(w)
+	if err != nil {
+		// headers are sent, client get truncated gzip stream
+		fmt.Printf("Error backup:%s\n", err)
+	}
+}
@@ -0,0 +1,115 @@
+package httpserver
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/recoilme/sniper"
+	"github.com/stretchr/testify/assert"
+)
+
+func do(t *testing.T, h http.Handler, method, url string, body []byte, header map[string]string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, url, bytes.NewReader(body))
+	for k, v := range header {
+		req.Header.Set(k, v)
+	}
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+	return w
+}
+
+func TestServer(t *testing.T) {
+	err := sniper.DeleteStore("1")
+	assert.NoError(t, err)
+	s, err := sniper.Open(sniper.Dir("1"))
+	assert.NoError(t, err)
+	h := New(s)
+
+	w := do(t, h, "PUT", "/kv/hello", []byte("world"), map[string]string{"X-TTL": "100"})
+	assert.Equal(t, http.StatusNoContent, w.Code)
+	w = do(t, h, "GET", "/kv/hello", nil, nil)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "world", w.Body.String())
+	ttl, _ := strconv.Atoi(w.Header().Get("X-TTL"))
+	assert.True(t, ttl > 98 && ttl <= 100)
+
+	w = do(t, h, "PUT", "/kv/nottl", []byte("v"), nil)
+	assert.Equal(t, http.StatusNoContent, w.Code)
+	w = do(t, h, "GET", "/kv/nottl", nil, nil)
+	assert.Equal(t, "", w.Header().Get("X-TTL"))
+	assert.Equal(t, "", w.Header().Get("X-Expire"))
+
+	// X-Expire is expire of returned record
+	at := strconv.FormatInt(time.Now().Unix()+1000, 10)
+	w = do(t, h, "PUT", "/kv/at", []byte("v1"), map[string]string{"X-Expire": at})
+	assert.Equal(t, http.StatusNoContent, w.Code)
+	w = do(t, h, "GET", "/kv/at", nil, nil)
+	assert.Equal(t, at, w.Header().Get("X-Expire"))
+	ttl, _ = strconv.Atoi(w.Header().Get("X-TTL"))
+	assert.True(t, ttl > 998 && ttl <= 1000)
+	w = do(t, h, "PUT", "/kv/at", []byte("v2"), nil)
+	assert.Equal(t, http.StatusNoContent, w.Code)
+	w = do(t, h, "GET", "/kv/at", nil, nil)
+	assert.Equal(t, "v2", w.Body.String())
+	assert.Equal(t, "", w.Header().Get("X-Expire"))
+	w = do(t, h, "PUT", "/kv/bad", []byte("v"), map[string]string{"X-TTL": "x"})
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+
+	w = do(t, h, "DELETE", "/kv/hello", nil, nil)
+	assert.Equal(t, http.StatusNoContent, w.Code)
+	w = do(t, h, "GET", "/kv/hello", nil, nil)
+	assert.Equal(t, http.StatusNotFound, w.Code)
+	w = do(t, h, "DELETE", "/kv/hello", nil, nil)
+	assert.Equal(t, http.StatusNotFound, w.Code)
+
+	w = do(t, h, "POST", "/incr/cnt?by=5", nil, nil)
+	assert.Equal(t, http.StatusOK, w.Code)
+	w = do(t, h, "POST", "/incr/cnt?by=-2", nil, nil)
+	var res map[string]int64
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &res))
+	assert.Equal(t, int64(3), res["value"])
+	w = do(t, h, "GET", "/incr/cnt", nil, nil)
+	assert.Equal(t, http.StatusMethodNotAllowed, w.Code)
+	// counter is decimal string
+	w = do(t, h, "GET", "/kv/cnt", nil, nil)
+	assert.Equal(t, "3", w.Body.String())
+	w = do(t, h, "POST", "/incr/nottl", nil, nil)
+	assert.Equal(t, http.StatusConflict, w.Code)
+
+	bucket, err := s.Bucket("users")
+	assert.NoError(t, err)
+	for _, k := range []string{"1", "2", "3"} {
+		assert.NoError(t, s.Put(bucket, []byte(k), []byte("v")))
+	}
+	w = do(t, h, "GET", "/buckets/users?limit=2", nil, nil)
+	assert.Equal(t, http.StatusOK, w.Code)
+	var keys []string
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &keys))
+	assert.Equal(t, []string{"3", "2"}, keys)
+	w = do(t, h, "GET", "/buckets/nope", nil, nil)
+	assert.Equal(t, http.StatusNotFound, w.Code)
+	_, err = s.LookupBucket("nope")
+	assert.Equal(t, sniper.ErrNotFound, err)
+
+	w = do(t, h, "GET", "/backup", nil, nil)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.NoError(t, s.Close())
+
+	// restore backup in new store
+	assert.NoError(t, sniper.DeleteStore("2"))
+	s2, err := sniper.Open(sniper.Dir("2"))
+	assert.NoError(t, err)
+	assert.NoError(t, s2.RestoreGZ(w.Body))
+	v, err := s2.Get([]byte("nottl"))
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("v"), v)
+	assert.NoError(t, s2.Close())
+
+	assert.NoError(t, sniper.DeleteStore("1"))
+	assert.NoError(t, sniper.DeleteStore("2"))
+}
@@ -0,0 +1,244 @@
+package sniper
+
+import (
+	"sort"
+	"time"
+)
+
+// record - key/value pair with expire, read from chunk
+type record struct {
+	key    []byte
+	val    []byte
+	expire uint32
+	ver    uint64
+}
+
+// Iterator walk all live records chunk by chunk. Every chunk is read
+// from consistent snapshot: records of chunk are taken at once, under chunk
+// lock, when iterator reach it, and are returned as they were at this moment,
+// even if they are changed or deleted later. Record is read when iterator
+// reach it, so memory use do not depend on chunk size: only records, changed
+// while their chunk is iterated, are saved in memory before change.
+// Chunk is not compacted, while it is iterated. Iteration stops with
+// ErrResharded, if store is resharded
+type Iterator struct {
+	s     *Store
+	gen   int       // generation of chunks, when iteration started
+	chunk int       // next chunk for read
+	c     *chunk    // chunk of snapshot
+	snap  *snapshot // snapshot of current chunk
+	pos   int
+	rec   record
+	err   error
+}
+
+// Iterator return new iterator, positioned before first record.
+// Iterator must be closed, it pin chunk of current record
+// usage:
+//
+//	it := s.Iterator()
+//	defer it.Close()
+//	for it.Next() {
+//		fmt.Println(it.Key(), it.Value())
+//	}
+//	err = it.Err()
+func (s *Store) Iterator() *Iterator {
+	s.RLock()
+	defer s.RUnlock()
+	return &Iterator{s: s, gen: s.chunksGen}
+}
+
+// Next move iterator to next record, return false
+// if no more records or error happens
+func (it *Iterator) Next() bool {
+	if it.err != nil || it.s == nil {
+		return false
+	}
+	it.rec = record{}
+	it.s.RLock()
+	defer it.s.RUnlock()
+	if it.s.chunksGen != it.gen {
+		it.err = ErrResharded
+		it.release()
+		return false
+	}
+	for {
+		it.pos++
+		for it.snap == nil || it.pos >= len(it.snap.metas) {
+			it.release()
+			if it.chunk >= len(it.s.chunks) {
+				return false
+			}
+			it.c = &it.s.chunks[it.chunk]
+			it.snap = it.c.snapshot()
+			it.chunk++
+			it.pos = 0
+		}
+		rec, ok, err := it.c.snapRecord(it.snap, it.pos)
+		if err != nil {
+			it.err = err
+			it.release()
+			return false
+		}
+		if ok {
+			it.rec = rec
+			return true
+		}
+	}
+}
+
+// release unpin snapshot of current chunk
+func (it *Iterator) release() {
+	if it.snap != nil {
+		// chunk, replaced by Reshard, is released in memory only
+		it.c.release(it.snap)
+		it.snap = nil
+	}
+}
+
+// Key return key of current record
+func (it *Iterator) Key() []byte {
+	return it.rec.key
+}
+
+// Value return value of current record
+func (it *Iterator) Value() []byte {
+	return it.rec.val
+}
+
+// Expire return expire time of current record, 0 - never expire
+func (it *Iterator) Expire() uint32 {
+	return it.rec.expire
+}
+
+// Err return error, if any, happened while iteration
+func (it *Iterator) Err() error {
+	return it.err
+}
+
+// Close release iterator resources
+func (it *Iterator) Close() error {
+	if it.s != nil {
+		it.release()
+	}
+	it.s = nil
+	it.rec = record{}
+	return nil
+}
+
+// Range call fn for every live record, iteration stops if fn return false
+// keys and values must not be modified and are valid only inside fn
+func (s *Store) Range(fn func(k, v []byte, expire uint32) bool) error {
+	it := s.Iterator()
+	defer it.Close()
+	for it.Next() {
+		if !fn(it.Key(), it.Value(), it.Expire()) {
+			break
+		}
+	}
+	return it.Err()
+}
+
+// snapMeta - address, size and expire of record in snapshot
+type snapMeta struct {
+	addr   uint64
+	size   byte
+	expire uint32
+}
+
+// savedRecord - record of snapshot, read before it was changed
+type savedRecord struct {
+	rec record
+	ok  bool
+	err error
+}
+
+// snapshot - records of chunk at the moment, when snapshot was taken.
+// Snapshot pin chunk: record of snapshot is saved in it before its place
+// in chunk file or its blob extents are reused, chunk is not compacted
+type snapshot struct {
+	metas []snapMeta // in address order, for sequential read
+	saved map[uint64]savedRecord
+}
+
+// has return true if snapshot has record at addr
+func (sn *snapshot) has(addr uint64) bool {
+	i := sort.Search(len(sn.metas), func(i int) bool { return sn.metas[i].addr >= addr })
+	return i < len(sn.metas) && sn.metas[i].addr == addr
+}
+
+// snapshot take metas of all records in chunk and pin chunk until release
+func (c *chunk) snapshot() *snapshot {
+	c.Lock()
+	defer c.Unlock()
+	sn := &snapshot{metas: make([]snapMeta, 0, len(c.m)), saved: make(map[uint64]savedRecord)}
+	for _, meta := range c.m {
+		addr, size, expire := decodeKeyMeta(meta)
+		sn.metas = append(sn.metas, snapMeta{addr: addr, size: size, expire: expire})
+	}
+	sort.Slice(sn.metas, func(i, j int) bool { return sn.metas[i].addr < sn.metas[j].addr })
+	c.snaps = append(c.snaps, sn)
+	return sn
+}
+
+// release unpin chunk, pinned by snapshot
+func (c *chunk) release(sn *snapshot) {
+	c.Lock()
+	defer c.Unlock()
+	for i := range c.snaps {
+		if c.snaps[i] == sn {
+			c.snaps = append(c.snaps[:i], c.snaps[i+1:]...)
+			break
+		}
+	}
+}
+
+// preserve save record at addr in snapshots, which have it,
+// before record is changed or its blob extents are freed.
+// Chunk must be locked for write
+func (c *chunk) preserve(addr uint64) {
+	var saved *savedRecord
+	for _, sn := range c.snaps {
+		if _, ok := sn.saved[addr]; ok || !sn.has(addr) {
+			continue
+		}
+		if saved == nil {
+			i := sort.Search(len(sn.metas), func(i int) bool { return sn.metas[i].addr >= addr })
+			rec, ok, err := c.readRecord(addr, sn.metas[i].size)
+			saved = &savedRecord{rec: rec, ok: ok, err: err}
+		}
+		sn.saved[addr] = *saved
+	}
+}
+
+// snapRecord read record i of snapshot, ok is false if record is expired
+func (c *chunk) snapRecord(sn *snapshot, i int) (rec record, ok bool, err error) {
+	meta := sn.metas[i]
+	if meta.expire != 0 && int64(meta.expire) < time.Now().Unix() {
+		return
+	}
+	c.RLock()
+	defer c.RUnlock()
+	if saved, ok := sn.saved[meta.addr]; ok {
+		return saved.rec, saved.ok, saved.err
+	}
+	return c.readRecord(meta.addr, meta.size)
+}
+
+// readRecord read record at addr, ok is false if record is expired
+func (c *chunk) readRecord(addr uint64, size byte) (rec record, ok bool, err error) {
+	packet, err := c.read_packet(addr, size)
+	if err != nil {
+		return record{}, false, err
+	}
+	header, key, val := packetUnmarshal(packet)
+	// skip expired entry
+	if header.expire != 0 && int64(header.expire) < time.Now().Unix() {
+		return record{}, false, nil
+	}
+	val, err = c.value(header, val)
+	if err != nil {
+		return record{}, false, err
+	}
+	return record{key: key, val: val, expire: header.expire, ver: header.ver}, true, nil
+}
@@ -0,0 +1,53 @@
+package sniper
+
+import (
+	"io"
+	"path/filepath"
+)
+
+// openLock lock LOCK file in store directory, exclusive for writer
+// and shared for read only store, return ErrLocked if store is opened
+// by other process or other Open call
+func (s *Store) openLock() (err error) {
+	s.lockf, err = s.fs.Lock(s.filename("LOCK"), !s.readOnly)
+	return
+}
+
+// closeLock release lock of store directory
+func (s *Store) closeLock() (err error) {
+	if s.lockf == nil {
+		return
+	}
+	err = s.lockf.Close()
+	s.lockf = nil
+	return
+}
+
+// lockDir lock exclusive all stores, which chunk files are in files,
+// for tools, which modify files
+func lockDir(fs VFS, dir string, files []string) (locks []io.Closer, err error) {
+	names := make(map[string]bool)
+	for _, file := range files {
+		name := "LOCK"
+		if m := chunkName.FindStringSubmatch(filepath.Base(file)); m != nil && m[1] != "" {
+			name = m[1] + "-LOCK"
+		}
+		names[name] = true
+	}
+	for name := range names {
+		l, err := fs.Lock(filepath.Join(dir, name), true)
+		if err != nil {
+			unlockDir(locks)
+			return nil, err
+		}
+		locks = append(locks, l)
+	}
+	return
+}
+
+// unlockDir release locks, taken by lockDir
+func unlockDir(locks []io.Closer) {
+	for _, l := range locks {
+		l.Close()
+	}
+}
@@ -0,0 +1,176 @@
+package sniper
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// manifestVersion - version of manifest format,
+// version 2 has chunks generation and unfinished reshard
+const manifestVersion = 2
+
+// hashName - name of key hash function
+const hashName = "murmur3-32"
+
+// manifest - store configuration, written on store create.
+// Keys are placed in chunks by hash, chunks total and collision chunks,
+// so store must be opened with the same configuration.
+// Manifest is rewritten by Reshard on start, with chunks it writes,
+// and on finish, with new chunks and their generation
+type manifest struct {
+	Version          int           `json:"version"`
+	ChunksTotal      int           `json:"chunks_total"`
+	ChunksCollision  int           `json:"chunks_collision"`
+	ChunksPrefix     string        `json:"chunks_prefix"`
+	ChunksGeneration int           `json:"chunks_generation,omitempty"`
+	Reshard          *reshardState `json:"reshard,omitempty"`
+	Hash             string        `json:"hash"`
+}
+
+// reshardState - chunks of unfinished Reshard, they are kept
+// on Open and Reshard with same chunks resume copy in them
+type reshardState struct {
+	ChunksTotal      int `json:"chunks_total"`
+	ChunksCollision  int `json:"chunks_collision"`
+	ChunksGeneration int `json:"chunks_generation"`
+}
+
+// loadManifest check options against manifest, options which are not set
+// are taken from manifest. Manifest is created for new store
+// and for store, created before manifests
+func (s *Store) loadManifest() (err error) {
+	name := s.filename("MANIFEST")
+	b, err := readFile(s.fs, name)
+	if os.IsNotExist(err) {
+		if s.chunksCnt < 0 {
+			s.chunksCnt = 256
+		}
+		if s.chunkColCnt < 0 {
+			s.chunkColCnt = 4
+		}
+		err = s.checkChunks()
+		if err != nil {
+			return
+		}
+		if s.readOnly {
+			return nil
+		}
+		return s.writeManifest()
+	}
+	if err != nil {
+		return
+	}
+	var m manifest
+	err = json.Unmarshal(b, &m)
+	if err != nil {
+		return fmt.Errorf("%s: %s: %w", name, err.Error(), ErrFormat)
+	}
+	if m.Version < 1 || m.Version > manifestVersion {
+		return fmt.Errorf("%s: unknown version %d: %w", name, m.Version, ErrFormat)
+	}
+	if m.Hash != hashName {
+		return fmt.Errorf("%s: hash %s, supported %s: %w", name, m.Hash, hashName, ErrManifest)
+	}
+	if m.ChunksPrefix != s.chunksPrefix {
+		return fmt.Errorf("%s: chunks prefix %q, option %q: %w", name, m.ChunksPrefix, s.chunksPrefix, ErrManifest)
+	}
+	if s.chunksCnt >= 0 && s.chunksCnt != m.ChunksTotal {
+		return fmt.Errorf("%s: chunks total %d, option %d: %w", name, m.ChunksTotal, s.chunksCnt, ErrManifest)
+	}
+	if s.chunkColCnt >= 0 && s.chunkColCnt != m.ChunksCollision {
+		return fmt.Errorf("%s: chunks collision %d, option %d: %w", name, m.ChunksCollision, s.chunkColCnt, ErrManifest)
+	}
+	s.chunksCnt = m.ChunksTotal
+	s.chunkColCnt = m.ChunksCollision
+	if m.Reshard != nil && m.Reshard.ChunksGeneration != m.ChunksGeneration+1 {
+		return fmt.Errorf("%s: reshard generation %d, chunks generation %d: %w", name, m.Reshard.ChunksGeneration, m.ChunksGeneration, ErrFormat)
+	}
+	s.chunksGen = m.ChunksGeneration
+	s.resharding = m.Reshard
+	return
+}
+
+// checkChunks check, that chunk files of store without manifest match
+// chunks total: keys of store, opened with other chunks total, are routed
+// to wrong chunks. New store has no chunk files
+func (s *Store) checkChunks() (err error) {
+	if s.chunksCnt-s.chunkColCnt < 1 {
+		// wrong options, Open return error
+		return nil
+	}
+	_, err = s.fs.Stat(s.chunkFile(0, 0))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return
+	}
+	_, err = s.fs.Stat(s.chunkFile(0, s.chunksCnt-1))
+	if os.IsNotExist(err) {
+		return fmt.Errorf("%s: store has less then %d chunks: %w", s.dir, s.chunksCnt, ErrManifest)
+	}
+	if err != nil {
+		return
+	}
+	_, err = s.fs.Stat(s.chunkFile(0, s.chunksCnt))
+	if err == nil {
+		return fmt.Errorf("%s: store has more then %d chunks: %w", s.dir, s.chunksCnt, ErrManifest)
+	}
+	if !os.IsNotExist(err) {
+		return
+	}
+	return nil
+}
+
+// writeManifest write manifest with current configuration
+// manifest is written in temp file and renamed, so it is never torn
+func (s *Store) writeManifest() (err error) {
+	if s.chunksCnt-s.chunkColCnt < 1 {
+		// wrong options, Open return error
+		return nil
+	}
+	version := manifestVersion
+	if s.chunksGen == 0 && s.resharding == nil {
+		// store, which was not resharded, is opened by older versions
+		version = 1
+	}
+	b, err := json.MarshalIndent(manifest{
+		Version:          version,
+		ChunksTotal:      s.chunksCnt,
+		ChunksCollision:  s.chunkColCnt,
+		ChunksPrefix:     s.chunksPrefix,
+		ChunksGeneration: s.chunksGen,
+		Reshard:          s.resharding,
+		Hash:             hashName,
+	}, "", "  ")
+	if err != nil {
+		return
+	}
+	name := s.filename("MANIFEST")
+	tmp := name + ".tmp"
+	err = writeFile(s.fs, tmp, append(b, '\n'))
+	if err != nil {
+		s.fs.Remove(tmp)
+		return
+	}
+	err = s.fs.Rename(tmp, name)
+	if err != nil {
+		return
+	}
+	return s.fs.SyncDir(filepath.Dir(name))
+}
+
+// syncDir commit directory entries to stable storage
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	err = d.Sync()
+	if errClose := d.Close(); err == nil {
+		err = errClose
+	}
+	return err
+}
@@ -0,0 +1,437 @@
+package sniper
+
+import (
+	"io"
+	iofs "io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// MemFS - in memory file system, store files are lost, when MemFS is dropped.
+// Files, removed or renamed while open, stay readable by open handles
+type MemFS struct {
+	mu    sync.Mutex
+	files map[string]*memData
+	dirs  map[string]bool
+	locks map[string]int // name / shared locks count, -1 - exclusive
+}
+
+// memData - file content
+type memData struct {
+	sync.RWMutex
+	b       []byte
+	modTime time.Time
+}
+
+// NewMemFS return empty in memory file system
+func NewMemFS() *MemFS {
+	return &MemFS{
+		files: make(map[string]*memData),
+		dirs:  map[string]bool{".": true, "/": true},
+		locks: make(map[string]int),
+	}
+}
+
+// OpenFile open file, O_CREATE, O_EXCL, O_TRUNC, O_APPEND and
+// O_RDONLY/O_WRONLY/O_RDWR flags are supported
+func (fs *MemFS) OpenFile(name string, flag int, perm os.FileMode) (File, error) {
+	name = filepath.Clean(name)
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	d, ok := fs.files[name]
+	if ok && flag&os.O_CREATE != 0 && flag&os.O_EXCL != 0 {
+		return nil, &os.PathError{Op: "open", Path: name, Err: os.ErrExist}
+	}
+	if !ok {
+		if flag&os.O_CREATE == 0 {
+			return nil, &os.PathError{Op: "open", Path: name, Err: os.ErrNotExist}
+		}
+		if !fs.dirs[filepath.Dir(name)] {
+			return nil, &os.PathError{Op: "open", Path: name, Err: os.ErrNotExist}
+		}
+		d = &memData{modTime: time.Now()}
+		fs.files[name] = d
+	}
+	f := &memFile{name: name, d: d, flag: flag}
+	if flag&os.O_TRUNC != 0 && f.writable() {
+		d.Lock()
+		d.b = d.b[:0]
+		d.modTime = time.Now()
+		d.Unlock()
+	}
+	return f, nil
+}
+
+// Stat return info of file or directory
+func (fs *MemFS) Stat(name string) (os.FileInfo, error) {
+	name = filepath.Clean(name)
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	if d, ok := fs.files[name]; ok {
+		d.RLock()
+		defer d.RUnlock()
+		return &memFileInfo{name: filepath.Base(name), size: int64(len(d.b)), modTime: d.modTime}, nil
+	}
+	if fs.dirs[name] {
+		return &memFileInfo{name: filepath.Base(name), dir: true}, nil
+	}
+	return nil, &os.PathError{Op: "stat", Path: name, Err: os.ErrNotExist}
+}
+
+// Remove remove file or empty directory
+func (fs *MemFS) Remove(name string) error {
+	name = filepath.Clean(name)
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	if _, ok := fs.files[name]; ok {
+		delete(fs.files, name)
+		return nil
+	}
+	if fs.dirs[name] {
+		for _, child := range fs.names() {
+			if filepath.Dir(child) == name {
+				return &os.PathError{Op: "remove", Path: name, Err: os.ErrExist}
+			}
+		}
+		delete(fs.dirs, name)
+		return nil
+	}
+	return &os.PathError{Op: "remove", Path: name, Err: os.ErrNotExist}
+}
+
+// Rename rename file, existing newname is replaced
+func (fs *MemFS) Rename(oldname, newname string) error {
+	oldname, newname = filepath.Clean(oldname), filepath.Clean(newname)
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	d, ok := fs.files[oldname]
+	if !ok {
+		return &os.LinkError{Op: "rename", Old: oldname, New: newname, Err: os.ErrNotExist}
+	}
+	if !fs.dirs[filepath.Dir(newname)] {
+		return &os.LinkError{Op: "rename", Old: oldname, New: newname, Err: os.ErrNotExist}
+	}
+	delete(fs.files, oldname)
+	fs.files[newname] = d
+	return nil
+}
+
+// MkdirAll create directory with parents
+func (fs *MemFS) MkdirAll(path string, perm os.FileMode) error {
+	path = filepath.Clean(path)
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	for p := path; !fs.dirs[p]; p = filepath.Dir(p) {
+		if _, ok := fs.files[p]; ok {
+			return &os.PathError{Op: "mkdir", Path: p, Err: os.ErrExist}
+		}
+		fs.dirs[p] = true
+	}
+	return nil
+}
+
+// ReadDir return sorted files and directories in dir
+func (fs *MemFS) ReadDir(dir string) ([]os.DirEntry, error) {
+	dir = filepath.Clean(dir)
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	if !fs.dirs[dir] {
+		return nil, &os.PathError{Op: "readdir", Path: dir, Err: os.ErrNotExist}
+	}
+	var entries []os.DirEntry
+	for _, name := range fs.names() {
+		if name == dir || filepath.Dir(name) != dir {
+			continue
+		}
+		fi := &memFileInfo{name: filepath.Base(name), dir: fs.dirs[name]}
+		if d, ok := fs.files[name]; ok {
+			d.RLock()
+			fi.size, fi.modTime = int64(len(d.b)), d.modTime
+			d.RUnlock()
+		}
+		entries = append(entries, iofs.FileInfoToDirEntry(fi))
+	}
+	return entries, nil
+}
+
+// SyncDir do nothing, directory is always in sync
+func (fs *MemFS) SyncDir(dir string) error {
+	return nil
+}
+
+// Lock take lock in memory, file is not needed
+func (fs *MemFS) Lock(name string, exclusive bool) (io.Closer, error) {
+	name = filepath.Clean(name)
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	held := fs.locks[name]
+	if held < 0 || (exclusive && held > 0) {
+		return nil, ErrLocked
+	}
+	if exclusive {
+		fs.locks[name] = -1
+	} else {
+		fs.locks[name] = held + 1
+	}
+	return &memLock{fs: fs, name: name, exclusive: exclusive}, nil
+}
+
+// Names return sorted names of all files
+func (fs *MemFS) Names() []string {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	return fs.names()
+}
+
+func (fs *MemFS) names() (names []string) {
+	for name := range fs.files {
+		names = append(names, name)
+	}
+	for name := range fs.dirs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return
+}
+
+// RemoveAll remove path and all files in it
+func (fs *MemFS) RemoveAll(path string) error {
+	path = filepath.Clean(path)
+	prefix := path + string(filepath.Separator)
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	for name := range fs.files {
+		if name == path || strings.HasPrefix(name, prefix) {
+			delete(fs.files, name)
+		}
+	}
+	for name := range fs.dirs {
+		if name == path || strings.HasPrefix(name, prefix) {
+			delete(fs.dirs, name)
+		}
+	}
+	return nil
+}
+
+type memLock struct {
+	fs        *MemFS
+	name      string
+	exclusive bool
+	closed    bool
+}
+
+func (l *memLock) Close() error {
+	l.fs.mu.Lock()
+	defer l.fs.mu.Unlock()
+	if l.closed {
+		return os.ErrClosed
+	}
+	l.closed = true
+	if l.exclusive || l.fs.locks[l.name] <= 1 {
+		delete(l.fs.locks, l.name)
+	} else {
+		l.fs.locks[l.name]--
+	}
+	return nil
+}
+
+// memFile - open file of MemFS
+type memFile struct {
+	mu     sync.Mutex // guard offset
+	name   string
+	d      *memData
+	flag   int
+	off    int64
+	closed bool
+}
+
+func (f *memFile) writable() bool {
+	return f.flag&(os.O_WRONLY|os.O_RDWR) != 0
+}
+
+func (f *memFile) check(op string, write bool) error {
+	if f.closed {
+		return &os.PathError{Op: op, Path: f.name, Err: os.ErrClosed}
+	}
+	if write && !f.writable() {
+		return &os.PathError{Op: op, Path: f.name, Err: os.ErrPermission}
+	}
+	if !write && f.flag&os.O_WRONLY != 0 {
+		return &os.PathError{Op: op, Path: f.name, Err: os.ErrPermission}
+	}
+	return nil
+}
+
+func (f *memFile) Read(b []byte) (n int, err error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	n, err = f.ReadAt(b, f.off)
+	f.off += int64(n)
+	if err == io.EOF && n > 0 {
+		err = nil
+	}
+	return
+}
+
+func (f *memFile) ReadAt(b []byte, off int64) (n int, err error) {
+	if err = f.check("read", false); err != nil {
+		return
+	}
+	if off < 0 {
+		return 0, &os.PathError{Op: "readat", Path: f.name, Err: os.ErrInvalid}
+	}
+	f.d.RLock()
+	defer f.d.RUnlock()
+	if off >= int64(len(f.d.b)) {
+		return 0, io.EOF
+	}
+	n = copy(b, f.d.b[off:])
+	if n < len(b) {
+		err = io.EOF
+	}
+	return
+}
+
+func (f *memFile) Write(b []byte) (n int, err error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	off := f.off
+	if f.flag&os.O_APPEND != 0 {
+		f.d.RLock()
+		off = int64(len(f.d.b))
+		f.d.RUnlock()
+	}
+	n, err = f.writeAt(b, off)
+	f.off = off + int64(n)
+	return
+}
+
+func (f *memFile) WriteAt(b []byte, off int64) (n int, err error) {
+	if f.flag&os.O_APPEND != 0 {
+		return 0, &os.PathError{Op: "writeat", Path: f.name, Err: os.ErrInvalid}
+	}
+	return f.writeAt(b, off)
+}
+
+func (f *memFile) writeAt(b []byte, off int64) (n int, err error) {
+	if err = f.check("write", true); err != nil {
+		return
+	}
+	if off < 0 {
+		return 0, &os.PathError{Op: "writeat", Path: f.name, Err: os.ErrInvalid}
+	}
+	f.d.Lock()
+	defer f.d.Unlock()
+	if end := off + int64(len(b)); end > int64(len(f.d.b)) {
+		f.d.grow(end)
+	}
+	n = copy(f.d.b[off:], b)
+	f.d.modTime = time.Now()
+	return
+}
+
+// grow extend file with zeros
+func (d *memData) grow(size int64) {
+	if size <= int64(cap(d.b)) {
+		tail := d.b[len(d.b):size]
+		for i := range tail {
+			tail[i] = 0
+		}
+		d.b = d.b[:size]
+		return
+	}
+	b := make([]byte, size, size+size/4)
+	copy(b, d.b)
+	d.b = b
+}
+
+func (f *memFile) Seek(offset int64, whence int) (int64, error) {
+	if f.closed {
+		return 0, &os.PathError{Op: "seek", Path: f.name, Err: os.ErrClosed}
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += f.off
+	case io.SeekEnd:
+		f.d.RLock()
+		offset += int64(len(f.d.b))
+		f.d.RUnlock()
+	default:
+		return 0, &os.PathError{Op: "seek", Path: f.name, Err: os.ErrInvalid}
+	}
+	if offset < 0 {
+		return 0, &os.PathError{Op: "seek", Path: f.name, Err: os.ErrInvalid}
+	}
+	f.off = offset
+	return offset, nil
+}
+
+func (f *memFile) Stat() (os.FileInfo, error) {
+	if f.closed {
+		return nil, &os.PathError{Op: "stat", Path: f.name, Err: os.ErrClosed}
+	}
+	f.d.RLock()
+	defer f.d.RUnlock()
+	return &memFileInfo{name: filepath.Base(f.name), size: int64(len(f.d.b)), modTime: f.d.modTime}, nil
+}
+
+func (f *memFile) Sync() error {
+	if f.closed {
+		return &os.PathError{Op: "sync", Path: f.name, Err: os.ErrClosed}
+	}
+	return nil
+}
+
+func (f *memFile) Truncate(size int64) error {
+	if err := f.check("truncate", true); err != nil {
+		return err
+	}
+	if size < 0 {
+		return &os.PathError{Op: "truncate", Path: f.name, Err: os.ErrInvalid}
+	}
+	f.d.Lock()
+	defer f.d.Unlock()
+	if size > int64(len(f.d.b)) {
+		f.d.grow(size)
+	} else {
+		f.d.b = f.d.b[:size]
+	}
+	f.d.modTime = time.Now()
+	return nil
+}
+
+func (f *memFile) Close() error {
+	if f.closed {
+		return &os.PathError{Op: "close", Path: f.name, Err: os.ErrClosed}
+	}
+	f.closed = true
+	return nil
+}
+
+// memFileInfo - os.FileInfo of MemFS file
+type memFileInfo struct {
+	name    string
+	size    int64
+	modTime time.Time
+	dir     bool
+}
+
+func (fi *memFileInfo) Name() string       { return fi.name }
+func (fi *memFileInfo) Size() int64        { return fi.size }
+func (fi *memFileInfo) ModTime() time.Time { return fi.modTime }
+func (fi *memFileInfo) IsDir() bool        { return fi.dir }
+func (fi *memFileInfo) Sys() interface{}   { return nil }
+
+func (fi *memFileInfo) Mode() os.FileMode {
+	if fi.dir {
+		return os.ModeDir | dirMode
+	}
+	return fileMode
+}
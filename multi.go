@@ -0,0 +1,182 @@
+package sniper
+
+import (
+	"sort"
+	"sync"
+)
+
+// multi key operations: keys are grouped by chunk, every chunk is locked
+// once and chunks are processed in parallel. Keys, which collide in their
+// chunk, are processed after it one by one, same way as in Get, Set and Delete
+
+// KV - key with value and expire, used by SetMulti
+type KV struct {
+	Key    []byte
+	Value  []byte
+	Expire uint32 // unix time in seconds, 0 - no expire
+}
+
+// multiGroup - positions of keys in request, which belong to chunk
+type multiGroup struct {
+	chunk int
+	pos   []int
+}
+
+// groupKeys group n keys of request by chunk, groups are sorted by chunk
+func (s *Store) groupKeys(n int, key func(i int) []byte) (groups []multiGroup, hashes []uint32) {
+	hashes = make([]uint32, n)
+	byChunk := make(map[int][]int)
+	for i := 0; i < n; i++ {
+		hashes[i] = hash(key(i))
+		idx := int(s.idx(hashes[i]))
+		byChunk[idx] = append(byChunk[idx], i)
+	}
+	groups = make([]multiGroup, 0, len(byChunk))
+	for idx, pos := range byChunk {
+		groups = append(groups, multiGroup{chunk: idx, pos: pos})
+	}
+	sort.Slice(groups, func(i, j int) bool { return groups[i].chunk < groups[j].chunk })
+	return
+}
+
+// eachGroup run fn for every group in parallel and wait all of them
+func eachGroup(groups []multiGroup, fn func(g multiGroup)) {
+	if len(groups) == 1 {
+		fn(groups[0])
+		return
+	}
+	var wg sync.WaitGroup
+	for _, g := range groups {
+		wg.Add(1)
+		go func(g multiGroup) {
+			defer wg.Done()
+			fn(g)
+		}(g)
+	}
+	wg.Wait()
+}
+
+// GetMulti - return values of keys, values[i] and errs[i] belong to keys[i],
+// errs[i] is ErrNotFound for missing key
+func (s *Store) GetMulti(keys [][]byte) (values [][]byte, errs []error) {
+	values = make([][]byte, len(keys))
+	errs = make([]error, len(keys))
+	s.RLock()
+	groups, hashes := s.groupKeys(len(keys), func(i int) []byte { return keys[i] })
+	eachGroup(groups, func(g multiGroup) {
+		c := &s.chunks[g.chunk]
+		var expired []int
+		c.RLock()
+		for _, i := range g.pos {
+			var isExpired bool
+			values[i], _, isExpired, errs[i] = c.lookup(keys[i], hashes[i])
+			if isExpired {
+				expired = append(expired, i)
+			}
+		}
+		c.RUnlock()
+		if len(expired) == 0 {
+			return
+		}
+		c.Lock()
+		for _, i := range expired {
+			c.dropExpired(keys[i], hashes[i])
+		}
+		c.Unlock()
+	})
+	s.RUnlock()
+	for i := range keys {
+		if errs[i] == ErrCollision {
+			values[i], errs[i] = s.Get(keys[i])
+		}
+	}
+	return
+}
+
+// SetMulti - store pairs, errs[i] belong to pairs[i]. Pairs are not written
+// atomically, use Write with Batch for it
+func (s *Store) SetMulti(pairs []KV) (errs []error) {
+	errs = make([]error, len(pairs))
+	if err := s.writable(); err != nil {
+		for i := range errs {
+			errs[i] = err
+		}
+		return
+	}
+	s.RLock()
+	groups, hashes := s.groupKeys(len(pairs), func(i int) []byte { return pairs[i].Key })
+	eachGroup(groups, func(g multiGroup) {
+		c := &s.chunks[g.chunk]
+		c.wlock()
+		defer c.wunlock()
+		ops := make([]batchOp, 0, len(g.pos))
+		for _, i := range g.pos {
+			ops = append(ops, batchOp{op: opSet, key: pairs[i].Key, val: pairs[i].Value, expire: pairs[i].Expire})
+		}
+		// group is one record in write ahead log
+		if err := c.logOps(ops); err != nil {
+			for _, i := range g.pos {
+				errs[i] = err
+			}
+			return
+		}
+		// logged write, which is not applied, fail store
+		for _, i := range g.pos {
+			errs[i] = c.applied(c.write_key(pairs[i].Key, pairs[i].Value, hashes[i], pairs[i].Expire, 0))
+		}
+	})
+	s.RUnlock()
+	for i, kv := range pairs {
+		if errs[i] == ErrCollision {
+			errs[i] = s.Set(kv.Key, kv.Value, kv.Expire)
+		}
+	}
+	return
+}
+
+// DeleteMulti - delete keys, deleted[i] and errs[i] belong to keys[i]
+func (s *Store) DeleteMulti(keys [][]byte) (deleted []bool, errs []error) {
+	deleted = make([]bool, len(keys))
+	errs = make([]error, len(keys))
+	if err := s.writable(); err != nil {
+		for i := range errs {
+			errs[i] = err
+		}
+		return
+	}
+	s.RLock()
+	groups, hashes := s.groupKeys(len(keys), func(i int) []byte { return keys[i] })
+	eachGroup(groups, func(g multiGroup) {
+		c := &s.chunks[g.chunk]
+		c.wlock()
+		defer c.wunlock()
+		// only keys, present in chunk, are logged
+		ops := make([]batchOp, 0, len(g.pos))
+		for _, i := range g.pos {
+			if _, ok := c.m[hashes[i]]; ok {
+				ops = append(ops, batchOp{op: opDelete, key: keys[i]})
+			}
+		}
+		if len(ops) == 0 {
+			return
+		}
+		if err := c.logOps(ops); err != nil {
+			for _, i := range g.pos {
+				errs[i] = err
+			}
+			return
+		}
+		for _, i := range g.pos {
+			var err error
+			deleted[i], err = c.delete_key(keys[i], hashes[i])
+			errs[i] = c.applied(err)
+		}
+	})
+	s.RUnlock()
+	for i := range keys {
+		if errs[i] == ErrCollision {
+			deleted[i], errs[i] = s.Delete(keys[i])
+		}
+	}
+	return
+}
@@ -0,0 +1,39 @@
+package sniper
+
+import (
+	"fmt"
+	"os"
+)
+
+// ReadOnly - open store for read only: files are opened read only,
+// Set, Delete, Incr, Touch, Put, Write and other writes return ErrReadOnly,
+// expired keys are not removed from index, old chunks are not upgraded.
+// Store is locked with shared lock, many read only stores
+// may be opened at once, but not together with store opened for write
+func ReadOnly() OptStore {
+	return func(s *Store) error {
+		s.readOnly = true
+		return nil
+	}
+}
+
+// checkLogs return error if write ahead log or batch log has operations,
+// which may be not applied to chunks, store must be opened for write to recover them
+func (s *Store) checkLogs() error {
+	for _, name := range []string{"wal.log", "batch.log"} {
+		f, err := s.fs.OpenFile(s.filename(name), os.O_RDONLY, 0)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		// damaged record is torn write, it was never applied
+		_, err = readRecord(f)
+		f.Close()
+		if err == nil {
+			return fmt.Errorf("%s has operations to recover: %w", name, ErrReadOnly)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,458 @@
+package sniper
+
+import (
+	"errors"
+	"os"
+	"sync/atomic"
+)
+
+// reshardRounds - how many times changed keys are copied, before store
+// is locked for switch. Keys, changed after last round, are copied under lock
+const reshardRounds = 10
+
+// reshardLockKeys - changed keys, which may be copied under lock of store
+const reshardLockKeys = 1000
+
+// reshardSyncBytes - copied bytes, after which new chunks are synced,
+// so records, copied before crash, are not copied again by resumed Reshard
+const reshardSyncBytes = 16 << 20
+
+// Reshard open store in dir, move its records in newTotal chunks with
+// newCollision collision chunks and close it. Other options of store,
+// as ChunksPrefix or FS, are passed in opts. Reshard, interrupted by
+// crash or error, is resumed by next call with same chunks
+func Reshard(dir string, newTotal, newCollision int, opts ...OptStore) (err error) {
+	s, err := Open(append([]OptStore{Dir(dir)}, opts...)...)
+	if err != nil {
+		return
+	}
+	err = s.Reshard(newTotal, newCollision)
+	if errClose := s.Close(); err == nil {
+		err = errClose
+	}
+	return
+}
+
+// Reshard move all records of open store in newTotal chunks with newCollision
+// collision chunks, store serve reads and writes meanwhile. New chunks are
+// written next to old ones, with generation in file name, and are recorded in
+// manifest before copy: Reshard, interrupted by crash, error or Close, is
+// resumed by next call with same chunks, records, copied before, are not
+// written again. Every old chunk is copied from snapshot, keys, changed after
+// their chunk was copied, are copied again. Then store is locked for short time:
+// last changed keys are copied, new chunks are synced, write ahead log is
+// checkpointed and manifest is switched to new chunks by one rename. Old chunk
+// files are removed after switch. Copied records keep their versions, so
+// versions, read by SetIfVersion users and memcached cas, stay valid.
+// Reshard with other chunks discard unfinished one.
+// Iterators, open at switch, stop with ErrResharded
+func (s *Store) Reshard(newTotal, newCollision int) (err error) {
+	if newCollision < 0 || newTotal-newCollision < 1 {
+		return errors.New("chunksCnt must be more then chunkColCnt minimum on 1")
+	}
+	s.reshardMu.Lock()
+	defer s.reshardMu.Unlock()
+	if atomic.LoadInt32(&s.closing) != 0 {
+		return ErrClosed
+	}
+	err = s.writable()
+	if err != nil {
+		return
+	}
+	// chunks are replaced under reshardMu only, so they are read without lock
+	state := &reshardState{ChunksTotal: newTotal, ChunksCollision: newCollision, ChunksGeneration: s.chunksGen + 1}
+	resume := s.resharding != nil && *s.resharding == *state
+	var dst *Store
+	if resume {
+		dst, err = s.newChunks(state)
+		// chunks, which can't be opened, are copied from begin
+		resume = err == nil
+	}
+	if !resume {
+		err = s.startReshard(state)
+		if err != nil {
+			return
+		}
+		dst, err = s.newChunks(state)
+		if err != nil {
+			return
+		}
+	}
+	switched := false
+	defer func() {
+		if !switched {
+			// written chunks are kept for next call
+			s.stopTracking()
+			dst.dropChunks()
+		}
+	}()
+
+	var unsynced int64
+	for i := range s.chunks {
+		n, err := s.copyChunk(&s.chunks[i], dst, resume)
+		if err != nil {
+			return err
+		}
+		unsynced += n
+		if unsynced >= reshardSyncBytes {
+			err = dst.syncCopied()
+			if err != nil {
+				return err
+			}
+			unsynced = 0
+		}
+	}
+	if resume {
+		// keys, deleted while Reshard was interrupted, were not tracked
+		err = s.dropDeleted(dst)
+		if err != nil {
+			return
+		}
+	}
+	for round := 0; round < reshardRounds; round++ {
+		n, err := s.copyChanges(dst)
+		if err != nil {
+			return err
+		}
+		if n <= reshardLockKeys {
+			break
+		}
+	}
+
+	s.Lock()
+	_, err = s.copyChanges(dst)
+	if err == nil {
+		err = dst.syncChunks()
+	}
+	if err == nil && s.wal != nil {
+		// log has numbers of old chunks, it must be empty before switch
+		s.wal.ckpt.Lock()
+		err = s.flushChunks()
+		s.wal.ckpt.Unlock()
+	}
+	if err != nil {
+		s.Unlock()
+		return
+	}
+	old, oldTotal, oldCollision, oldGen := s.chunks, s.chunksCnt, s.chunkColCnt, s.chunksGen
+	s.chunksCnt, s.chunkColCnt, s.chunksGen, s.resharding = newTotal, newCollision, state.ChunksGeneration, nil
+	err = s.writeManifest()
+	if err != nil {
+		s.chunksCnt, s.chunkColCnt, s.chunksGen, s.resharding = oldTotal, oldCollision, oldGen, state
+		s.Unlock()
+		// manifest may be on disk, store is reopened with chunks from it
+		return s.fail(err)
+	}
+	for i := range dst.chunks {
+		dst.chunks[i].wal = s.wal
+		dst.chunks[i].resharded = false
+	}
+	s.chunks = dst.chunks
+	s.compactchunk = 0
+	switched = true
+	s.Unlock()
+
+	for i := range old {
+		old[i].drop()
+	}
+	// old chunks, which are not removed, are removed on next Open
+	return s.removeChunks(oldGen)
+}
+
+// startReshard remove chunk files of discarded Reshard and record
+// chunks of new one in manifest, before they are created
+func (s *Store) startReshard(state *reshardState) (err error) {
+	err = s.removeChunks(state.ChunksGeneration)
+	if err != nil {
+		return
+	}
+	prev := s.resharding
+	s.resharding = state
+	err = s.writeManifest()
+	if err != nil {
+		s.resharding = prev
+	}
+	return
+}
+
+// newChunks open chunks of Reshard, they are held
+// in separate store, which is not visible to users
+func (s *Store) newChunks(state *reshardState) (dst *Store, err error) {
+	dst = &Store{
+		dir:          s.dir,
+		chunksPrefix: s.chunksPrefix,
+		chunksCnt:    state.ChunksTotal,
+		chunkColCnt:  state.ChunksCollision,
+		chunksGen:    state.ChunksGeneration,
+		fs:           s.fs,
+	}
+	dst.chunks = make([]chunk, dst.chunksCnt)
+	// chunks are created in order, so removeChunks find all of them
+	for i := range dst.chunks {
+		c := &dst.chunks[i]
+		c.id = i
+		c.fs = s.fs
+		c.resharded = true
+		err = c.init(dst.chunkFile(dst.chunksGen, i))
+		if err != nil {
+			dst.dropChunks()
+			return nil, err
+		}
+	}
+	return
+}
+
+// copyChunk copy live records of chunk from snapshot, keys, changed
+// after snapshot, are tracked in chunk and are copied by copyChanges.
+// Resumed copy skip records, which are copied with same version.
+// Return size of copied keys and values
+func (s *Store) copyChunk(c *chunk, dst *Store, resume bool) (n int64, err error) {
+	c.Lock()
+	c.changes = make(map[string]bool)
+	c.Unlock()
+	sn := c.snapshot()
+	defer c.release(sn)
+	for i := range sn.metas {
+		if atomic.LoadInt32(&s.closing) != 0 {
+			return n, ErrClosed
+		}
+		rec, ok, err := c.snapRecord(sn, i)
+		if err != nil {
+			return n, err
+		}
+		if !ok || resume && dst.copied(rec) {
+			continue
+		}
+		err = dst.put(rec)
+		if err != nil {
+			return n, err
+		}
+		n += int64(len(rec.key) + len(rec.val))
+	}
+	return
+}
+
+// copyChanges copy current records of keys, changed after their chunk
+// was copied, deleted keys are deleted. Return count of copied keys
+func (s *Store) copyChanges(dst *Store) (n int, err error) {
+	for i := range s.chunks {
+		c := &s.chunks[i]
+		c.Lock()
+		keys := c.changes
+		c.changes = make(map[string]bool)
+		c.Unlock()
+		for k := range keys {
+			if atomic.LoadInt32(&s.closing) != 0 {
+				return n, ErrClosed
+			}
+			err = s.copyKey(dst, []byte(k))
+			if err != nil {
+				return
+			}
+			n++
+		}
+	}
+	return
+}
+
+// copyKey copy current record of key, key, which is not found, is deleted
+func (s *Store) copyKey(dst *Store, k []byte) (err error) {
+	v, header, err := s.get(k)
+	switch err {
+	case nil:
+		return dst.put(record{key: k, val: v, expire: header.expire, ver: header.ver})
+	case ErrNotFound, ErrCollision:
+		_, err = dst.Delete(k)
+		if err == ErrNotFound || err == ErrCollision {
+			err = nil
+		}
+	}
+	return
+}
+
+// dropDeleted delete keys from chunks of resumed Reshard, which are
+// not found in store. Keys, changed meanwhile, are tracked by chunks
+func (s *Store) dropDeleted(dst *Store) (err error) {
+	for i := range dst.chunks {
+		keys, err := dst.chunks[i].keys()
+		if err != nil {
+			return err
+		}
+		for _, k := range keys {
+			if atomic.LoadInt32(&s.closing) != 0 {
+				return ErrClosed
+			}
+			_, _, err = s.get(k)
+			if err == nil {
+				continue
+			}
+			if err != ErrNotFound && err != ErrCollision {
+				return err
+			}
+			_, err = dst.Delete(k)
+			if err != nil && err != ErrNotFound && err != ErrCollision {
+				return err
+			}
+		}
+	}
+	return
+}
+
+// copied return true if record is copied with same version and expire
+func (s *Store) copied(rec record) bool {
+	_, header, err := s.get(rec.key)
+	return err == nil && header.ver == rec.ver && header.expire == rec.expire
+}
+
+// put write copied record with its version
+func (s *Store) put(rec record) (err error) {
+	h := hash(rec.key)
+	err = s.chunks[s.idx(h)].put(rec, h)
+	if err == ErrCollision {
+		for i := 0; i < int(s.chunkColCnt); i++ {
+			err = s.chunks[i].put(rec, h)
+			if err == ErrCollision {
+				continue
+			}
+			break
+		}
+	}
+	return
+}
+
+// put write copied record with its version under lock of chunk
+func (c *chunk) put(rec record, h uint32) error {
+	c.Lock()
+	defer c.Unlock()
+	return c.write_key(rec.key, rec.val, h, rec.expire, rec.ver)
+}
+
+// keys return keys of live records in chunk
+func (c *chunk) keys() (keys [][]byte, err error) {
+	c.RLock()
+	defer c.RUnlock()
+	keys = make([][]byte, 0, len(c.m))
+	for _, meta := range c.m {
+		addr, size, _ := decodeKeyMeta(meta)
+		packet, err := c.read_packet(addr, size)
+		if err != nil {
+			return nil, err
+		}
+		_, key, _ := packetUnmarshal(packet)
+		keys = append(keys, key)
+	}
+	return
+}
+
+// track remember key, changed after chunk was copied by Reshard,
+// chunk must be locked for write
+func (c *chunk) track(k []byte) {
+	if c.changes != nil {
+		c.changes[string(k)] = true
+	}
+}
+
+// stopTracking stop tracking of changed keys in chunks
+func (s *Store) stopTracking() {
+	for i := range s.chunks {
+		c := &s.chunks[i]
+		c.Lock()
+		c.changes = nil
+		c.Unlock()
+	}
+}
+
+// syncChunks sync chunks and write their hints, so switched
+// store is opened without scan
+func (s *Store) syncChunks() (err error) {
+	for i := range s.chunks {
+		c := &s.chunks[i]
+		c.Lock()
+		c.needFsync = false
+		err = c.sync()
+		if err == nil {
+			err = c.writeHint()
+		}
+		c.Unlock()
+		if err != nil {
+			return
+		}
+	}
+	// created chunk files must survive power loss
+	return s.fs.SyncDir(s.dir)
+}
+
+// syncCopied sync changed chunks of unfinished Reshard
+func (s *Store) syncCopied() (err error) {
+	for i := range s.chunks {
+		err = s.chunks[i].fsync()
+		if err != nil {
+			return
+		}
+	}
+	// created chunk files must survive power loss
+	return s.fs.SyncDir(s.dir)
+}
+
+// dropChunks close files of chunks, which are not used any more
+func (s *Store) dropChunks() {
+	for i := range s.chunks {
+		s.chunks[i].drop()
+	}
+}
+
+// drop close files of chunk, hint is not written
+func (c *chunk) drop() {
+	c.Lock()
+	defer c.Unlock()
+	if c.blob != nil {
+		c.blob.Close()
+	}
+	if c.f != nil {
+		c.f.Close()
+	}
+}
+
+// removeChunks remove chunk files of generation gen with their hints and blobs.
+// Chunks are removed from last one, so interrupted removal is finished by next call
+func (s *Store) removeChunks(gen int) (err error) {
+	n := 0
+	for ; ; n++ {
+		_, err = s.fs.Stat(s.chunkFile(gen, n))
+		if os.IsNotExist(err) {
+			break
+		}
+		if err != nil {
+			return
+		}
+	}
+	if n == 0 {
+		return nil
+	}
+	for i := n - 1; i >= 0; i-- {
+		name := s.chunkFile(gen, i)
+		for _, file := range []string{hintName(name), hintName(name) + ".tmp", name + ".blob", name + ".compact", name} {
+			err = s.fs.Remove(file)
+			if err != nil && !os.IsNotExist(err) {
+				return
+			}
+		}
+	}
+	return s.fs.SyncDir(s.dir)
+}
+
+// removeStaleChunks remove chunks of other generations: old chunks, which
+// were not removed after Reshard, and files of Reshard, which was not
+// recorded in manifest. Chunks of unfinished Reshard are kept for resume
+func (s *Store) removeStaleChunks() (err error) {
+	if s.chunksGen > 0 {
+		err = s.removeChunks(s.chunksGen - 1)
+		if err != nil {
+			return
+		}
+	}
+	if s.resharding != nil {
+		return nil
+	}
+	return s.removeChunks(s.chunksGen + 1)
+}
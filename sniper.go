@@ -6,8 +6,10 @@ import (
 	"fmt"
 	"io"
 	"os"
+	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/recoilme/sortedset"
@@ -28,6 +30,31 @@ var ErrFormat = errors.New("Error, unexpected file format")
 // ErrNotFound key not found error
 var ErrNotFound = errors.New("Error, key not found")
 
+// ErrCorrupted record checksum mismatch
+var ErrCorrupted = errors.New("Error, record is corrupted")
+
+// ErrManifest options do not match store configuration
+var ErrManifest = errors.New("Error, options do not match store manifest")
+
+// ErrLocked store is opened by other process or other Open call
+var ErrLocked = errors.New("Error, store is locked by another process")
+
+// ErrReadOnly store is opened with ReadOnly option
+var ErrReadOnly = errors.New("Error, store is opened read only")
+
+// ErrChunkFull chunk file reach maximum size
+var ErrChunkFull = errors.New("Error, chunk is full")
+
+// ErrFailed store has write, which was logged, but not applied,
+// store refuse writes until it will be reopened and log will be replayed
+var ErrFailed = errors.New("Error, store failed, reopen it")
+
+// ErrResharded store was resharded while it was iterated or backed up
+var ErrResharded = errors.New("Error, store is resharded")
+
+// ErrClosed store is closed
+var ErrClosed = errors.New("Error, store is closed")
+
 var counters sync.Map
 
 //var chunkColCnt uint32      //chunks for collisions resolving
@@ -37,18 +64,41 @@ var expirechunk = 0 // numbeg chunk for next expiration
 // Store struct
 // data in store sharded by chunks
 type Store struct {
+	// operations with chunks hold read lock, Reshard replace chunks under write lock
 	sync.RWMutex
 	chunks       []chunk
 	chunksCnt    int
 	chunksPrefix string
 	chunkColCnt  int
-
-	dir            string
-	syncInterval   time.Duration
-	iv             interval.Interval
-	expireInterval time.Duration
-	expiv          interval.Interval
-	ss             *sortedset.SortedSet
+	chunksGen    int           // generation of chunk files, changed by Reshard
+	resharding   *reshardState // chunks of unfinished Reshard, nil if there is no one
+	reshardMu    sync.Mutex    // held by running Reshard
+	closing      int32         // Close is called, running Reshard is stopped
+
+	dir             string
+	syncInterval    time.Duration
+	iv              interval.Interval
+	expireInterval  time.Duration
+	expiv           interval.Interval
+	compactInterval time.Duration
+	compactRatio    float64
+	compactiv       interval.Interval
+	hintInterval    time.Duration
+	hintiv          interval.Interval
+	compactchunk    int
+	ss              *sortedset.SortedSet
+	bucketf         File
+	bucketMu        sync.Mutex
+	bucketDirty     bool // index has operations, which are not synced
+	batchf          File
+	batchMu         sync.Mutex
+	durability      DurabilityMode
+	wal             *wal
+	readOnly        bool
+	failErr         error // first error, which put store in failed state
+	failMu          sync.Mutex
+	lockf           io.Closer // lock of store directory, held while store is open
+	fs              VFS
 	//tree         *btreeset.BTreeSet
 }
 
@@ -61,29 +111,13 @@ func Dir(dir string) OptStore {
 		if dir == "" {
 			dir = "."
 		}
-		var err error
-		// create dirs
-		_, err = os.Stat(dir)
-		if err != nil {
-			// file not exists - create dirs if any
-			if os.IsNotExist(err) {
-				if dir != "." {
-					err = os.MkdirAll(dir, os.FileMode(dirMode))
-					if err != nil {
-						return err
-					}
-				}
-			} else {
-				return err
-			}
-		}
 		s.dir = dir
 		return nil
 	}
 }
 
 // ChunksCollision -  number chunks for collisions resolving,
-// default is 4 (>1_000_000_000 of 8 bytes alphabet keys without collision errors)
+// default is 4 or value from manifest of existing store (>1_000_000_000 of 8 bytes alphabet keys without collision errors)
 // different keys may has same hash
 // collision chunks needed for resolving this, without collisions errors
 // if ChunkColCnt - zero, ErrCollision will return in case of collision
@@ -94,7 +128,7 @@ func ChunksCollision(chunks int) OptStore {
 	}
 }
 
-// ChunksTotal - total chunks/shards, default 256
+// ChunksTotal - total chunks/shards, default 256 or value from manifest of existing store
 // Must be more then collision chunks
 func ChunksTotal(chunks int) OptStore {
 	return func(s *Store) error {
@@ -117,6 +151,8 @@ func SyncInterval(interv time.Duration) OptStore {
 		s.syncInterval = interv
 		if interv > 0 {
 			s.iv = interval.Set(func(t time.Time) {
+				s.RLock()
+				defer s.RUnlock()
 				for i := range s.chunks[:] {
 					err := s.chunks[i].fsync()
 					if err != nil {
@@ -138,14 +174,62 @@ func ExpireInterval(interv time.Duration) OptStore {
 		s.expireInterval = interv
 		if interv > 0 {
 			s.expiv = interval.Set(func(t time.Time) {
-				err := s.chunks[expirechunk].expirekeys(interv)
-				if err != nil {
-					fmt.Printf("Error expire:%s\n", err)
+				if s.readOnly {
+					return
 				}
-				expirechunk++
+				// expiration may run long, store is not locked meanwhile,
+				// chunk, replaced by Reshard, is changed in memory only
+				s.RLock()
 				if expirechunk >= s.chunksCnt {
 					expirechunk = 0
 				}
+				c := &s.chunks[expirechunk]
+				expirechunk++
+				s.RUnlock()
+				err := c.expirekeys(interv)
+				if err != nil {
+					fmt.Printf("Error expire:%s\n", err)
+				}
+			}, interv)
+		}
+		return nil
+	}
+}
+
+// AutoCompact - how often check chunks for holes
+// check only one chunk, chunk will be compacted if
+// holes take more then ratio (0..1) of chunk file
+func AutoCompact(interv time.Duration, ratio float64) OptStore {
+	return func(s *Store) error {
+		if ratio <= 0 || ratio > 1 {
+			return errors.New("compaction ratio must be in range (0, 1]")
+		}
+		s.compactInterval = interv
+		s.compactRatio = ratio
+		if interv > 0 {
+			s.compactiv = interval.Set(func(t time.Time) {
+				if s.readOnly {
+					return
+				}
+				s.RLock()
+				defer s.RUnlock()
+				if s.compactchunk >= s.chunksCnt {
+					s.compactchunk = 0
+				}
+				c := &s.chunks[s.compactchunk]
+				s.compactchunk++
+				ratio, err := c.holeRatio()
+				if err != nil {
+					fmt.Printf("Error compact:%s\n", err)
+					return
+				}
+				if ratio < s.compactRatio {
+					return
+				}
+				err = c.compact()
+				if err != nil {
+					fmt.Printf("Error compact:%s\n", err)
+				}
 			}, interv)
 		}
 		return nil
@@ -172,10 +256,13 @@ func hash(b []byte) uint32 {
 func Open(opts ...OptStore) (s *Store, err error) {
 	s = &Store{}
 	//default
+	s.dir = "."
 	s.syncInterval = 0
 	s.expireInterval = 0
-	s.chunkColCnt = 4
-	s.chunksCnt = 256
+	s.hintInterval = 0
+	// chunks are not set, defaults or values from manifest will be used
+	s.chunkColCnt = -1
+	s.chunksCnt = -1
 	// call option functions on instance to set options on it
 	for _, opt := range opts {
 		err := opt(s)
@@ -184,10 +271,52 @@ func Open(opts ...OptStore) (s *Store, err error) {
 			return nil, err
 		}
 	}
+	if s.fs == nil {
+		s.fs = OSFS
+	}
+	// create dirs
+	_, err = s.fs.Stat(s.dir)
+	if os.IsNotExist(err) && s.dir != "." {
+		err = s.fs.MkdirAll(s.dir, os.FileMode(dirMode))
+	}
+	if err != nil {
+		return nil, err
+	}
+	err = s.openLock()
+	if err != nil {
+		return nil, err
+	}
+	lockf := s.lockf
+	defer func() {
+		if err != nil {
+			lockf.Close()
+		}
+	}()
+	err = s.loadManifest()
+	if err != nil {
+		return nil, err
+	}
 	if s.chunksCnt-s.chunkColCnt < 1 {
 		return nil, errors.New("chunksCnt must be more then chunkColCnt minimum on 1")
 	}
+	if !s.readOnly {
+		err = s.removeStaleChunks()
+		if err != nil {
+			return nil, err
+		}
+	}
 	s.chunks = make([]chunk, s.chunksCnt)
+	if s.readOnly {
+		err = s.checkLogs()
+		if err != nil {
+			return nil, err
+		}
+	} else if s.durability != 0 {
+		err = s.openWAL()
+		if err != nil {
+			return nil, err
+		}
+	}
 
 	chchan := make(chan int, s.chunksCnt)
 	errchan := make(chan error, 4)
@@ -202,13 +331,11 @@ func Open(opts ...OptStore) (s *Store, err error) {
 					break
 				}
 
-				var filename string
-				if s.chunksPrefix != "" {
-					filename = fmt.Sprintf("%s/%s-%d", s.dir, s.chunksPrefix, i)
-				} else {
-					filename = fmt.Sprintf("%s/%d", s.dir, i)
-				}
-				err := s.chunks[i].init(filename)
+				s.chunks[i].id = i
+				s.chunks[i].wal = s.wal
+				s.chunks[i].readOnly = s.readOnly
+				s.chunks[i].fs = s.fs
+				err := s.chunks[i].init(s.chunkFile(s.chunksGen, i))
 				if err != nil {
 					errchan <- err
 					exitworkers = true
@@ -231,18 +358,85 @@ func Open(opts ...OptStore) (s *Store, err error) {
 		err = <-errchan
 		return
 	}
+	// buckets index is loaded before logs, they may hold its operations
 	s.ss = sortedset.New()
+	err = s.loadBuckets()
+	if err != nil {
+		return nil, err
+	}
+	if s.wal != nil {
+		err = s.replayWAL()
+		if err != nil {
+			return nil, err
+		}
+		s.startWAL()
+	}
+	if !s.readOnly {
+		err = s.openBatchLog()
+		if err != nil {
+			return nil, err
+		}
+		// created files must survive power loss
+		err = s.fs.SyncDir(s.dir)
+		if err != nil {
+			return nil, err
+		}
+		s.startHints()
+	}
 	return
 }
 
+// filename return path to store file with chunks prefix
+func (s *Store) filename(name string) string {
+	if s.chunksPrefix != "" {
+		return fmt.Sprintf("%s/%s-%s", s.dir, s.chunksPrefix, name)
+	}
+	return fmt.Sprintf("%s/%s", s.dir, name)
+}
+
+// chunkFile return name of chunk file, chunks, written by Reshard,
+// have generation in name
+func (s *Store) chunkFile(gen, i int) string {
+	if gen == 0 {
+		return s.filename(strconv.Itoa(i))
+	}
+	return s.filename(fmt.Sprintf("%d.g%d", i, gen))
+}
+
+// fail put store in failed state, writes return ErrFailed until reopen
+// return error of failed state
+func (s *Store) fail(err error) error {
+	s.failMu.Lock()
+	defer s.failMu.Unlock()
+	if s.failErr == nil {
+		s.failErr = fmt.Errorf("%w: %s", ErrFailed, err.Error())
+	}
+	return s.failErr
+}
+
+// writable return ErrReadOnly or error of failed state, if store can't be written
+func (s *Store) writable() error {
+	if s.readOnly {
+		return ErrReadOnly
+	}
+	s.failMu.Lock()
+	defer s.failMu.Unlock()
+	return s.failErr
+}
+
 func (s *Store) idx(h uint32) uint32 {
 	return uint32((int(h) % (s.chunksCnt - s.chunkColCnt)) + s.chunkColCnt)
 }
 
 // Set - store key and val in shard
-// max packet size is 2^19, 512kb (524288)
-// packet size = len(key) + len(val) + 8
+// expire - unix time in seconds, 0 - no expire
+// values bigger then 64kb are stored in blob file
 func (s *Store) Set(k, v []byte, expire uint32) (err error) {
+	if err := s.writable(); err != nil {
+		return err
+	}
+	s.RLock()
+	defer s.RUnlock()
 	h := hash(k)
 	idx := s.idx(h)
 	err = s.chunks[idx].set(k, v, h, expire)
@@ -260,6 +454,11 @@ func (s *Store) Set(k, v []byte, expire uint32) (err error) {
 
 // Touch - update key expire
 func (s *Store) Touch(k []byte, expire uint32) (err error) {
+	if err := s.writable(); err != nil {
+		return err
+	}
+	s.RLock()
+	defer s.RUnlock()
 	h := hash(k)
 	idx := s.idx(h)
 	err = s.chunks[idx].touch(k, h, expire)
@@ -277,12 +476,20 @@ func (s *Store) Touch(k []byte, expire uint32) (err error) {
 
 // Get - return val by key
 func (s *Store) Get(k []byte) (v []byte, err error) {
+	s.RLock()
+	defer s.RUnlock()
+	v, _, err = s.get(k)
+	return
+}
+
+// get return val with header, store must be locked
+func (s *Store) get(k []byte) (v []byte, header *Header, err error) {
 	h := hash(k)
 	idx := s.idx(h)
-	v, _, err = s.chunks[idx].get(k, h)
+	v, header, err = s.chunks[idx].get(k, h)
 	if err == ErrCollision {
 		for i := 0; i < int(s.chunkColCnt); i++ {
-			v, _, err = s.chunks[i].get(k, h)
+			v, header, err = s.chunks[i].get(k, h)
 			if err == ErrCollision || err == ErrNotFound {
 				continue
 			}
@@ -292,23 +499,91 @@ func (s *Store) Get(k []byte) (v []byte, err error) {
 	return
 }
 
+// TTL return remaining time to live of key, -1 if key has no expire
+func (s *Store) TTL(k []byte) (ttl time.Duration, err error) {
+	s.RLock()
+	defer s.RUnlock()
+	h := hash(k)
+	idx := s.idx(h)
+	expire, err := s.chunks[idx].ttl(k, h)
+	if err == ErrCollision {
+		for i := 0; i < int(s.chunkColCnt); i++ {
+			expire, err = s.chunks[i].ttl(k, h)
+			if err == ErrCollision || err == ErrNotFound {
+				continue
+			}
+			break
+		}
+	}
+	if err != nil {
+		return
+	}
+	if expire == 0 {
+		return -1, nil
+	}
+	ttl = time.Until(time.Unix(int64(expire), 0))
+	if ttl < 0 {
+		// expire in current second
+		ttl = 0
+	}
+	return
+}
+
 // Count return count keys
 func (s *Store) Count() (cnt int) {
+	s.RLock()
+	defer s.RUnlock()
 	for i := range s.chunks[:] {
 		cnt += s.chunks[i].count()
 	}
 	return
 }
 
+// Holes - return count and total size of free space in chunks,
+// taken from index in memory
+func (s *Store) Holes() (n int, size int64) {
+	s.RLock()
+	defer s.RUnlock()
+	for i := range s.chunks[:] {
+		cn, csize := s.chunks[i].holes()
+		n += cn
+		size += csize
+	}
+	return
+}
+
 // Close - close related chunks
 func (s *Store) Close() (err error) {
 	errStr := ""
+	// stop running Reshard and wait it
+	atomic.StoreInt32(&s.closing, 1)
+	s.reshardMu.Lock()
+	defer s.reshardMu.Unlock()
 	if s.syncInterval > 0 {
 		s.iv.Clear()
 	}
 	if s.expireInterval > 0 {
 		s.expiv.Clear()
 	}
+	if s.compactInterval > 0 {
+		s.compactiv.Clear()
+	}
+	if !s.readOnly && s.hintInterval > 0 {
+		s.hintiv.Clear()
+	}
+	// error of write ahead log or of failed state
+	// is returned after store is closed
+	var errFail error
+	if s.wal != nil {
+		errFail = s.closeWAL()
+	} else if !s.readOnly {
+		errFail = s.writable()
+	}
+	defer func() {
+		if errFail != nil {
+			err = errFail
+		}
+	}()
 	for i := range s.chunks[:] {
 		err = s.chunks[i].close()
 		if err != nil {
@@ -316,10 +591,22 @@ func (s *Store) Close() (err error) {
 			return
 		}
 	}
+	if s.batchf != nil {
+		err = s.batchf.Close()
+		if err != nil {
+			return
+		}
+	}
+	if s.bucketf != nil {
+		err = s.bucketf.Close()
+		if err != nil {
+			return
+		}
+	}
 	if errStr != "" {
 		return errors.New(errStr)
 	}
-	return
+	return s.closeLock()
 }
 
 // DeleteStore - remove directory with files
@@ -329,6 +616,8 @@ func DeleteStore(dir string) error {
 
 // FileSize returns the total size of the disk storage used by the DB.
 func (s *Store) FileSize() (fs int64, err error) {
+	s.RLock()
+	defer s.RUnlock()
 	for i := range s.chunks[:] {
 		is, err := s.chunks[i].fileSize()
 		if err != nil {
@@ -341,6 +630,11 @@ func (s *Store) FileSize() (fs int64, err error) {
 
 // Delete - delete item by key
 func (s *Store) Delete(k []byte) (isDeleted bool, err error) {
+	if err := s.writable(); err != nil {
+		return false, err
+	}
+	s.RLock()
+	defer s.RUnlock()
 	h := hash(k)
 	idx := s.idx(h)
 	isDeleted, err = s.chunks[idx].delete(k, h)
@@ -356,49 +650,73 @@ func (s *Store) Delete(k []byte) (isDeleted bool, err error) {
 	return
 }
 
-// Incr - Incr item by uint64
-// inited with zero
+// Incr - Incr item by uint64, counter wrap at 2^64
+// inited with zero. Counter is 8 bytes big endian, decimal counter of IncrInt
+// is read too. ErrNotNumber is returned if value is not uint64
 func (s *Store) Incr(k []byte, v uint64) (uint64, error) {
-	h := hash(k)
-	idx := s.idx(h)
-	return s.chunks[idx].incrdecr(k, h, v, true)
+	return s.incrdecr(k, v, true)
 }
 
-// Decr - Decr item by uint64
+// Decr - Decr item by uint64, counter wrap below zero
 // inited with zero
 func (s *Store) Decr(k []byte, v uint64) (uint64, error) {
-	h := hash(k)
-	idx := s.idx(h)
-	return s.chunks[idx].incrdecr(k, h, v, false)
+	return s.incrdecr(k, v, false)
 }
 
-// Backup all data to writer
+// Backup all data to writer, ErrResharded is returned
+// if store is resharded while backup is written
 func (s *Store) Backup(w io.Writer) (err error) {
 	_, err = w.Write([]byte{currentChunkVersion})
 	if err != nil {
 		return
 	}
-	for i := range s.chunks[:] {
-		err = s.chunks[i].backup(w)
+	return s.eachChunk(func(c *chunk) error {
+		return c.backup(w)
+	})
+}
+
+// eachChunk call fn for every chunk, store is locked for every call only,
+// so long walk do not delay Reshard. ErrResharded is returned,
+// if store is resharded while chunks are walked
+func (s *Store) eachChunk(fn func(c *chunk) error) error {
+	s.RLock()
+	gen := s.chunksGen
+	s.RUnlock()
+	for i := 0; ; i++ {
+		s.RLock()
+		if s.chunksGen != gen {
+			s.RUnlock()
+			return ErrResharded
+		}
+		if i >= len(s.chunks) {
+			s.RUnlock()
+			return nil
+		}
+		err := fn(&s.chunks[i])
+		s.RUnlock()
 		if err != nil {
-			return
+			return err
 		}
 	}
-	return
 }
 
 // Restore from backup reader
 func (s *Store) Restore(r io.Reader) (err error) {
+	err = s.writable()
+	if err != nil {
+		return
+	}
 	b := make([]byte, 1)
 	_, err = r.Read(b)
-	if int(b[0]) != currentChunkVersion {
+	version := int(b[0])
+	if version < 1 || version > currentChunkVersion {
 		return fmt.Errorf("Bad backup version %d", b[0])
 	}
 
 	for {
 		var header *Header
 		var errRead error
-		header, errRead = readHeader(r, currentChunkVersion)
+		header, errRead = readHeader(r, version)
 		if errRead != nil {
 			return errRead
 		}
@@ -415,6 +733,10 @@ func (s *Store) Restore(r io.Reader) (err error) {
 		if n != size-int(sizeHead) {
 			return fmt.Errorf("n != record length: %w", ErrFormat)
 		}
+		// records have checksum since version 2
+		if version >= 2 && checksum(header, b[sizeHead:], version) != header.crc {
+			return ErrCorrupted
+		}
 
 		// skip deleted or expired entry
 		if header.status == deleted || (header.expire != 0 && int64(header.expire) < time.Now().Unix()) {
@@ -445,11 +767,42 @@ func (s *Store) RestoreGZ(r io.Reader) (err error) {
 
 // Expire - remove expired keys from all chunks
 func (s *Store) Expire() (err error) {
-	for i := range s.chunks[:] {
-		err = s.chunks[i].expirekeys(time.Duration(0))
-		if err != nil {
-			return
+	err = s.writable()
+	if err != nil {
+		return
+	}
+	err = s.eachChunk(func(c *chunk) error {
+		return c.expirekeys(time.Duration(0))
+	})
+	if err == ErrResharded {
+		// expired records are not copied by Reshard
+		err = nil
+	}
+	return
+}
+
+// Compact - rewrite chunks with holes, reclaim space
+// from deleted and expired records
+// chunks compacted one by one, so other chunks stay available.
+// Chunk with damaged live record is not compacted, ErrCorrupted is returned.
+// Chunk, iterated by open Iterator, is skipped
+func (s *Store) Compact() (err error) {
+	err = s.writable()
+	if err != nil {
+		return
+	}
+	err = s.eachChunk(func(c *chunk) error {
+		c.RLock()
+		holes := len(c.h)
+		c.RUnlock()
+		if holes == 0 {
+			return nil
 		}
+		return c.compact()
+	})
+	if err == ErrResharded {
+		// chunks, written by Reshard, have no holes
+		err = nil
 	}
 	return
 }
@@ -469,7 +822,23 @@ func appendUint32(b []byte, x uint32) []byte {
 	return append(b, a[:]...)
 }
 
-// Bucket - create new bucket for storing keys with same prefix in memory index
+// LookupBucket - return existing bucket, ErrNotFound if bucket is missing.
+// Unlike Bucket, it do not modify store and works with read only store
+func (s *Store) LookupBucket(name string) (*sortedset.BucketStore, error) {
+	buckets, err := s.Buckets()
+	if err != nil {
+		return nil, err
+	}
+	for _, bucket := range buckets {
+		if bucket == name {
+			return sortedset.Bucket(s.ss, name), nil
+		}
+	}
+	return nil, ErrNotFound
+}
+
+// Bucket - create new bucket for storing keys with same prefix in index
+// index is kept in memory and persisted in buckets index file
 func (s *Store) Bucket(name string) (*sortedset.BucketStore, error) {
 	// store all buckets in [buckets] key
 	bKey := []byte("[buckets]")
@@ -501,14 +870,49 @@ func (s *Store) Bucket(name string) (*sortedset.BucketStore, error) {
 	return sortedset.Bucket(s.ss, name), nil
 }
 
+// Buckets return names of all buckets
+func (s *Store) Buckets() ([]string, error) {
+	val, err := s.Get([]byte("[buckets]"))
+	if err == ErrNotFound {
+		return nil, nil
+	}
+	if err != nil || len(val) == 0 {
+		return nil, err
+	}
+	return strings.Split(string(val), ","), nil
+}
+
 // Put - store key and val with Set
 // And add key in index (backed by sortedset)
+// value and index are written in one batch, so crash can't split them
 func (s *Store) Put(bucket *sortedset.BucketStore, k, v []byte) (err error) {
 	key := []byte(bucket.Name)
 	key = append(key, k...)
-	err = s.Set(key, v, 0)
-	if err == nil {
-		bucket.Put(string(k))
+	if bucket.Set.Has(bucket.Name + string(k)) {
+		return s.Set(key, v, 0)
+	}
+	b := &Batch{}
+	b.Set(key, v, 0)
+	b.ops = append(b.ops, batchOp{op: opBucketPut, key: []byte(bucket.Name), val: append([]byte{}, k...)})
+	return s.Write(b)
+}
+
+// DeleteFromBucket - delete key stored with Put method
+// and remove key from bucket index
+func (s *Store) DeleteFromBucket(bucket *sortedset.BucketStore, k []byte) (isDeleted bool, err error) {
+	key := []byte(bucket.Name)
+	key = append(key, k...)
+	if !bucket.Set.Has(bucket.Name + string(k)) {
+		return s.Delete(key)
+	}
+	ops, err := s.write([]batchOp{
+		{op: opDelete, key: key},
+		{op: opBucketDelete, key: []byte(bucket.Name), val: append([]byte{}, k...)},
+	})
+	for _, op := range ops {
+		if op.op == opDelete {
+			isDeleted = true
+		}
 	}
 	return
 }
@@ -3,12 +3,18 @@ package sniper
 import (
 	"bytes"
 	"encoding/binary"
+	"errors"
 	"fmt"
 	"math/rand"
 	"os"
 	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
+	"unsafe"
 
 	"bou.ke/monkey"
 	"github.com/stretchr/testify/assert"
@@ -18,25 +24,87 @@ import (
 func TestPack(t *testing.T) {
 	addr := 1<<26 - 5
 	size := byte(5)
-	curtime := time.Now().Unix()
-	expire := uint32(curtime>>9) << 9
-	some64 := encodeKeyMeta(uint32(addr), size, expire)
-	expire += 1<<9 - 1
-	s, l, e := decodeKeyMeta(some64)
-	if s != uint32(addr) || l != 5 || e != expire {
+	expire := uint32(time.Now().Unix())
+	meta := encodeKeyMeta(uint64(addr), size, expire)
+	s, l, e := decodeKeyMeta(meta)
+	if s != uint64(addr) || l != 5 || e != expire {
 		t.Errorf("get addr = %d, size=%d expire=%d", s, l, e)
 	}
-	addr = 1<<28 - 1
-	size = byte(19)
-	exp, _ := time.Parse("2006-02-01 15:04:05", "2020-10-11 12:34:56")
-	curtime = exp.Unix()
-	expire = uint32(curtime>>9) << 9
-	maxAddrSize := encodeKeyMeta(uint32(addr), size, expire)
-	expire += 1<<9 - 1
-	s, l, e = decodeKeyMeta(maxAddrSize)
-	if s != uint32(addr) || l != 19 || e != expire {
-		t.Errorf("get addr = %d, size=%d expire=%d", s, l, e)
+	// address over 4 Gb, maximum size and expire
+	for _, addr64 := range []uint64{uint64(1)<<40 + 3, maxChunkSize} {
+		size = byte(31)
+		expire = 1<<32 - 1
+		meta = encodeKeyMeta(addr64, size, expire)
+		s, l, e = decodeKeyMeta(meta)
+		if s != addr64 || l != 31 || e != expire {
+			t.Errorf("get addr = %d, size=%d expire=%d", s, l, e)
+		}
 	}
+	if n := unsafe.Sizeof(meta); n != 12 {
+		t.Errorf("key meta size = %d", n)
+	}
+}
+
+func TestTTL(t *testing.T) {
+	err := DeleteStore("1")
+	assert.NoError(t, err)
+	s, err := Open(Dir("1"))
+	assert.NoError(t, err)
+
+	unixtime := uint32(time.Now().Unix())
+	err = s.Set([]byte("key1"), []byte("go"), unixtime+100)
+	assert.NoError(t, err)
+	err = s.Set([]byte("key2"), []byte("go"), 0)
+	assert.NoError(t, err)
+
+	ttl, err := s.TTL([]byte("key1"))
+	assert.NoError(t, err)
+	assert.True(t, ttl > 98*time.Second && ttl <= 100*time.Second)
+	ttl, err = s.TTL([]byte("key2"))
+	assert.NoError(t, err)
+	assert.Equal(t, time.Duration(-1), ttl)
+	_, err = s.TTL([]byte("key3"))
+	assert.Equal(t, ErrNotFound, err)
+
+	// key expire exactly in time, not rounded
+	patch := monkey.Patch(time.Now, func() time.Time { return time.Unix(int64(unixtime)+101, 0) })
+	_, err = s.TTL([]byte("key1"))
+	assert.Equal(t, ErrNotFound, err)
+	err = s.Expire()
+	assert.NoError(t, err)
+	patch.Unpatch()
+	assert.Equal(t, 1, s.Count())
+
+	err = s.Close()
+	assert.NoError(t, err)
+	err = DeleteStore("1")
+	assert.NoError(t, err)
+}
+
+func TestAddr64(t *testing.T) {
+	err := DeleteStore("1")
+	assert.NoError(t, err)
+	s, err := Open(Dir("1"), ChunksCollision(0), ChunksTotal(1))
+	assert.NoError(t, err)
+	err = s.Set([]byte("key1"), []byte("val1"), 0)
+	assert.NoError(t, err)
+	// sparse chunk file bigger then 4 Gb
+	err = s.chunks[0].f.Truncate(5 << 30)
+	assert.NoError(t, err)
+	err = s.Set([]byte("key2"), []byte("val2"), 0)
+	assert.NoError(t, err)
+	addr, _, _ := decodeKeyMeta(s.chunks[0].m[hash([]byte("key2"))])
+	assert.Equal(t, uint64(5<<30), addr)
+	v, err := s.Get([]byte("key2"))
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("val2"), v)
+	v, err = s.Get([]byte("key1"))
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("val1"), v)
+	err = s.Close()
+	assert.NoError(t, err)
+	err = DeleteStore("1")
+	assert.NoError(t, err)
 }
 
 func TestHashCol(t *testing.T) {
@@ -301,6 +369,42 @@ func TestBucket(t *testing.T) {
 
 	assert.Equal(t, []string{"02", "01"}, users.Keys(0, 0))
 
+	// index survive restart
+	err = s.Close()
+	assert.NoError(t, err)
+	s, err = Open(Dir("2"), ChunksCollision(0), ChunksTotal(1))
+	assert.NoError(t, err)
+	users, err = s.Bucket("users")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"02", "01"}, s.Keys(users, 0, 0))
+
+	deleted, err := s.DeleteFromBucket(users, []byte("02"))
+	assert.NoError(t, err)
+	assert.True(t, deleted)
+	_, err = s.Get([]byte("users02"))
+	assert.Equal(t, ErrNotFound, err)
+	assert.Equal(t, []string{"01"}, s.Keys(users, 0, 0))
+
+	err = s.Close()
+	assert.NoError(t, err)
+	s, err = Open(Dir("2"), ChunksCollision(0), ChunksTotal(1))
+	assert.NoError(t, err)
+	users, err = s.LookupBucket("users")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"01"}, s.Keys(users, 0, 0))
+
+	// lookup do not create bucket
+	_, err = s.LookupBucket("nope")
+	assert.Equal(t, ErrNotFound, err)
+	buckets, err := s.Buckets()
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"users"}, buckets)
+
+	// deleted record is hole
+	holes, holeBytes := s.Holes()
+	assert.True(t, holes > 0)
+	assert.True(t, holeBytes > 0)
+
 	err = s.Close()
 	assert.NoError(t, err)
 	DeleteStore("2")
@@ -504,28 +608,1780 @@ func TestBackup(t *testing.T) {
 	assert.NoError(t, err)
 }
 
-// test run only when set enviroment variable "TESTCHUNK"
-// test use prepared chunk file "testchunk"
-func TestExpireChunk(t *testing.T) {
-	if os.Getenv("TESTCHUNK") == "" {
-		t.SkipNow()
+func TestCompact(t *testing.T) {
+	err := DeleteStore("1")
+	assert.NoError(t, err)
+
+	s, err := Open(Dir("1"), ChunksCollision(0), ChunksTotal(2))
+	assert.NoError(t, err)
+
+	for i := 0; i < 1000; i++ {
+		k := []byte(fmt.Sprintf("key%d", i))
+		err = s.Set(k, []byte("small"), 0)
+		assert.NoError(t, err)
 	}
-	ch := chunk{}
-	err := ch.init("testchunk")
+	// grow values, old records become holes
+	for i := 0; i < 1000; i++ {
+		k := []byte(fmt.Sprintf("key%d", i))
+		err = s.Set(k, bytes.Repeat([]byte("v"), 100), 0)
+		assert.NoError(t, err)
+	}
+	for i := 0; i < 1000; i += 2 {
+		_, err = s.Delete([]byte(fmt.Sprintf("key%d", i)))
+		assert.NoError(t, err)
+	}
+	size1, err := s.FileSize()
 	assert.NoError(t, err)
 
-	keys1 := ch.count()
-	t.Logf("before expire keys count %d", keys1)
+	err = s.Compact()
+	assert.NoError(t, err)
+	size2, err := s.FileSize()
+	assert.NoError(t, err)
+	assert.Less(t, size2, size1)
+	assert.Equal(t, 500, s.Count())
 
-	newtime := time.Now().Add(time.Hour * 168)
-	// shift time forward by week force expire delete old keys
-	patch := monkey.Patch(time.Now, func() time.Time { return newtime })
-	ch.expirekeys(0)
-	patch.Unpatch()
-	keys2 := ch.count()
-	t.Logf("after expire keys count %d", keys2)
-	assert.Less(t, keys2, keys1, "Expire not work")
+	ratio, err := s.chunks[1].holeRatio()
+	assert.NoError(t, err)
+	assert.Equal(t, float64(0), ratio)
 
-	err = ch.close()
+	// store is usable after compaction
+	err = s.Set([]byte("key0"), []byte("new"), 0)
+	assert.NoError(t, err)
+
+	err = s.Close()
+	assert.NoError(t, err)
+	s, err = Open(Dir("1"), ChunksCollision(0), ChunksTotal(2))
+	assert.NoError(t, err)
+	assert.Equal(t, 501, s.Count())
+	v, err := s.Get([]byte("key0"))
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("new"), v)
+	for i := 1; i < 1000; i += 2 {
+		v, err := s.Get([]byte(fmt.Sprintf("key%d", i)))
+		assert.NoError(t, err)
+		assert.Equal(t, bytes.Repeat([]byte("v"), 100), v)
+	}
+
+	err = s.Close()
+	assert.NoError(t, err)
+	err = DeleteStore("1")
+	assert.NoError(t, err)
+}
+
+// renameFS - MemFS, where rename of compacted chunk fail and, if reopen
+// is false, files can't be opened after failed rename
+type renameFS struct {
+	*MemFS
+	reopen bool
+	failed bool
+}
+
+func (fs *renameFS) Rename(oldname, newname string) error {
+	if !strings.HasSuffix(oldname, ".compact") {
+		return fs.MemFS.Rename(oldname, newname)
+	}
+	fs.failed = true
+	return &os.LinkError{Op: "rename", Old: oldname, New: newname, Err: os.ErrPermission}
+}
+
+func (fs *renameFS) OpenFile(name string, flag int, perm os.FileMode) (File, error) {
+	if fs.failed && !fs.reopen {
+		return nil, &os.PathError{Op: "open", Path: name, Err: os.ErrPermission}
+	}
+	return fs.MemFS.OpenFile(name, flag, perm)
+}
+
+func TestCompactRenameFail(t *testing.T) {
+	for _, reopen := range []bool{true, false} {
+		fs := &renameFS{MemFS: NewMemFS(), reopen: reopen}
+		s, err := Open(Dir("1"), FS(fs), ChunksCollision(0), ChunksTotal(1))
+		assert.NoError(t, err)
+		for i := 0; i < 10; i++ {
+			assert.NoError(t, s.Set([]byte(fmt.Sprintf("key%d", i)), []byte("v"), 0))
+		}
+		_, err = s.Delete([]byte("key0"))
+		assert.NoError(t, err)
+		assert.Error(t, s.Compact())
+		// chunk stay usable with old file or return error, but never panic
+		_, err = s.Get([]byte("key1"))
+		if reopen {
+			assert.NoError(t, err)
+			assert.NoError(t, s.Set([]byte("key1"), []byte("new"), 0))
+		} else {
+			assert.Error(t, err)
+			assert.Error(t, s.Set([]byte("key1"), []byte("new"), 0))
+		}
+		s.Close()
+	}
+}
+
+func TestRange(t *testing.T) {
+	err := DeleteStore("1")
+	assert.NoError(t, err)
+
+	s, err := Open(Dir("1"), ChunksCollision(0), ChunksTotal(4))
+	assert.NoError(t, err)
+
+	expire := uint32(time.Now().Unix()) + 100
+	for i := 0; i < 100; i++ {
+		err = s.Set([]byte(fmt.Sprintf("key%d", i)), []byte(fmt.Sprintf("val%d", i)), expire)
+		assert.NoError(t, err)
+	}
+	for i := 0; i < 100; i += 10 {
+		_, err = s.Delete([]byte(fmt.Sprintf("key%d", i)))
+		assert.NoError(t, err)
+	}
+	// already expired
+	err = s.Set([]byte("expired"), []byte("val"), uint32(time.Now().Unix())-1)
+	assert.NoError(t, err)
+
+	found := make(map[string]string)
+	err = s.Range(func(k, v []byte, exp uint32) bool {
+		assert.Equal(t, expire, exp)
+		found[string(k)] = string(v)
+		return true
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, 90, len(found))
+	for i := 0; i < 100; i++ {
+		v, ok := found[fmt.Sprintf("key%d", i)]
+		if i%10 == 0 {
+			assert.False(t, ok)
+			continue
+		}
+		assert.Equal(t, fmt.Sprintf("val%d", i), v)
+	}
+
+	// stop iteration
+	cnt := 0
+	err = s.Range(func(k, v []byte, exp uint32) bool {
+		cnt++
+		return cnt < 5
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, 5, cnt)
+
+	it := s.Iterator()
+	cnt = 0
+	for it.Next() {
+		assert.Equal(t, found[string(it.Key())], string(it.Value()))
+		cnt++
+	}
+	assert.NoError(t, it.Err())
+	assert.NoError(t, it.Close())
+	assert.Equal(t, 90, cnt)
+
+	// chunk is read from snapshot: records of current chunk, changed or
+	// deleted after iterator reach it, have old values, records of next chunks
+	// are taken when iterator reach them and have new values
+	it = s.Iterator()
+	assert.True(t, it.Next())
+	first := s.idx(hash(it.Key()))
+	want := make(map[string]string)
+	deleted := false
+	for k, v := range found {
+		if k == string(it.Key()) {
+			continue
+		}
+		if s.idx(hash([]byte(k))) != first {
+			assert.NoError(t, s.Set([]byte(k), []byte("new"), 0))
+			want[k] = "new"
+			continue
+		}
+		if !deleted {
+			_, err = s.Delete([]byte(k))
+			deleted = true
+		} else {
+			err = s.Set([]byte(k), []byte("new value, other size"), 0)
+		}
+		assert.NoError(t, err)
+		want[k] = v
+	}
+	assert.True(t, deleted)
+	// pinned chunk is not compacted
+	assert.NoError(t, s.Compact())
+	cnt = 1
+	for it.Next() {
+		assert.Equal(t, want[string(it.Key())], string(it.Value()))
+		cnt++
+	}
+	assert.NoError(t, it.Err())
+	assert.NoError(t, it.Close())
+	assert.Equal(t, 90, cnt)
+	assert.Empty(t, s.chunks[first].snaps)
+
+	err = s.Close()
+	assert.NoError(t, err)
+	err = DeleteStore("1")
+	assert.NoError(t, err)
+}
+
+// TestIteratorBlob - blob extents of record in snapshot are not reused
+func TestIteratorBlob(t *testing.T) {
+	s, err := Open(FS(NewMemFS()), ChunksCollision(0), ChunksTotal(1))
+	assert.NoError(t, err)
+	big := bytes.Repeat([]byte("a"), 3*blobExtent)
+	assert.NoError(t, s.Set([]byte("big"), big, 0))
+	assert.NoError(t, s.Set([]byte("small"), []byte("v"), 0))
+
+	it := s.Iterator()
+	assert.True(t, it.Next())
+	_, err = s.Delete([]byte("big"))
+	assert.NoError(t, err)
+	assert.NoError(t, s.Set([]byte("big2"), bytes.Repeat([]byte("b"), 3*blobExtent), 0))
+	assert.NoError(t, s.Touch([]byte("small"), uint32(time.Now().Unix())+100))
+
+	found := map[string][]byte{string(it.Key()): it.Value()}
+	expire := map[string]uint32{string(it.Key()): it.Expire()}
+	for it.Next() {
+		found[string(it.Key())] = it.Value()
+		expire[string(it.Key())] = it.Expire()
+	}
+	assert.NoError(t, it.Err())
+	assert.NoError(t, it.Close())
+	assert.Equal(t, 2, len(found))
+	assert.Equal(t, big, found["big"])
+	assert.Equal(t, []byte("v"), found["small"])
+	assert.Equal(t, uint32(0), expire["small"])
+
+	v, err := s.Get([]byte("big2"))
+	assert.NoError(t, err)
+	assert.Equal(t, bytes.Repeat([]byte("b"), 3*blobExtent), v)
+	assert.NoError(t, s.Close())
+}
+
+func TestBatch(t *testing.T) {
+	err := DeleteStore("1")
+	assert.NoError(t, err)
+
+	s, err := Open(Dir("1"))
+	assert.NoError(t, err)
+
+	err = s.Set([]byte("old"), []byte("val"), 0)
+	assert.NoError(t, err)
+
+	b := &Batch{}
+	for i := 0; i < 100; i++ {
+		b.Set([]byte(fmt.Sprintf("key%d", i)), []byte(fmt.Sprintf("val%d", i)), 0)
+	}
+	b.Incr([]byte("counter"), 2)
+	b.Incr([]byte("counter"), 3)
+	b.Delete([]byte("old"))
+	b.Delete([]byte("key99"))
+	assert.Equal(t, 104, b.Len())
+	err = s.Write(b)
+	assert.NoError(t, err)
+
+	for i := 0; i < 99; i++ {
+		v, err := s.Get([]byte(fmt.Sprintf("key%d", i)))
+		assert.NoError(t, err)
+		assert.Equal(t, []byte(fmt.Sprintf("val%d", i)), v)
+	}
+	_, err = s.Get([]byte("key99"))
+	assert.Equal(t, ErrNotFound, err)
+	_, err = s.Get([]byte("old"))
+	assert.Equal(t, ErrNotFound, err)
+	cnt, err := s.Incr([]byte("counter"), 0)
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(5), cnt)
+
+	// batch log with interrupted batch
+	b.Reset()
+	b.Set([]byte("key0"), []byte("new"), 0)
+	b.Delete([]byte("key1"))
+	idxs := s.batchChunks(b.ops)
+	for _, i := range idxs {
+		s.chunks[i].Lock()
+	}
+	ops, err := s.resolveOps(b.ops)
+	for _, i := range idxs {
+		s.chunks[i].Unlock()
+	}
+	assert.NoError(t, err)
+	err = s.Close()
+	assert.NoError(t, err)
+	rec := frameRecord(encodeOps(ops))
+
+	// damaged batch is dropped
+	err = os.WriteFile("1/batch.log", rec[:len(rec)-1], 0644)
+	assert.NoError(t, err)
+	s, err = Open(Dir("1"))
+	assert.NoError(t, err)
+	v, err := s.Get([]byte("key0"))
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("val0"), v)
+	err = s.Close()
+	assert.NoError(t, err)
+
+	// complete batch is rolled forward
+	err = os.WriteFile("1/batch.log", rec, 0644)
+	assert.NoError(t, err)
+	s, err = Open(Dir("1"))
+	assert.NoError(t, err)
+	v, err = s.Get([]byte("key0"))
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("new"), v)
+	_, err = s.Get([]byte("key1"))
+	assert.Equal(t, ErrNotFound, err)
+	fi, err := os.Stat("1/batch.log")
+	assert.NoError(t, err)
+	assert.Equal(t, int64(0), fi.Size())
+
+	err = s.Close()
+	assert.NoError(t, err)
+	err = DeleteStore("1")
+	assert.NoError(t, err)
+}
+
+func TestWAL(t *testing.T) {
+	err := DeleteStore("1")
+	assert.NoError(t, err)
+
+	s, err := Open(Dir("1"), ChunksTotal(8), Durability(SyncEveryWrite))
+	assert.NoError(t, err)
+	for i := 0; i < 100; i++ {
+		err = s.Set([]byte(fmt.Sprintf("key%d", i)), []byte(fmt.Sprintf("val%d", i)), 0)
+		assert.NoError(t, err)
+	}
+	_, err = s.Delete([]byte("key1"))
+	assert.NoError(t, err)
+	expire := uint32(time.Now().Unix()) + 100
+	err = s.Touch([]byte("key2"), expire)
+	assert.NoError(t, err)
+	_, err = s.Incr([]byte("counter"), 42)
+	assert.NoError(t, err)
+	b := &Batch{}
+	b.Set([]byte("key3"), []byte("batch"), 0)
+	b.Delete([]byte("key4"))
+	err = s.Write(b)
+	assert.NoError(t, err)
+
+	// log after crash
+	log, err := os.ReadFile("1/wal.log")
+	assert.NoError(t, err)
+	assert.NotEmpty(t, log)
+	err = s.Close()
+	assert.NoError(t, err)
+
+	// chunks lost all writes, some chunk has torn record at the end,
+	// log has torn record at the end
+	for i := 0; i < 8; i++ {
+		err = os.WriteFile(fmt.Sprintf("1/%d", i), []byte{versionMarker, currentChunkVersion}, 0644)
+		assert.NoError(t, err)
+	}
+	err = os.WriteFile("1/5", []byte{versionMarker, currentChunkVersion, 10, 0, 0}, 0644)
+	assert.NoError(t, err)
+	torn := frameRecord(encodeOps([]batchOp{{op: opSet, key: []byte("torn"), val: []byte("torn")}}))
+	err = os.WriteFile("1/wal.log", append(log, torn[:len(torn)-2]...), 0644)
+	assert.NoError(t, err)
+
+	s, err = Open(Dir("1"), ChunksTotal(8), Durability(GroupCommit))
+	assert.NoError(t, err)
+	for i := 0; i < 100; i++ {
+		v, err := s.Get([]byte(fmt.Sprintf("key%d", i)))
+		switch i {
+		case 1, 4:
+			assert.Equal(t, ErrNotFound, err)
+		case 3:
+			assert.Equal(t, []byte("batch"), v)
+		default:
+			assert.NoError(t, err)
+			assert.Equal(t, []byte(fmt.Sprintf("val%d", i)), v)
+		}
+	}
+	_, err = s.Get([]byte("torn"))
+	assert.Equal(t, ErrNotFound, err)
+	// log is truncated after replay
+	fi, err := os.Stat("1/wal.log")
+	assert.NoError(t, err)
+	assert.Equal(t, int64(0), fi.Size())
+	cnt, err := s.Incr([]byte("counter"), 0)
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(42), cnt)
+
+	// concurrent writers share fsync
+	var wg sync.WaitGroup
+	for g := 0; g < 8; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			for i := 0; i < 50; i++ {
+				err := s.Set([]byte(fmt.Sprintf("g%d-%d", g, i)), []byte("v"), 0)
+				assert.NoError(t, err)
+			}
+		}(g)
+	}
+	wg.Wait()
+	assert.Equal(t, 99+400, s.Count())
+
+	err = s.Close()
+	assert.NoError(t, err)
+	err = DeleteStore("1")
+	assert.NoError(t, err)
+}
+
+func TestChecksum(t *testing.T) {
+	err := DeleteStore("1")
+	assert.NoError(t, err)
+
+	s, err := Open(Dir("1"), ChunksCollision(0), ChunksTotal(1))
+	assert.NoError(t, err)
+	err = s.Set([]byte("key"), []byte("value"), 0)
+	assert.NoError(t, err)
+	err = s.Close()
+	assert.NoError(t, err)
+
+	// flip bit in value
+	f, err := os.OpenFile("1/0", os.O_RDWR, 0644)
+	assert.NoError(t, err)
+	b := make([]byte, 1)
+	_, err = f.ReadAt(b, int64(2+sizeHead))
+	assert.NoError(t, err)
+	b[0] ^= 1
+	_, err = f.WriteAt(b, int64(2+sizeHead))
+	assert.NoError(t, err)
+	f.Close()
+
+	s, err = Open(Dir("1"), ChunksCollision(0), ChunksTotal(1))
+	assert.NoError(t, err)
+	_, err = s.Get([]byte("key"))
+	assert.Equal(t, ErrCorrupted, err)
+	err = s.Touch([]byte("key"), 0)
+	assert.Equal(t, ErrCorrupted, err)
+
+	// damaged record is not copied by compaction, old file is kept
+	err = s.Set([]byte("key2"), []byte("value"), 0)
+	assert.NoError(t, err)
+	_, err = s.Delete([]byte("key2"))
 	assert.NoError(t, err)
+	err = s.Compact()
+	assert.True(t, errors.Is(err, ErrCorrupted))
+	_, err = os.Stat("1/0.compact")
+	assert.True(t, os.IsNotExist(err))
+	_, err = s.Get([]byte("key"))
+	assert.Equal(t, ErrCorrupted, err)
+
+	// damaged record may be overwritten
+	err = s.Set([]byte("key"), []byte("value"), 0)
+	assert.NoError(t, err)
+	v, err := s.Get([]byte("key"))
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("value"), v)
+
+	err = s.Close()
+	assert.NoError(t, err)
+	err = DeleteStore("1")
+	assert.NoError(t, err)
+}
+
+func TestUpgrade(t *testing.T) {
+	err := DeleteStore("1")
+	assert.NoError(t, err)
+	err = os.MkdirAll("1", 0755)
+	assert.NoError(t, err)
+
+	// chunk in v1 format
+	chunkv1 := []byte{versionMarker, 1}
+	for _, kv := range [][2]string{{"key1", "val1"}, {"key2", "val2"}} {
+		rec := make([]byte, 32)
+		rec[0] = 5
+		binary.BigEndian.PutUint16(rec[2:4], uint16(len(kv[0])))
+		binary.BigEndian.PutUint32(rec[4:8], uint32(len(kv[1])))
+		copy(rec[12:], kv[1])
+		copy(rec[12+len(kv[1]):], kv[0])
+		chunkv1 = append(chunkv1, rec...)
+	}
+	err = os.WriteFile("1/0", chunkv1, 0644)
+	assert.NoError(t, err)
+
+	s, err := Open(Dir("1"), ChunksCollision(0), ChunksTotal(1))
+	assert.NoError(t, err)
+	assert.Equal(t, 2, s.Count())
+	v, err := s.Get([]byte("key1"))
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("val1"), v)
+	v, err = s.Get([]byte("key2"))
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("val2"), v)
+	err = s.Close()
+	assert.NoError(t, err)
+
+	b, err := os.ReadFile("1/0")
+	assert.NoError(t, err)
+	assert.Equal(t, byte(currentChunkVersion), b[1])
+
+	err = DeleteStore("1")
+	assert.NoError(t, err)
+	err = os.MkdirAll("1", 0755)
+	assert.NoError(t, err)
+
+	// chunk in v2 format, value of key2 is damaged
+	chunkv2 := []byte{versionMarker, 2}
+	for _, kv := range [][2]string{{"key1", "val1"}, {"key2", "val2"}} {
+		rec := make([]byte, 32)
+		header := &Header{sizeb: 5, keylen: uint16(len(kv[0])), vallen: uint32(len(kv[1]))}
+		copy(rec[16:], kv[1])
+		copy(rec[16+len(kv[1]):], kv[0])
+		binary.BigEndian.PutUint32(rec[12:16], checksum(header, rec[16:16+len(kv[0])+len(kv[1])], 2))
+		rec[0] = header.sizeb
+		binary.BigEndian.PutUint16(rec[2:4], header.keylen)
+		binary.BigEndian.PutUint32(rec[4:8], header.vallen)
+		chunkv2 = append(chunkv2, rec...)
+	}
+	chunkv2[2+32+16] ^= 1
+	err = os.WriteFile("1/0", chunkv2, 0644)
+	assert.NoError(t, err)
+
+	// damaged record is not sealed with new checksum, upgrade wait for repair
+	_, err = Open(Dir("1"), ChunksCollision(0), ChunksTotal(1))
+	assert.True(t, errors.Is(err, ErrFormat))
+	b, err = os.ReadFile("1/0")
+	assert.NoError(t, err)
+	assert.Equal(t, chunkv2, b)
+	_, err = os.Stat("1/0.new")
+	assert.True(t, os.IsNotExist(err))
+
+	report, err := Repair("1", false)
+	assert.NoError(t, err)
+	if assert.Equal(t, 1, len(report.Problems)) {
+		assert.Equal(t, ProblemChecksum, report.Problems[0].Kind)
+	}
+	s, err = Open(Dir("1"), ChunksCollision(0), ChunksTotal(1))
+	assert.NoError(t, err)
+	assert.Equal(t, 1, s.Count())
+	v, err = s.Get([]byte("key1"))
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("val1"), v)
+	_, err = s.Get([]byte("key2"))
+	assert.Equal(t, ErrNotFound, err)
+	err = s.Close()
+	assert.NoError(t, err)
+
+	err = DeleteStore("1")
+	assert.NoError(t, err)
+}
+
+func TestVerify(t *testing.T) {
+	err := DeleteStore("1")
+	assert.NoError(t, err)
+
+	s, err := Open(Dir("1"), ChunksCollision(0), ChunksTotal(1))
+	assert.NoError(t, err)
+	for i := 0; i < 100; i++ {
+		err = s.Set([]byte(fmt.Sprintf("key%d", i)), []byte("val"), 0)
+		assert.NoError(t, err)
+	}
+	_, err = s.Delete([]byte("key0"))
+	assert.NoError(t, err)
+	err = s.Close()
+	assert.NoError(t, err)
+
+	report, err := Verify("1")
+	assert.NoError(t, err)
+	assert.True(t, report.OK())
+	assert.Equal(t, 1, report.Files)
+	assert.Equal(t, 99, report.Records)
+	assert.Equal(t, 1, report.Holes)
+
+	// damage value of key1 and add garbage tail
+	f, err := os.OpenFile("1/0", os.O_RDWR, 0644)
+	assert.NoError(t, err)
+	_, err = f.WriteAt([]byte{0xff}, int64(2+32+sizeHead))
+	assert.NoError(t, err)
+	fi, err := f.Stat()
+	assert.NoError(t, err)
+	_, err = f.WriteAt([]byte{5, 0, 0}, fi.Size())
+	assert.NoError(t, err)
+	f.Close()
+
+	_, err = Open(Dir("1"), ChunksCollision(0), ChunksTotal(1))
+	assert.Error(t, err)
+
+	report, err = Verify("1")
+	assert.NoError(t, err)
+	if assert.Equal(t, 2, len(report.Problems)) {
+		assert.Equal(t, ProblemChecksum, report.Problems[0].Kind)
+		assert.Equal(t, ProblemTail, report.Problems[1].Kind)
+	}
+
+	report, err = Repair("1", false)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, len(report.Problems))
+	report, err = Verify("1")
+	assert.NoError(t, err)
+	assert.True(t, report.OK())
+	assert.Equal(t, 98, report.Records)
+
+	s, err = Open(Dir("1"), ChunksCollision(0), ChunksTotal(1))
+	assert.NoError(t, err)
+	assert.Equal(t, 98, s.Count())
+	err = s.Close()
+	assert.NoError(t, err)
+
+	// salvage keep live records only
+	f, err = os.OpenFile("1/0", os.O_RDWR|os.O_APPEND, 0644)
+	assert.NoError(t, err)
+	_, err = f.Write(append([]byte{5, 7}, make([]byte, 30)...))
+	assert.NoError(t, err)
+	f.Close()
+	report, err = Repair("1", true)
+	assert.NoError(t, err)
+	if assert.Equal(t, 1, len(report.Problems)) {
+		assert.Equal(t, ProblemHeader, report.Problems[0].Kind)
+	}
+	report, err = Verify("1")
+	assert.NoError(t, err)
+	assert.True(t, report.OK())
+	assert.Equal(t, 98, report.Records)
+	assert.Equal(t, 0, report.Holes)
+
+	err = DeleteStore("1")
+	assert.NoError(t, err)
+}
+
+func TestVerifyFS(t *testing.T) {
+	fs := NewMemFS()
+	opts := []OptStore{FS(fs), Dir("db"), ChunksPrefix("p"), ChunksCollision(0), ChunksTotal(2)}
+	s, err := Open(opts...)
+	assert.NoError(t, err)
+	for i := 0; i < 100; i++ {
+		err = s.Set([]byte(fmt.Sprintf("key%d", i)), []byte("val"), 0)
+		assert.NoError(t, err)
+	}
+
+	// chunks are listed and locked through VFS
+	_, err = RepairFS(fs, "db", false)
+	assert.Equal(t, ErrLocked, err)
+	err = s.Close()
+	assert.NoError(t, err)
+	report, err := VerifyFS(fs, "db")
+	assert.NoError(t, err)
+	assert.True(t, report.OK())
+	assert.Equal(t, 2, report.Files)
+	assert.Equal(t, 100, report.Records)
+
+	f, err := fs.OpenFile("db/p-1", os.O_WRONLY|os.O_APPEND, 0644)
+	assert.NoError(t, err)
+	_, err = f.Write([]byte{5, 0, 0})
+	assert.NoError(t, err)
+	f.Close()
+	report, err = VerifyFS(fs, "db")
+	assert.NoError(t, err)
+	if assert.Equal(t, 1, len(report.Problems)) {
+		assert.Equal(t, ProblemTail, report.Problems[0].Kind)
+	}
+	_, err = RepairFS(fs, "db", false)
+	assert.NoError(t, err)
+	report, err = VerifyFS(fs, "db")
+	assert.NoError(t, err)
+	assert.True(t, report.OK())
+
+	s, err = Open(opts...)
+	assert.NoError(t, err)
+	assert.Equal(t, 100, s.Count())
+	err = s.Close()
+	assert.NoError(t, err)
+}
+
+func TestVerifyBlob(t *testing.T) {
+	err := DeleteStore("1")
+	assert.NoError(t, err)
+
+	s, err := Open(Dir("1"), ChunksCollision(0), ChunksTotal(1))
+	assert.NoError(t, err)
+	assert.NoError(t, s.Set([]byte("big"), make([]byte, 3*blobExtent), 0))
+	assert.NoError(t, s.Set([]byte("small"), []byte("val"), 0))
+	assert.NoError(t, s.Close())
+
+	// blob value is lost, as by crash before its fsync
+	assert.NoError(t, os.Truncate("1/0.blob", blobExtent))
+	s, err = Open(Dir("1"), ChunksCollision(0), ChunksTotal(1))
+	assert.NoError(t, err)
+	_, err = s.Get([]byte("big"))
+	assert.Equal(t, ErrCorrupted, err)
+	assert.NoError(t, s.Close())
+
+	report, err := Verify("1")
+	assert.NoError(t, err)
+	if assert.Equal(t, 1, len(report.Problems)) {
+		assert.Equal(t, ProblemBlob, report.Problems[0].Kind)
+	}
+	_, err = Repair("1", false)
+	assert.NoError(t, err)
+	s, err = Open(Dir("1"), ChunksCollision(0), ChunksTotal(1))
+	assert.NoError(t, err)
+	_, err = s.Get([]byte("big"))
+	assert.Equal(t, ErrNotFound, err)
+	v, err := s.Get([]byte("small"))
+	assert.NoError(t, err)
+	assert.Equal(t, "val", string(v))
+	assert.NoError(t, s.Close())
+
+	err = DeleteStore("1")
+	assert.NoError(t, err)
+}
+
+func TestVerifyHoles(t *testing.T) {
+	err := DeleteStore("1")
+	assert.NoError(t, err)
+
+	s, err := Open(Dir("1"), ChunksCollision(0), ChunksTotal(1))
+	assert.NoError(t, err)
+	for i := 0; i < 10; i++ {
+		assert.NoError(t, s.Set([]byte(fmt.Sprintf("key%d", i)), []byte("val"), 0))
+	}
+	_, err = s.Delete([]byte("key0"))
+	assert.NoError(t, err)
+	assert.NoError(t, s.Close())
+	report, err := Verify("1")
+	assert.NoError(t, err)
+	assert.True(t, report.OK())
+
+	// hint with holes over live record and after end of chunk
+	b, err := os.ReadFile("1/0.hint")
+	assert.NoError(t, err)
+	hd, ok := parseHint(b)
+	assert.True(t, ok)
+	assert.Equal(t, 1, len(hd.holes))
+	for _, meta := range hd.keys {
+		addr, size, _ := decodeKeyMeta(meta)
+		hd.holes[addr] = size
+		break
+	}
+	hd.holes[hd.covered] = 5
+	c := &chunk{m: hd.keys, h: hd.holes, lastVer: hd.lastVer, blobEnd: hd.blobEnd, blobFree: hd.free}
+	assert.NoError(t, os.WriteFile("1/0.hint", c.marshalHint(int64(hd.covered), hd.crc), 0644))
+
+	report, err = Verify("1")
+	assert.NoError(t, err)
+	if assert.Equal(t, 2, len(report.Problems)) {
+		assert.Equal(t, ProblemHole, report.Problems[0].Kind)
+		assert.Equal(t, int64(hd.covered), report.Problems[1].Offset)
+	}
+	report, err = Repair("1", false)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, len(report.Problems))
+	_, err = os.Stat("1/0.hint")
+	assert.True(t, os.IsNotExist(err))
+	report, err = Verify("1")
+	assert.NoError(t, err)
+	assert.True(t, report.OK())
+	assert.Equal(t, 9, report.Records)
+
+	err = DeleteStore("1")
+	assert.NoError(t, err)
+}
+
+func TestBlob(t *testing.T) {
+	err := DeleteStore("1")
+	assert.NoError(t, err)
+	err = DeleteStore("2")
+	assert.NoError(t, err)
+
+	s, err := Open(Dir("1"))
+	assert.NoError(t, err)
+
+	big := make([]byte, 3<<20+5)
+	rand.Read(big)
+	k := []byte("big")
+	err = s.Set(k, big, 0)
+	assert.NoError(t, err)
+	err = s.Set([]byte("small"), []byte("val"), 0)
+	assert.NoError(t, err)
+	v, err := s.Get(k)
+	assert.NoError(t, err)
+	assert.Equal(t, big, v)
+	size, err := s.FileSize()
+	assert.NoError(t, err)
+	assert.True(t, size < int64(len(big))+int64(len(big))/4)
+
+	// overwrite
+	big2 := make([]byte, 1<<20)
+	rand.Read(big2)
+	err = s.Set(k, big2, 0)
+	assert.NoError(t, err)
+	v, err = s.Get(k)
+	assert.NoError(t, err)
+	assert.Equal(t, big2, v)
+	size2, err := s.FileSize()
+	assert.NoError(t, err)
+	assert.True(t, size2 <= size+int64(len(big2))+blobExtent+1<<10)
+
+	// reopen
+	err = s.Close()
+	assert.NoError(t, err)
+	s, err = Open(Dir("1"))
+	assert.NoError(t, err)
+	v, err = s.Get(k)
+	assert.NoError(t, err)
+	assert.Equal(t, big2, v)
+	var got []byte
+	err = s.Range(func(key, val []byte, expire uint32) bool {
+		if bytes.Equal(key, k) {
+			got = val
+		}
+		return true
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, big2, got)
+
+	// backup / restore
+	var buf bytes.Buffer
+	err = s.Backup(&buf)
+	assert.NoError(t, err)
+	s2, err := Open(Dir("2"))
+	assert.NoError(t, err)
+	err = s2.Restore(&buf)
+	assert.NoError(t, err)
+	v, err = s2.Get(k)
+	assert.NoError(t, err)
+	assert.Equal(t, big2, v)
+	assert.Equal(t, 2, s2.Count())
+	err = s2.Close()
+	assert.NoError(t, err)
+
+	deleted, err := s.Delete(k)
+	assert.NoError(t, err)
+	assert.True(t, deleted)
+	_, err = s.Get(k)
+	assert.Equal(t, ErrNotFound, err)
+	// free extents are reused
+	err = s.Set(k, big, 0)
+	assert.NoError(t, err)
+	size3, err := s.FileSize()
+	assert.NoError(t, err)
+	assert.True(t, size3 <= size2+blobExtent)
+	err = s.Close()
+	assert.NoError(t, err)
+
+	report, err := Verify("1")
+	assert.NoError(t, err)
+	assert.True(t, report.OK())
+
+	err = DeleteStore("1")
+	assert.NoError(t, err)
+	err = DeleteStore("2")
+	assert.NoError(t, err)
+}
+
+func TestManifest(t *testing.T) {
+	err := DeleteStore("1")
+	assert.NoError(t, err)
+
+	s, err := Open(Dir("1"), ChunksTotal(10), ChunksCollision(2))
+	assert.NoError(t, err)
+	err = s.Set([]byte("key"), []byte("val"), 0)
+	assert.NoError(t, err)
+	err = s.Close()
+	assert.NoError(t, err)
+
+	// options are taken from manifest
+	s, err = Open(Dir("1"))
+	assert.NoError(t, err)
+	assert.Equal(t, 10, s.chunksCnt)
+	assert.Equal(t, 2, s.chunkColCnt)
+	v, err := s.Get([]byte("key"))
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("val"), v)
+	err = s.Close()
+	assert.NoError(t, err)
+
+	_, err = Open(Dir("1"), ChunksTotal(20))
+	assert.True(t, errors.Is(err, ErrManifest))
+	_, err = Open(Dir("1"), ChunksTotal(10), ChunksCollision(4))
+	assert.True(t, errors.Is(err, ErrManifest))
+
+	// store without manifest, created by old version
+	err = os.Remove("1/MANIFEST")
+	assert.NoError(t, err)
+	_, err = Open(Dir("1"), ChunksTotal(5), ChunksCollision(2))
+	assert.True(t, errors.Is(err, ErrManifest))
+	s, err = Open(Dir("1"), ChunksTotal(10), ChunksCollision(2))
+	assert.NoError(t, err)
+	err = s.Close()
+	assert.NoError(t, err)
+	_, err = os.Stat("1/MANIFEST")
+	assert.NoError(t, err)
+
+	// store with less chunks then default, created by old version
+	err = DeleteStore("1")
+	assert.NoError(t, err)
+	s, err = Open(Dir("1"), ChunksTotal(16), ChunksCollision(2))
+	assert.NoError(t, err)
+	err = s.Set([]byte("key"), []byte("val"), 0)
+	assert.NoError(t, err)
+	err = s.Close()
+	assert.NoError(t, err)
+	err = os.Remove("1/MANIFEST")
+	assert.NoError(t, err)
+	_, err = Open(Dir("1"))
+	assert.True(t, errors.Is(err, ErrManifest))
+	_, err = Open(Dir("1"), ReadOnly())
+	assert.True(t, errors.Is(err, ErrManifest))
+	_, err = os.Stat("1/MANIFEST")
+	assert.True(t, os.IsNotExist(err))
+	s, err = Open(Dir("1"), ChunksTotal(16), ChunksCollision(2))
+	assert.NoError(t, err)
+	v, err = s.Get([]byte("key"))
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("val"), v)
+	err = s.Close()
+	assert.NoError(t, err)
+
+	err = DeleteStore("1")
+	assert.NoError(t, err)
+}
+
+func TestReshard(t *testing.T) {
+	err := DeleteStore("1")
+	assert.NoError(t, err)
+	s, err := Open(Dir("1"), ChunksTotal(16), ChunksCollision(2), ChunksPrefix("p"))
+	assert.NoError(t, err)
+	for i := 0; i < 1000; i++ {
+		err = s.Set([]byte(fmt.Sprintf("key%d", i)), []byte(fmt.Sprintf("val%d", i)), 0)
+		assert.NoError(t, err)
+	}
+	big := make([]byte, 200<<10)
+	rand.Read(big)
+	err = s.Set([]byte("big"), big, 0)
+	assert.NoError(t, err)
+	bucket, err := s.Bucket("b")
+	assert.NoError(t, err)
+	err = s.Put(bucket, []byte("k"), []byte("v"))
+	assert.NoError(t, err)
+	_, meta, err := s.GetWithMeta([]byte("key500"))
+	assert.NoError(t, err)
+
+	check := func(s *Store, total, collision int) {
+		assert.Equal(t, total, s.chunksCnt)
+		assert.Equal(t, collision, s.chunkColCnt)
+		assert.Equal(t, 1003, s.Count())
+		// records keep versions
+		v, m, err := s.GetWithMeta([]byte("key500"))
+		assert.NoError(t, err)
+		assert.Equal(t, []byte("val500"), v)
+		assert.Equal(t, meta.Version, m.Version)
+		v, err = s.Get([]byte("big"))
+		assert.NoError(t, err)
+		assert.Equal(t, big, v)
+		bucket, err := s.LookupBucket("b")
+		assert.NoError(t, err)
+		assert.Equal(t, []string{"k"}, s.Keys(bucket, 0, 0))
+	}
+
+	// open store is resharded, open iterator is stopped
+	it := s.Iterator()
+	assert.True(t, it.Next())
+	err = s.Reshard(64, 4)
+	assert.NoError(t, err)
+	assert.False(t, it.Next())
+	assert.Equal(t, ErrResharded, it.Err())
+	it.Close()
+	check(s, 64, 4)
+	_, err = os.Stat("1/p-0")
+	assert.True(t, os.IsNotExist(err))
+	_, err = os.Stat("1/p-0.g1")
+	assert.NoError(t, err)
+	_, err = os.Stat("1/p-0.g1.blob")
+	if err != nil {
+		// big value may be in other chunk
+		_, err = os.Stat("1/p-1.g1")
+	}
+	assert.NoError(t, err)
+	err = s.Close()
+	assert.NoError(t, err)
+
+	_, err = Open(Dir("1"), ChunksPrefix("p"), ChunksTotal(16))
+	assert.True(t, errors.Is(err, ErrManifest))
+	s, err = Open(Dir("1"), ChunksPrefix("p"))
+	assert.NoError(t, err)
+	check(s, 64, 4)
+	err = s.Close()
+	assert.NoError(t, err)
+
+	// closed store is resharded in place
+	err = Reshard("1", 32, 0, ChunksPrefix("p"))
+	assert.NoError(t, err)
+	_, err = os.Stat("1/p-0.g1")
+	assert.True(t, os.IsNotExist(err))
+
+	// files of reshard, which is not recorded in manifest, are removed on open
+	for _, name := range []string{"1/p-0.g3", "1/p-0.g3.hint", "1/p-1.g3"} {
+		err = os.WriteFile(name, []byte{versionMarker, currentChunkVersion}, fileMode)
+		assert.NoError(t, err)
+	}
+	s, err = Open(Dir("1"), ChunksPrefix("p"))
+	assert.NoError(t, err)
+	check(s, 32, 0)
+	for _, name := range []string{"1/p-0.g3", "1/p-0.g3.hint", "1/p-1.g3"} {
+		_, err = os.Stat(name)
+		assert.True(t, os.IsNotExist(err), name)
+	}
+	err = s.Close()
+	assert.NoError(t, err)
+	report, err := Verify("1")
+	assert.NoError(t, err)
+	assert.Equal(t, 32, report.Files)
+	assert.True(t, report.OK())
+
+	err = DeleteStore("1")
+	assert.NoError(t, err)
+}
+
+// TestReshardWrites - writes, which run together with Reshard, must be in new chunks
+func TestReshardWrites(t *testing.T) {
+	for _, mode := range []DurabilityMode{0, SyncEveryWrite} {
+		fs := NewMemFS()
+		opts := []OptStore{Dir("1"), FS(fs)}
+		if mode != 0 {
+			opts = append(opts, Durability(mode))
+		}
+		s, err := Open(append(opts, ChunksTotal(8), ChunksCollision(1))...)
+		assert.NoError(t, err)
+		const keys, writers = 20000, 4
+		for i := 0; i < keys; i++ {
+			err = s.Set([]byte(strconv.Itoa(i)), []byte("v"), 0)
+			assert.NoError(t, err)
+		}
+
+		models := make([]map[string]string, writers)
+		incrs := make([]int, writers)
+		done := make(chan struct{})
+		var writes int64
+		var wg sync.WaitGroup
+		for w := 0; w < writers; w++ {
+			models[w] = make(map[string]string)
+			wg.Add(1)
+			go func(w int, model map[string]string) {
+				defer wg.Done()
+				rnd := rand.New(rand.NewSource(int64(w)))
+				for n := 0; ; n++ {
+					select {
+					case <-done:
+						return
+					default:
+					}
+					atomic.AddInt64(&writes, 1)
+					// writer own every writers-th key
+					k := strconv.Itoa(rnd.Intn(keys/writers)*writers + w)
+					var err error
+					switch rnd.Intn(4) {
+					case 0:
+						_, err = s.Delete([]byte(k))
+						model[k] = ""
+					case 1:
+						_, err = s.Incr([]byte("cnt"+strconv.Itoa(w)), 1)
+						incrs[w]++
+					default:
+						err = s.Set([]byte(k), []byte(strconv.Itoa(n)), 0)
+						model[k] = strconv.Itoa(n)
+					}
+					if err != nil {
+						t.Error(err)
+						return
+					}
+				}
+			}(w, models[w])
+		}
+		for atomic.LoadInt64(&writes) < 100 {
+			time.Sleep(time.Millisecond)
+		}
+		before := atomic.LoadInt64(&writes)
+		err = s.Reshard(32, 2)
+		during := atomic.LoadInt64(&writes) - before
+		close(done)
+		wg.Wait()
+		assert.NoError(t, err)
+		assert.True(t, during > 0, "no writes while resharded")
+
+		check := func(s *Store) {
+			assert.Equal(t, 32, s.chunksCnt)
+			for w, model := range models {
+				for k, want := range model {
+					v, err := s.Get([]byte(k))
+					if want == "" {
+						assert.Equal(t, ErrNotFound, err, k)
+					} else {
+						assert.Equal(t, want, string(v), k)
+					}
+				}
+				if incrs[w] > 0 {
+					v, err := s.Get([]byte("cnt" + strconv.Itoa(w)))
+					assert.NoError(t, err)
+					assert.Equal(t, binaryUint(uint64(incrs[w])), v)
+				}
+			}
+		}
+		check(s)
+		err = s.Close()
+		assert.NoError(t, err)
+		s, err = Open(opts...)
+		assert.NoError(t, err)
+		check(s)
+		err = s.Close()
+		assert.NoError(t, err)
+	}
+}
+
+func TestLock(t *testing.T) {
+	err := DeleteStore("1")
+	assert.NoError(t, err)
+	s, err := Open(Dir("1"))
+	assert.NoError(t, err)
+	_, err = Open(Dir("1"))
+	assert.Equal(t, ErrLocked, err)
+	_, err = Open(Dir("1"), ReadOnly())
+	assert.Equal(t, ErrLocked, err)
+	_, err = Repair("1", false)
+	assert.Equal(t, ErrLocked, err)
+	err = s.Close()
+	assert.NoError(t, err)
+
+	// many readers
+	r1, err := Open(Dir("1"), ReadOnly())
+	assert.NoError(t, err)
+	r2, err := Open(Dir("1"), ReadOnly())
+	assert.NoError(t, err)
+	_, err = Open(Dir("1"))
+	assert.Equal(t, ErrLocked, err)
+	assert.NoError(t, r1.Close())
+	assert.NoError(t, r2.Close())
+
+	// reader create missing LOCK file, writer see its lock
+	assert.NoError(t, os.Remove("1/LOCK"))
+	r1, err = Open(Dir("1"), ReadOnly())
+	assert.NoError(t, err)
+	_, err = Open(Dir("1"))
+	assert.Equal(t, ErrLocked, err)
+	assert.NoError(t, r1.Close())
+
+	s, err = Open(Dir("1"))
+	assert.NoError(t, err)
+	err = s.Close()
+	assert.NoError(t, err)
+	err = DeleteStore("1")
+	assert.NoError(t, err)
+}
+
+func TestReadOnly(t *testing.T) {
+	err := DeleteStore("1")
+	assert.NoError(t, err)
+	s, err := Open(Dir("1"))
+	assert.NoError(t, err)
+	assert.NoError(t, s.Set([]byte("key"), []byte("val"), 0))
+	assert.NoError(t, s.Set([]byte("expire"), []byte("val"), uint32(time.Now().Unix()+1)))
+	bucket, err := s.Bucket("b")
+	assert.NoError(t, err)
+	assert.NoError(t, s.Put(bucket, []byte("k"), []byte("v")))
+	assert.NoError(t, s.Close())
+	size := func() (sum int64) {
+		files, _ := os.ReadDir("1")
+		for _, f := range files {
+			fi, _ := f.Info()
+			sum += fi.Size()
+		}
+		return
+	}
+	before := size()
+
+	s, err = Open(Dir("1"), ReadOnly())
+	assert.NoError(t, err)
+	v, err := s.Get([]byte("key"))
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("val"), v)
+	bucket, err = s.Bucket("b")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"k"}, s.Keys(bucket, 0, 0))
+
+	time.Sleep(time.Second * 2)
+	_, err = s.Get([]byte("expire"))
+	assert.Equal(t, ErrNotFound, err)
+	// expired key stay in index
+	assert.Equal(t, 4, s.Count())
+
+	assert.Equal(t, ErrReadOnly, s.Set([]byte("key"), []byte("new"), 0))
+	assert.Equal(t, ErrReadOnly, s.Touch([]byte("key"), 0))
+	_, err = s.Delete([]byte("key"))
+	assert.Equal(t, ErrReadOnly, err)
+	_, err = s.Incr([]byte("cnt"), 1)
+	assert.Equal(t, ErrReadOnly, err)
+	assert.Equal(t, ErrReadOnly, s.Put(bucket, []byte("k2"), []byte("v")))
+	b := &Batch{}
+	b.Set([]byte("key"), []byte("new"), 0)
+	assert.Equal(t, ErrReadOnly, s.Write(b))
+	assert.Equal(t, ErrReadOnly, s.Compact())
+	assert.Equal(t, ErrReadOnly, s.Expire())
+	_, err = s.Bucket("new")
+	assert.Equal(t, ErrReadOnly, err)
+	assert.NoError(t, s.Close())
+	assert.Equal(t, before, size())
+
+	// batch, interrupted by crash, must be finished by writer
+	err = os.WriteFile("1/batch.log", frameRecord(encodeOps(b.ops)), 0644)
+	assert.NoError(t, err)
+	_, err = Open(Dir("1"), ReadOnly())
+	assert.True(t, errors.Is(err, ErrReadOnly))
+
+	err = DeleteStore("1")
+	assert.NoError(t, err)
+}
+
+func TestHint(t *testing.T) {
+	err := DeleteStore("1")
+	assert.NoError(t, err)
+	s, err := Open(Dir("1"), ChunksTotal(8), ChunksCollision(1))
+	assert.NoError(t, err)
+	big := bytes.Repeat([]byte("b"), blobThreshold*2)
+	for i := 0; i < 1000; i++ {
+		assert.NoError(t, s.Set([]byte(strconv.Itoa(i)), []byte(strconv.Itoa(i)), 0))
+	}
+	assert.NoError(t, s.Set([]byte("big"), big, 0))
+	for i := 0; i < 100; i++ {
+		_, err = s.Delete([]byte(strconv.Itoa(i)))
+		assert.NoError(t, err)
+	}
+	assert.NoError(t, s.Close())
+
+	s, err = Open(Dir("1"))
+	assert.NoError(t, err)
+	hinted := make([]map[uint32]keyMeta, len(s.chunks))
+	for i := range s.chunks {
+		// empty chunk has no hint
+		assert.Equal(t, len(s.chunks[i].m) > 0, s.chunks[i].hinted)
+		hinted[i] = make(map[uint32]keyMeta)
+		for h, meta := range s.chunks[i].m {
+			hinted[i][h] = meta
+		}
+	}
+	assert.Equal(t, 901, s.Count())
+	v, err := s.Get([]byte("big"))
+	assert.NoError(t, err)
+	assert.Equal(t, big, v)
+	// append after hint, store is not closed
+	assert.NoError(t, s.Set([]byte("new"), []byte("new"), 0))
+	for i := range s.chunks {
+		c := &s.chunks[i]
+		assert.NoError(t, c.sync())
+		c.f.Close()
+		if c.blob != nil {
+			c.blob.Close()
+		}
+	}
+	s.batchf.Close()
+	s.bucketf.Close()
+	assert.NoError(t, s.closeLock())
+
+	// records appended after hint are scanned
+	s, err = Open(Dir("1"))
+	assert.NoError(t, err)
+	v, err = s.Get([]byte("new"))
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("new"), v)
+	assert.Equal(t, 902, s.Count())
+	// change inside hinted part remove hint
+	_, err = s.Delete([]byte("new"))
+	assert.NoError(t, err)
+	_, err = os.Stat(hintName(s.chunks[s.idx(hash([]byte("new")))].name))
+	assert.True(t, os.IsNotExist(err))
+	assert.NoError(t, s.Close())
+
+	// damaged hint is ignored, index is same as after full scan
+	name := hintName(s.filename("3"))
+	b, err := os.ReadFile(name)
+	assert.NoError(t, err)
+	b[len(b)/2] ^= 0xff
+	assert.NoError(t, os.WriteFile(name, b, 0644))
+	s, err = Open(Dir("1"))
+	assert.NoError(t, err)
+	assert.False(t, s.chunks[3].hinted)
+	for i := range s.chunks {
+		assert.Equal(t, hinted[i], s.chunks[i].m)
+	}
+	assert.NoError(t, s.Close())
+
+	err = DeleteStore("1")
+	assert.NoError(t, err)
+}
+
+func TestMemFS(t *testing.T) {
+	fs := NewMemFS()
+	s, err := Open(Dir("mem"), FS(fs), Durability(SyncEveryWrite))
+	assert.NoError(t, err)
+	_, err = Open(Dir("mem"), FS(fs))
+	assert.Equal(t, ErrLocked, err)
+	big := bytes.Repeat([]byte("b"), blobThreshold*3)
+	for i := 0; i < 1000; i++ {
+		assert.NoError(t, s.Set([]byte(strconv.Itoa(i)), []byte(strconv.Itoa(i)), 0))
+	}
+	assert.NoError(t, s.Set([]byte("big"), big, 0))
+	for i := 0; i < 500; i++ {
+		_, err = s.Delete([]byte(strconv.Itoa(i)))
+		assert.NoError(t, err)
+	}
+	b := &Batch{}
+	b.Set([]byte("batch"), []byte("v"), 0)
+	b.Incr([]byte("cnt"), 5)
+	assert.NoError(t, s.Write(b))
+	assert.NoError(t, s.Compact())
+	assert.NoError(t, s.Close())
+	_, err = os.Stat("mem")
+	assert.True(t, os.IsNotExist(err))
+
+	s, err = Open(Dir("mem"), FS(fs))
+	assert.NoError(t, err)
+	assert.Equal(t, 503, s.Count())
+	v, err := s.Get([]byte("big"))
+	assert.NoError(t, err)
+	assert.Equal(t, big, v)
+	v, err = s.Get([]byte("999"))
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("999"), v)
+	_, err = s.Get([]byte("1"))
+	assert.Equal(t, ErrNotFound, err)
+	assert.NoError(t, s.Close())
+	assert.Contains(t, fs.Names(), "mem/MANIFEST")
+	assert.NoError(t, fs.RemoveAll("mem"))
+	assert.NotContains(t, fs.Names(), "mem/MANIFEST")
+}
+
+func TestCompareAndSwap(t *testing.T) {
+	fs := NewMemFS()
+	s, err := Open(Dir("cas"), FS(fs), Durability(GroupCommit))
+	assert.NoError(t, err)
+	k := []byte("k")
+
+	isSet, err := s.SetXX(k, []byte("1"), 0)
+	assert.NoError(t, err)
+	assert.False(t, isSet)
+	isSet, err = s.SetNX(k, []byte("1"), 0)
+	assert.NoError(t, err)
+	assert.True(t, isSet)
+	isSet, err = s.SetNX(k, []byte("2"), 0)
+	assert.NoError(t, err)
+	assert.False(t, isSet)
+	isSet, err = s.SetXX(k, []byte("2"), 0)
+	assert.NoError(t, err)
+	assert.True(t, isSet)
+
+	swapped, err := s.CompareAndSwap(k, []byte("1"), []byte("3"), 0)
+	assert.NoError(t, err)
+	assert.False(t, swapped)
+	swapped, err = s.CompareAndSwap(k, []byte("2"), []byte("3"), 0)
+	assert.NoError(t, err)
+	assert.True(t, swapped)
+	swapped, err = s.CompareAndSwap([]byte("absent"), nil, []byte("3"), 0)
+	assert.NoError(t, err)
+	assert.False(t, swapped)
+
+	old, err := s.GetAndSet(k, []byte("4"), 0)
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("3"), old)
+	// absent key is set, old value is nil
+	old, err = s.GetAndSet([]byte("new"), []byte("v"), 0)
+	assert.NoError(t, err)
+	assert.Nil(t, old)
+	v, err := s.Get([]byte("new"))
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("v"), v)
+
+	// expired key is absent
+	assert.NoError(t, s.Set([]byte("exp"), []byte("1"), uint32(time.Now().Unix()-1)))
+	isSet, err = s.SetNX([]byte("exp"), []byte("2"), 0)
+	assert.NoError(t, err)
+	assert.True(t, isSet)
+
+	// concurrent increments with compare and swap
+	var wg sync.WaitGroup
+	cnt := []byte("cnt")
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				for {
+					old, err := s.Get(cnt)
+					if err == ErrNotFound {
+						isSet, err := s.SetNX(cnt, []byte("1"), 0)
+						assert.NoError(t, err)
+						if isSet {
+							break
+						}
+						continue
+					}
+					assert.NoError(t, err)
+					n, _ := strconv.Atoi(string(old))
+					swapped, err := s.CompareAndSwap(cnt, old, []byte(strconv.Itoa(n+1)), 0)
+					assert.NoError(t, err)
+					if swapped {
+						break
+					}
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	v, err = s.Get(cnt)
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("800"), v)
+	assert.NoError(t, s.Close())
+
+	s, err = Open(Dir("cas"), FS(fs), ReadOnly())
+	assert.NoError(t, err)
+	_, err = s.SetNX([]byte("ro"), []byte("v"), 0)
+	assert.Equal(t, ErrReadOnly, err)
+	v, err = s.Get(k)
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("4"), v)
+	assert.NoError(t, s.Close())
+}
+
+func TestIncrInt(t *testing.T) {
+	s, err := Open(Dir("1"), FS(NewMemFS()), ChunksCollision(0), ChunksTotal(1))
+	assert.NoError(t, err)
+
+	n, err := s.IncrInt([]byte("cnt"), 5)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(5), n)
+	n, err = s.IncrInt([]byte("cnt"), -7)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(-2), n)
+	v, err := s.Get([]byte("cnt"))
+	assert.NoError(t, err)
+	assert.Equal(t, "-2", string(v))
+
+	// counter set as string, expire is kept
+	expire := uint32(time.Now().Unix()) + 100
+	assert.NoError(t, s.Set([]byte("str"), []byte("10"), expire))
+	n, err = s.IncrInt([]byte("str"), 1)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(11), n)
+	_, meta, err := s.GetWithMeta([]byte("str"))
+	assert.NoError(t, err)
+	assert.Equal(t, expire, meta.Expire)
+
+	assert.NoError(t, s.Set([]byte("bad"), []byte("x"), 0))
+	_, err = s.IncrInt([]byte("bad"), 1)
+	assert.Equal(t, ErrNotNumber, err)
+	assert.NoError(t, s.Set([]byte("max"), []byte("9223372036854775807"), 0))
+	_, err = s.IncrInt([]byte("max"), 1)
+	assert.Equal(t, ErrOverflow, err)
+
+	// Incr, Decr, IncrInt and Batch.Incr share counter
+	u, err := s.Incr([]byte("mix"), 5)
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(5), u)
+	n, err = s.IncrInt([]byte("mix"), 2)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(7), n)
+	b := &Batch{}
+	b.Incr([]byte("mix"), 3)
+	assert.NoError(t, s.Write(b))
+	u, err = s.Decr([]byte("mix"), 1)
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(9), u)
+	// Incr keep counter in 8 bytes big endian, as older versions
+	v, err = s.Get([]byte("mix"))
+	assert.NoError(t, err)
+	if assert.Equal(t, 8, len(v)) {
+		assert.Equal(t, uint64(9), binary.BigEndian.Uint64(v))
+	}
+	_, err = s.Incr([]byte("bad"), 1)
+	assert.Equal(t, ErrNotNumber, err)
+	// counter, written by older Incr, is read by Incr and IncrInt,
+	// IncrInt rewrite it as decimal
+	legacy := make([]byte, 8)
+	binary.BigEndian.PutUint64(legacy, 41)
+	assert.NoError(t, s.Set([]byte("legacy"), legacy, 0))
+	u, err = s.Incr([]byte("legacy"), 1)
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(42), u)
+	v, err = s.Get([]byte("legacy"))
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(42), binary.BigEndian.Uint64(v))
+	n, err = s.IncrInt([]byte("legacy"), 1)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(43), n)
+	v, err = s.Get([]byte("legacy"))
+	assert.NoError(t, err)
+	assert.Equal(t, "43", string(v))
+	// 8 chars decimal is never legacy counter
+	assert.NoError(t, s.Set([]byte("dec8"), []byte("-1234567"), 0))
+	n, err = s.IncrInt([]byte("dec8"), 1)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(-1234566), n)
+
+	// Update return version of written record, value is kept if fn decline write
+	meta, err = s.Update([]byte("str"), func(old []byte, m *Meta) ([]byte, uint32, bool, error) {
+		return nil, 0, false, nil
+	})
+	assert.NoError(t, err)
+	_, cur, err := s.GetWithMeta([]byte("str"))
+	assert.NoError(t, err)
+	assert.Equal(t, cur, meta)
+	meta, err = s.Update([]byte("new"), func(old []byte, m *Meta) ([]byte, uint32, bool, error) {
+		assert.Nil(t, m)
+		return []byte("v"), 0, true, nil
+	})
+	assert.NoError(t, err)
+	_, cur, err = s.GetWithMeta([]byte("new"))
+	assert.NoError(t, err)
+	assert.Equal(t, cur, meta)
+
+	// concurrent increments are not lost
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				s.IncrInt([]byte("par"), 1)
+			}
+		}()
+	}
+	wg.Wait()
+	v, err = s.Get([]byte("par"))
+	assert.NoError(t, err)
+	assert.Equal(t, "800", string(v))
+	assert.NoError(t, s.Close())
+}
+
+func TestRecordVersion(t *testing.T) {
+	fs := NewMemFS()
+	s, err := Open(Dir("ver"), FS(fs))
+	assert.NoError(t, err)
+	k := []byte("k")
+
+	_, _, err = s.GetWithMeta(k)
+	assert.Equal(t, ErrNotFound, err)
+	isSet, err := s.SetIfVersion(k, []byte("1"), 1, 0)
+	assert.NoError(t, err)
+	assert.False(t, isSet)
+	// version 0 - key must be absent
+	isSet, err = s.SetIfVersion(k, []byte("1"), 0, 0)
+	assert.NoError(t, err)
+	assert.True(t, isSet)
+	v, meta, err := s.GetWithMeta(k)
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("1"), v)
+	assert.NotZero(t, meta.Version)
+	assert.Equal(t, 1, meta.Size)
+
+	// same value, new version: lost update is detected
+	assert.NoError(t, s.Set(k, []byte("1"), 0))
+	_, meta2, err := s.GetWithMeta(k)
+	assert.NoError(t, err)
+	assert.Greater(t, meta2.Version, meta.Version)
+	isSet, err = s.SetIfVersion(k, []byte("2"), meta.Version, 0)
+	assert.NoError(t, err)
+	assert.False(t, isSet)
+	isSet, err = s.SetIfVersion(k, []byte("2"), meta2.Version, 0)
+	assert.NoError(t, err)
+	assert.True(t, isSet)
+
+	// touch keep version
+	_, meta, _ = s.GetWithMeta(k)
+	expire := uint32(time.Now().Unix()) + 3600
+	assert.NoError(t, s.Touch(k, expire))
+	_, meta2, err = s.GetWithMeta(k)
+	assert.NoError(t, err)
+	assert.Equal(t, meta.Version, meta2.Version)
+	assert.Equal(t, expire, meta2.Expire)
+
+	// size of big value
+	big := make([]byte, blobThreshold*2)
+	assert.NoError(t, s.Set([]byte("big"), big, 0))
+	_, meta, err = s.GetWithMeta([]byte("big"))
+	assert.NoError(t, err)
+	assert.Equal(t, len(big), meta.Size)
+
+	// version survive compaction and reopen
+	_, meta, _ = s.GetWithMeta(k)
+	assert.NoError(t, s.Compact())
+	assert.NoError(t, s.Close())
+	for _, hint := range []bool{true, false} {
+		if !hint {
+			for _, name := range fs.Names() {
+				if strings.HasSuffix(name, ".hint") {
+					assert.NoError(t, fs.Remove(name))
+				}
+			}
+		}
+		s, err = Open(Dir("ver"), FS(fs))
+		assert.NoError(t, err)
+		_, meta2, err = s.GetWithMeta(k)
+		assert.NoError(t, err)
+		assert.Equal(t, meta.Version, meta2.Version)
+		// versions are not reused
+		assert.NoError(t, s.Set([]byte("new"), []byte("v"), 0))
+		_, meta2, err = s.GetWithMeta([]byte("new"))
+		assert.NoError(t, err)
+		assert.Greater(t, meta2.Version, meta.Version)
+		meta = meta2
+		k = []byte("new")
+		assert.NoError(t, s.Close())
+	}
+}
+
+func TestMulti(t *testing.T) {
+	fs := NewMemFS()
+	s, err := Open(Dir("multi"), FS(fs), ChunksTotal(8), ChunksCollision(1), Durability(GroupCommit))
+	assert.NoError(t, err)
+	// keys with same hash
+	coll1, coll2 := []byte("key76424"), []byte("key215300")
+	assert.Equal(t, hash(coll1), hash(coll2))
+
+	var pairs []KV
+	var keys [][]byte
+	for i := 0; i < 100; i++ {
+		k := []byte(fmt.Sprintf("k%d", i))
+		pairs = append(pairs, KV{Key: k, Value: []byte(strconv.Itoa(i))})
+		keys = append(keys, k)
+	}
+	pairs = append(pairs, KV{Key: coll1, Value: []byte("c1")}, KV{Key: coll2, Value: []byte("c2")})
+	keys = append(keys, coll1, coll2, []byte("absent"))
+	for _, err := range s.SetMulti(pairs) {
+		assert.NoError(t, err)
+	}
+
+	values, errs := s.GetMulti(keys)
+	for i := 0; i < 100; i++ {
+		assert.NoError(t, errs[i])
+		assert.Equal(t, []byte(strconv.Itoa(i)), values[i])
+	}
+	assert.Equal(t, []byte("c1"), values[100])
+	assert.Equal(t, []byte("c2"), values[101])
+	assert.Nil(t, values[102])
+	assert.Equal(t, ErrNotFound, errs[102])
+
+	deleted, errs := s.DeleteMulti([][]byte{[]byte("k1"), coll2, []byte("absent")})
+	assert.Equal(t, []bool{true, true, false}, deleted)
+	assert.Equal(t, []error{nil, nil, nil}, errs)
+	_, err = s.Get(coll2)
+	assert.Equal(t, ErrNotFound, err)
+	v, err := s.Get(coll1)
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("c1"), v)
+	assert.Equal(t, 100, s.Count())
+	assert.NoError(t, s.Close())
+
+	// operations are in write ahead log
+	s, err = Open(Dir("multi"), FS(fs), ReadOnly())
+	assert.NoError(t, err)
+	values, errs = s.GetMulti([][]byte{[]byte("k1"), []byte("k2"), coll1})
+	assert.Equal(t, [][]byte{nil, []byte("2"), []byte("c1")}, values)
+	assert.Equal(t, []error{ErrNotFound, nil, nil}, errs)
+	assert.Equal(t, []error{ErrReadOnly}, s.SetMulti([]KV{{Key: []byte("k")}}))
+	assert.NoError(t, s.Close())
+}
+
+func TestConcurrentGet(t *testing.T) {
+	s, err := Open(Dir("rlock"), FS(NewMemFS()), ChunksTotal(2), ChunksCollision(1))
+	assert.NoError(t, err)
+	past := uint32(time.Now().Unix() - 1)
+	for i := 0; i < 100; i++ {
+		expire := uint32(0)
+		if i%2 == 1 {
+			expire = past
+		}
+		assert.NoError(t, s.Set([]byte(strconv.Itoa(i)), []byte(strconv.Itoa(i)), expire))
+	}
+	assert.Equal(t, 100, s.Count())
+
+	// readers of chunk run concurrently, expired keys are removed after read
+	var wg sync.WaitGroup
+	for g := 0; g < 8; g++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 100; i++ {
+				v, err := s.Get([]byte(strconv.Itoa(i)))
+				if i%2 == 1 {
+					assert.Equal(t, ErrNotFound, err)
+					continue
+				}
+				assert.NoError(t, err)
+				assert.Equal(t, []byte(strconv.Itoa(i)), v)
+			}
+		}()
+	}
+	wg.Wait()
+	assert.Equal(t, 50, s.Count())
+	assert.NoError(t, s.Close())
+}
+
+// test run only when set enviroment variable "TESTCHUNK"
+// test use prepared chunk file "testchunk"
+func TestExpireChunk(t *testing.T) {
+	if os.Getenv("TESTCHUNK") == "" {
+		t.SkipNow()
+	}
+	ch := chunk{fs: OSFS}
+	err := ch.init("testchunk")
+	assert.NoError(t, err)
+
+	keys1 := ch.count()
+	t.Logf("before expire keys count %d", keys1)
+
+	newtime := time.Now().Add(time.Hour * 168)
+	// shift time forward by week force expire delete old keys
+	patch := monkey.Patch(time.Now, func() time.Time { return newtime })
+	ch.expirekeys(0)
+	patch.Unpatch()
+	keys2 := ch.count()
+	t.Logf("after expire keys count %d", keys2)
+	assert.Less(t, keys2, keys1, "Expire not work")
+
+	err = ch.close()
+	assert.NoError(t, err)
+}
+
+// BenchmarkHotChunkGet - parallel reads of keys in one chunk (and collision chunk)
+// with shared and exclusive lock of chunk, run with: go test -run - -bench HotChunk -cpu 1,4,16
+func BenchmarkHotChunkGet(b *testing.B) {
+	s, err := Open(Dir(b.TempDir()), ChunksTotal(2), ChunksCollision(1))
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer s.Close()
+	keys := make([][]byte, 100000)
+	for i := range keys {
+		keys[i] = []byte(strconv.Itoa(i))
+		err = s.Set(keys[i], keys[i], 0)
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+	// baseline: read under exclusive lock of chunk, as before shared reads
+	exclusive := func(k []byte) error {
+		h := hash(k)
+		c := &s.chunks[s.idx(h)]
+		c.Lock()
+		_, _, err := c.load_key(k, h)
+		c.Unlock()
+		if err == ErrCollision {
+			_, err = s.Get(k)
+		}
+		return err
+	}
+	shared := func(k []byte) error {
+		_, err := s.Get(k)
+		return err
+	}
+	for _, bench := range []struct {
+		name string
+		get  func(k []byte) error
+	}{{"exclusive", exclusive}, {"shared", shared}} {
+		b.Run(bench.name, func(b *testing.B) {
+			b.RunParallel(func(pb *testing.PB) {
+				i := rand.Intn(len(keys))
+				for pb.Next() {
+					i = (i + 1) % len(keys)
+					if err := bench.get(keys[i]); err != nil {
+						b.Error(err)
+						return
+					}
+				}
+			})
+		})
+	}
 }
@@ -0,0 +1,441 @@
+package sniper
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"time"
+)
+
+// problem kinds
+const (
+	ProblemHeader    = "bad header"
+	ProblemOverlap   = "overlapping record"
+	ProblemTail      = "truncated tail"
+	ProblemChecksum  = "checksum mismatch"
+	ProblemBlob      = "damaged blob value" // value in blob file is lost or do not match checksum
+	ProblemDuplicate = "duplicate key"
+	ProblemVersion   = "unknown version"
+	ProblemHole      = "orphaned hole" // hole in hint overlap live record or run past end of chunk
+)
+
+// chunkName match chunk file name: number with optional prefix
+// and generation of resharded store
+var chunkName = regexp.MustCompile(`^(?:(.+)-)?[0-9]+(?:\.g[0-9]+)?$`)
+
+// Problem - damage, found in chunk file
+type Problem struct {
+	File   string
+	Offset int64
+	Kind   string
+	Repair string // what was done, if repaired
+}
+
+func (p Problem) String() string {
+	s := fmt.Sprintf("%s:%d: %s", p.File, p.Offset, p.Kind)
+	if p.Repair != "" {
+		s += " (" + p.Repair + ")"
+	}
+	return s
+}
+
+// Report - result of chunks verification
+type Report struct {
+	Files     int   // chunk files
+	Records   int   // live records
+	Holes     int   // deleted and expired records, space reused by records of same size
+	HoleBytes int64 // size of holes
+	Problems  []Problem
+}
+
+// OK return true if no problems found
+func (r *Report) OK() bool {
+	return len(r.Problems) == 0
+}
+
+// scanned record in chunk file
+type scanRecord struct {
+	off    int64
+	header *Header
+	live   bool
+	bad    bool // damaged record
+}
+
+// chunkScan - result of chunk file scan
+type chunkScan struct {
+	version  int
+	size     int64
+	records  []scanRecord
+	end      int64 // end of last readable record, file is damaged after it
+	problems []Problem
+	holes    []Problem // orphaned holes of hint, fixed by hint removal
+}
+
+// scanChunk read records from chunk file one by one and check them
+func scanChunk(fs VFS, name string) (cs *chunkScan, err error) {
+	f, err := fs.OpenFile(name, os.O_RDONLY, 0)
+	if err != nil {
+		return
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return
+	}
+	cs = &chunkScan{size: fi.Size()}
+	if cs.size < 2 {
+		cs.problems = append(cs.problems, Problem{File: name, Kind: ProblemTail})
+		return
+	}
+	b := make([]byte, 2)
+	_, err = f.ReadAt(b, 0)
+	if err != nil {
+		return nil, err
+	}
+	off := int64(2)
+	switch {
+	case b[0] == versionMarker && b[1] != 0 && b[1] != deleted:
+		cs.version = int(b[1])
+	case b[1] == 0 || b[1] == deleted:
+		cs.version = 0
+		if b[0] != versionMarker {
+			off = 0
+		}
+	default:
+		cs.version = -1
+	}
+	if _, ok := sizeHeaders[cs.version]; !ok {
+		cs.problems = append(cs.problems, Problem{File: name, Kind: ProblemVersion})
+		return
+	}
+	_, err = f.Seek(off, io.SeekStart)
+	if err != nil {
+		return nil, err
+	}
+	// values of overflow records are checked in blob file
+	blob, err := fs.OpenFile(name+".blob", os.O_RDONLY, 0)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	if blob != nil {
+		defer blob.Close()
+	}
+	r := bufio.NewReader(f)
+	cs.end = off
+	head := int64(sizeHeaders[cs.version])
+	now := time.Now().Unix()
+	seen := make(map[string]int) // key / index of live record
+	packet := make([]byte, 1<<12)
+	for off < cs.size {
+		problem := func(kind string) {
+			cs.problems = append(cs.problems, Problem{File: name, Offset: off, Kind: kind})
+		}
+		if off+head > cs.size {
+			problem(ProblemTail)
+			break
+		}
+		_, err = io.ReadFull(r, packet[:head])
+		if err != nil {
+			return nil, err
+		}
+		header, _ := parseHeaderOf(packet, cs.version)
+		if header.sizeb > 31 || header.status != 0 && header.status != overflow && header.status != deleted {
+			problem(ProblemHeader)
+			break
+		}
+		size := int64(1) << header.sizeb
+		if off+size > cs.size {
+			problem(ProblemTail)
+			break
+		}
+		if head+int64(header.vallen)+int64(header.keylen) > size {
+			// data overlap next record, slot size is unreliable
+			problem(ProblemOverlap)
+			break
+		}
+		if int64(len(packet)) < size {
+			packet = append(packet[:head], make([]byte, size-head)...)
+		}
+		_, err = io.ReadFull(r, packet[head:size])
+		if err != nil {
+			return nil, err
+		}
+		rec := scanRecord{off: off, header: header}
+		if cs.version >= 2 && checkRecord(packet[:size], cs.version) != nil {
+			if header.status != deleted {
+				problem(ProblemChecksum)
+				rec.bad = true
+			}
+		}
+		if !rec.bad && header.status == overflow {
+			errBlob := ErrCorrupted
+			if blob != nil {
+				_, errBlob = readBlob(blob, packet[head:head+int64(header.vallen)])
+			}
+			if errBlob == ErrCorrupted {
+				problem(ProblemBlob)
+				rec.bad = true
+			} else if errBlob != nil {
+				return nil, errBlob
+			}
+		}
+		rec.live = !rec.bad && header.status != deleted && (header.expire == 0 || int64(header.expire) >= now)
+		if rec.live {
+			key := string(packet[head+int64(header.vallen) : head+int64(header.vallen)+int64(header.keylen)])
+			if prev, ok := seen[key]; ok {
+				// last record wins, same as on Open
+				problem(ProblemDuplicate)
+				cs.records[prev].live = false
+				cs.records[prev].bad = true
+			}
+			seen[key] = len(cs.records)
+		}
+		cs.records = append(cs.records, rec)
+		off += size
+		cs.end = off
+	}
+	cs.holes, err = orphanHoles(fs, f, name, cs)
+	return
+}
+
+// orphanHoles check holes of chunk hint: every hole must be deleted
+// or expired record of same size inside readable part of chunk.
+// Hint, which do not match chunk, is ignored by Open and is not checked
+func orphanHoles(fs VFS, f File, name string, cs *chunkScan) (problems []Problem, err error) {
+	b, err := readFile(fs, hintName(name))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return
+	}
+	hd, ok := parseHint(b)
+	if !ok || !matchHint(f, hd, cs.size) {
+		return
+	}
+	limit := cs.end
+	if int64(hd.covered) < limit {
+		limit = int64(hd.covered)
+	}
+	byOff := make(map[int64]int, len(cs.records))
+	for i, rec := range cs.records {
+		byOff[rec.off] = i
+	}
+	for addr, size := range hd.holes {
+		i, ok := byOff[int64(addr)]
+		orphan := size > 31 || int64(addr)+int64(1)<<size > limit || !ok
+		if !orphan {
+			rec := cs.records[i]
+			orphan = rec.live || rec.header.sizeb != size
+		}
+		if orphan {
+			problems = append(problems, Problem{File: name, Offset: int64(addr), Kind: ProblemHole})
+		}
+	}
+	sort.Slice(problems, func(i, j int) bool { return problems[i].Offset < problems[j].Offset })
+	return
+}
+
+// chunkFiles return sorted chunk files in dir
+func chunkFiles(fs VFS, dir string) (files []string, err error) {
+	entries, err := fs.ReadDir(dir)
+	if err != nil {
+		return
+	}
+	for _, e := range entries {
+		if e.Type().IsRegular() && chunkName.MatchString(e.Name()) {
+			files = append(files, filepath.Join(dir, e.Name()))
+		}
+	}
+	sort.Strings(files)
+	return
+}
+
+// Verify scan all chunk files in dir and report damaged records:
+// bad headers, overlapping records, truncated tails, checksum mismatches,
+// duplicate keys and orphaned holes in hints. Store must be closed
+func Verify(dir string) (*Report, error) {
+	return verify(OSFS, dir, false, false)
+}
+
+// Repair verify chunk files in dir and fix problems.
+// Without salvage damaged tail is truncated and damaged
+// or duplicate records are marked as deleted.
+// With salvage every chunk with problems is rewritten in new file
+// with readable live records only. Hint with orphaned holes is removed.
+// Store must be closed
+func Repair(dir string, salvage bool) (*Report, error) {
+	return verify(OSFS, dir, true, salvage)
+}
+
+// VerifyFS - Verify for store, opened with FS option
+func VerifyFS(fs VFS, dir string) (*Report, error) {
+	return verify(fs, dir, false, false)
+}
+
+// RepairFS - Repair for store, opened with FS option
+func RepairFS(fs VFS, dir string, salvage bool) (*Report, error) {
+	return verify(fs, dir, true, salvage)
+}
+
+func verify(fs VFS, dir string, repair, salvage bool) (report *Report, err error) {
+	files, err := chunkFiles(fs, dir)
+	if err != nil {
+		return
+	}
+	if repair {
+		locks, err := lockDir(fs, dir, files)
+		if err != nil {
+			return nil, err
+		}
+		defer unlockDir(locks)
+	}
+	return verifyFiles(fs, files, repair, salvage)
+}
+
+// verifyFiles verify and repair chunk files, store must be closed
+func verifyFiles(fs VFS, files []string, repair, salvage bool) (report *Report, err error) {
+	report = &Report{}
+	for _, name := range files {
+		cs, err := scanChunk(fs, name)
+		if err != nil {
+			return nil, err
+		}
+		report.Files++
+		for _, rec := range cs.records {
+			if rec.live {
+				report.Records++
+			} else if !rec.bad {
+				report.Holes++
+				report.HoleBytes += 1 << rec.header.sizeb
+			}
+		}
+		repaired := false
+		if repair && len(cs.problems) > 0 && cs.version >= 0 {
+			var how string
+			if salvage {
+				how, err = salvageChunk(fs, name, cs)
+			} else {
+				how, err = repairChunk(fs, name, cs)
+			}
+			if err != nil {
+				return nil, err
+			}
+			for i := range cs.problems {
+				cs.problems[i].Repair = how
+			}
+			repaired = true
+		}
+		if repair && len(cs.holes) > 0 {
+			for i := range cs.holes {
+				cs.holes[i].Repair = "hint removed"
+			}
+			repaired = true
+		}
+		if repaired {
+			// index in hint do not match repaired chunk
+			err = fs.Remove(hintName(name))
+			if err != nil && !os.IsNotExist(err) {
+				return nil, err
+			}
+			err = fs.SyncDir(filepath.Dir(name))
+			if err != nil {
+				return nil, err
+			}
+		}
+		report.Problems = append(report.Problems, cs.problems...)
+		report.Problems = append(report.Problems, cs.holes...)
+	}
+	return
+}
+
+// repairChunk truncate damaged tail and mark damaged records as deleted
+func repairChunk(fs VFS, name string, cs *chunkScan) (how string, err error) {
+	f, err := fs.OpenFile(name, os.O_RDWR, os.FileMode(fileMode))
+	if err != nil {
+		return
+	}
+	defer f.Close()
+	for _, rec := range cs.records {
+		if rec.bad {
+			_, err = f.WriteAt([]byte{deleted}, rec.off+1)
+			if err != nil {
+				return
+			}
+		}
+	}
+	how = "marked deleted"
+	if cs.end < cs.size {
+		err = f.Truncate(cs.end)
+		if err != nil {
+			return
+		}
+		how = fmt.Sprintf("truncated at %d", cs.end)
+	}
+	return how, f.Sync()
+}
+
+// salvageChunk write live records in new chunk and replace old chunk with it
+func salvageChunk(fs VFS, name string, cs *chunkScan) (how string, err error) {
+	old, err := fs.OpenFile(name, os.O_RDONLY, 0)
+	if err != nil {
+		return
+	}
+	defer old.Close()
+	newname := name + ".salvage"
+	f, err := fs.OpenFile(newname, os.O_CREATE|os.O_RDWR|os.O_TRUNC, os.FileMode(fileMode))
+	if err != nil {
+		return
+	}
+	w := bufio.NewWriter(f)
+	_, err = w.Write([]byte{versionMarker, currentChunkVersion})
+	head := int64(sizeHeaders[cs.version])
+	cnt := 0
+	for _, rec := range cs.records {
+		if !rec.live || err != nil {
+			continue
+		}
+		b := make([]byte, 1<<rec.header.sizeb)
+		_, err = old.ReadAt(b, rec.off)
+		if err != nil {
+			break
+		}
+		val := b[head : head+int64(rec.header.vallen)]
+		key := b[head+int64(rec.header.vallen) : head+int64(rec.header.vallen)+int64(rec.header.keylen)]
+		ver := rec.header.ver
+		if ver == 0 {
+			// records of old chunk have no version
+			ver = uint64(time.Now().UnixNano())
+		}
+		header, packet := packetMarshal(key, val, rec.header.expire, ver)
+		if rec.header.status == overflow {
+			// keep blob ref, blob file is not changed
+			header.status = overflow
+			sealPacket(packet, header)
+		}
+		_, err = w.Write(packet)
+		cnt++
+	}
+	if err == nil {
+		err = w.Flush()
+	}
+	if err == nil {
+		err = f.Sync()
+	}
+	if errClose := f.Close(); err == nil {
+		err = errClose
+	}
+	if err != nil {
+		fs.Remove(newname)
+		return
+	}
+	err = fs.Rename(newname, name)
+	if err != nil {
+		return
+	}
+	return fmt.Sprintf("salvaged %d records", cnt), fs.SyncDir(filepath.Dir(name))
+}
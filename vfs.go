@@ -0,0 +1,158 @@
+package sniper
+
+import (
+	"io"
+	"os"
+)
+
+// File - file of store, *os.File implements it
+type File interface {
+	io.Reader
+	io.Writer
+	io.ReaderAt
+	io.WriterAt
+	io.Seeker
+	io.Closer
+	Stat() (os.FileInfo, error)
+	Sync() error
+	Truncate(size int64) error
+}
+
+// VFS - file system, where store keep its files.
+// Errors must be compatible with os errors: os.IsNotExist must
+// be true for missing file
+type VFS interface {
+	// OpenFile open file with os flags
+	OpenFile(name string, flag int, perm os.FileMode) (File, error)
+	Stat(name string) (os.FileInfo, error)
+	Remove(name string) error
+	Rename(oldname, newname string) error
+	MkdirAll(path string, perm os.FileMode) error
+	// ReadDir return entries of directory, sorted by name
+	ReadDir(dir string) ([]os.DirEntry, error)
+	// SyncDir commit directory entries (created, renamed or removed files)
+	SyncDir(dir string) error
+	// Lock lock name exclusive or shared, return ErrLocked if lock is held
+	// by other store. Lock is released by Close
+	Lock(name string, exclusive bool) (io.Closer, error)
+}
+
+// OSFS - operating system file system, default
+var OSFS VFS = osFS{}
+
+// FS - file system for store files, default OSFS
+func FS(fs VFS) OptStore {
+	return func(s *Store) error {
+		s.fs = fs
+		return nil
+	}
+}
+
+type osFS struct{}
+
+func (osFS) OpenFile(name string, flag int, perm os.FileMode) (File, error) {
+	f, err := os.OpenFile(name, flag, perm)
+	if err != nil {
+		// nil *os.File must not become non nil File
+		return nil, err
+	}
+	return f, nil
+}
+
+func (osFS) Stat(name string) (os.FileInfo, error) {
+	return os.Stat(name)
+}
+
+func (osFS) Remove(name string) error {
+	return os.Remove(name)
+}
+
+func (osFS) Rename(oldname, newname string) error {
+	return os.Rename(oldname, newname)
+}
+
+func (osFS) MkdirAll(path string, perm os.FileMode) error {
+	return os.MkdirAll(path, perm)
+}
+
+func (osFS) ReadDir(dir string) ([]os.DirEntry, error) {
+	return os.ReadDir(dir)
+}
+
+func (osFS) SyncDir(dir string) error {
+	return syncDir(dir)
+}
+
+// Lock lock file with flock, file is created if missing, also for
+// shared lock: writer, opened later, must see lock of reader
+func (osFS) Lock(name string, exclusive bool) (io.Closer, error) {
+	flag := os.O_CREATE | os.O_RDWR
+	if !exclusive {
+		flag = os.O_CREATE | os.O_RDONLY
+	}
+	f, err := os.OpenFile(name, flag, os.FileMode(fileMode))
+	if err != nil {
+		return nil, err
+	}
+	err = lockFile(f, exclusive)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return fileLock{f}, nil
+}
+
+// fileLock - locked file, unlocked on close
+type fileLock struct {
+	f *os.File
+}
+
+func (l fileLock) Close() error {
+	err := unlockFile(l.f)
+	if errClose := l.f.Close(); err == nil {
+		err = errClose
+	}
+	return err
+}
+
+// errFile - file, which return err on every operation. It replace file
+// of chunk, which can't be reopened, until store is reopened
+type errFile struct {
+	err error
+}
+
+func (f errFile) Read(b []byte) (int, error)                   { return 0, f.err }
+func (f errFile) Write(b []byte) (int, error)                  { return 0, f.err }
+func (f errFile) ReadAt(b []byte, off int64) (int, error)      { return 0, f.err }
+func (f errFile) WriteAt(b []byte, off int64) (int, error)     { return 0, f.err }
+func (f errFile) Seek(offset int64, whence int) (int64, error) { return 0, f.err }
+func (f errFile) Close() error                                 { return nil }
+func (f errFile) Stat() (os.FileInfo, error)                   { return nil, f.err }
+func (f errFile) Sync() error                                  { return f.err }
+func (f errFile) Truncate(size int64) error                    { return f.err }
+
+// readFile read whole file from fs
+func readFile(fs VFS, name string) ([]byte, error) {
+	f, err := fs.OpenFile(name, os.O_RDONLY, 0)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return io.ReadAll(f)
+}
+
+// writeFile create or truncate file and write b in it, file is synced
+func writeFile(fs VFS, name string, b []byte) (err error) {
+	f, err := fs.OpenFile(name, os.O_CREATE|os.O_RDWR|os.O_TRUNC, os.FileMode(fileMode))
+	if err != nil {
+		return
+	}
+	_, err = f.Write(b)
+	if err == nil {
+		err = f.Sync()
+	}
+	if errClose := f.Close(); err == nil {
+		err = errClose
+	}
+	return
+}
@@ -0,0 +1,343 @@
+package sniper
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/tidwall/interval"
+)
+
+// DurabilityMode - how write ahead log is synced to disk
+type DurabilityMode int
+
+const (
+	// SyncEveryWrite - fsync log on every write
+	SyncEveryWrite DurabilityMode = iota + 1
+	// GroupCommit - concurrent writes share one fsync
+	GroupCommit
+	// Interval - fsync log every SyncInterval (default 1s),
+	// last writes may be lost on power loss
+	Interval
+)
+
+// walMaxSize - log size, which trigger checkpoint
+const walMaxSize = 64 << 20
+
+// opTouch - touch operation in log
+const opTouch = 4
+
+// wal - write ahead log, every mutation is appended in log
+// before it will be written in chunk, so torn writes in chunks
+// are fixed by log replay on Open. Log is truncated on checkpoint,
+// after all chunks are synced
+type wal struct {
+	sync.Mutex
+	f       File
+	mode    DurabilityMode
+	size    int64  // log length
+	written uint64 // last appended record
+	synced  uint64 // last synced record
+	syncing bool   // fsync in progress
+	cond    *sync.Cond
+
+	ckpt       sync.RWMutex // writers hold read lock, checkpoint hold write lock
+	inckpt     int32        // background checkpoint is running
+	checkpoint func() error
+	fail       func(error) error // put store in failed state
+	iv         interval.Interval
+}
+
+// Durability - enable write ahead log with mode
+// SyncEveryWrite, GroupCommit or Interval, default - log disabled
+func Durability(mode DurabilityMode) OptStore {
+	return func(s *Store) error {
+		if mode < SyncEveryWrite || mode > Interval {
+			return fmt.Errorf("unknown durability mode %d", mode)
+		}
+		s.durability = mode
+		return nil
+	}
+}
+
+// append write record with operations in log and wait fsync,
+// according durability mode
+func (w *wal) append(ops []batchOp) (err error) {
+	rec := frameRecord(encodeOps(ops))
+	w.Lock()
+	defer w.Unlock()
+	_, err = w.f.WriteAt(rec, w.size)
+	if err != nil {
+		// cut partial record, next records must stay readable
+		if errTrunc := w.f.Truncate(w.size); errTrunc != nil {
+			return fmt.Errorf("%s: %w", errTrunc.Error(), err)
+		}
+		return
+	}
+	w.size += int64(len(rec))
+	w.written++
+	seq := w.written
+
+	switch w.mode {
+	case SyncEveryWrite:
+		err = w.f.Sync()
+		if err == nil {
+			w.synced = seq
+		}
+	case GroupCommit:
+		err = w.waitSync(seq)
+	}
+	if err != nil {
+		// record may be on disk or not, it is replayed on next Open
+		return w.fail(err)
+	}
+	if w.size > walMaxSize && atomic.CompareAndSwapInt32(&w.inckpt, 0, 1) {
+		go func() {
+			// error is returned by next write and Close
+			if err := w.checkpoint(); err != nil {
+				w.fail(err)
+			}
+			atomic.StoreInt32(&w.inckpt, 0)
+		}()
+	}
+	return
+}
+
+// waitSync wait until record seq is synced, first waiter
+// do fsync for all records appended at the moment
+// must be called with locked wal
+func (w *wal) waitSync(seq uint64) error {
+	for w.synced < seq {
+		if w.syncing {
+			w.cond.Wait()
+			continue
+		}
+		w.syncing = true
+		target := w.written
+		w.Unlock()
+		err := w.f.Sync()
+		w.Lock()
+		w.syncing = false
+		w.cond.Broadcast()
+		if err != nil {
+			return err
+		}
+		if target > w.synced {
+			w.synced = target
+		}
+	}
+	return nil
+}
+
+// sync - fsync all appended records, failed fsync put store in failed state
+func (w *wal) sync() error {
+	w.Lock()
+	defer w.Unlock()
+	err := w.waitSync(w.written)
+	if err != nil {
+		return w.fail(err)
+	}
+	return nil
+}
+
+// truncate - remove all records from log
+func (w *wal) truncate() (err error) {
+	w.Lock()
+	defer w.Unlock()
+	err = w.f.Truncate(0)
+	if err != nil {
+		return
+	}
+	err = w.f.Sync()
+	if err != nil {
+		return
+	}
+	w.size = 0
+	w.synced = w.written
+	return
+}
+
+// openWAL open log, chunks will be recovered from it after init
+func (s *Store) openWAL() (err error) {
+	f, err := s.fs.OpenFile(s.filename("wal.log"), os.O_CREATE|os.O_RDWR, os.FileMode(fileMode))
+	if err != nil {
+		return
+	}
+	s.wal = &wal{f: f, mode: s.durability, checkpoint: s.checkpoint, fail: s.fail}
+	s.wal.cond = sync.NewCond(&s.wal.Mutex)
+	return
+}
+
+// replayWAL apply all records from log in chunks
+// log is read until first damaged record, the rest is torn write
+func (s *Store) replayWAL() (err error) {
+	_, err = s.wal.f.Seek(0, io.SeekStart)
+	if err != nil {
+		return
+	}
+	r := bufio.NewReader(s.wal.f)
+	for {
+		payload, errRead := readRecord(r)
+		if errRead != nil {
+			break
+		}
+		ops, errDecode := decodeOps(payload)
+		if errDecode != nil {
+			return errDecode
+		}
+		for _, op := range ops {
+			if isBucketOp(op.op) {
+				err = s.applyBucketOp(op)
+				if err != nil {
+					return
+				}
+				continue
+			}
+			if op.chunk < 0 || op.chunk >= len(s.chunks) {
+				return fmt.Errorf("log record for chunk %d: %w", op.chunk, ErrFormat)
+			}
+			c := &s.chunks[op.chunk]
+			h := hash(op.key)
+			c.Lock()
+			switch op.op {
+			case opSet:
+				err = c.write_key(op.key, op.val, h, op.expire, 0)
+			case opDelete:
+				_, err = c.delete_key(op.key, h)
+			case opTouch:
+				err = c.touch_key(op.key, h, op.expire)
+			}
+			c.Unlock()
+			// operation failed same way, when it was logged
+			if err == ErrCollision || err == ErrNotFound {
+				err = nil
+			}
+			if err != nil {
+				return
+			}
+		}
+	}
+	return s.checkpoint()
+}
+
+// checkpoint - sync all chunks, write hints and truncate log
+// failed store keep log, it will be replayed on next Open
+func (s *Store) checkpoint() (err error) {
+	s.RLock()
+	defer s.RUnlock()
+	s.wal.ckpt.Lock()
+	defer s.wal.ckpt.Unlock()
+	return s.flushChunks()
+}
+
+// flushChunks sync all chunks, write hints and truncate log,
+// store and checkpoint must be locked
+func (s *Store) flushChunks() (err error) {
+	err = s.writable()
+	if err != nil {
+		return
+	}
+	for i := range s.chunks {
+		c := &s.chunks[i]
+		c.Lock()
+		c.needFsync = false
+		err = c.sync()
+		if err == nil {
+			err = c.writeHint()
+		}
+		c.Unlock()
+		if err != nil {
+			return
+		}
+	}
+	// buckets index must be on disk before log is truncated
+	err = s.syncBuckets()
+	if err != nil {
+		return
+	}
+	return s.wal.truncate()
+}
+
+// startWAL - start log sync in Interval mode
+func (s *Store) startWAL() {
+	if s.durability == Interval {
+		interv := s.syncInterval
+		if interv <= 0 {
+			interv = time.Second
+		}
+		s.wal.iv = interval.Set(func(t time.Time) {
+			// failed fsync put store in failed state,
+			// error is returned by next write and Close
+			s.wal.sync()
+		}, interv)
+	}
+}
+
+// closeWAL - do checkpoint and close log, log is closed on checkpoint error too
+func (s *Store) closeWAL() (err error) {
+	if s.durability == Interval {
+		s.wal.iv.Clear()
+	}
+	err = s.checkpoint()
+	errClose := s.wal.f.Close()
+	if err == nil {
+		err = errClose
+	}
+	return
+}
+
+// wlock - lock chunk for write, checkpoint wait until write is done
+func (c *chunk) wlock() {
+	if c.wal != nil {
+		c.wal.ckpt.RLock()
+	}
+	c.Lock()
+}
+
+// wunlock - unlock chunk, locked with wlock
+func (c *chunk) wunlock() {
+	c.Unlock()
+	if c.wal != nil {
+		c.wal.ckpt.RUnlock()
+	}
+}
+
+// syncLog - in Interval mode log is synced before record is overwritten
+// in place, so torn overwrite is always fixed by replay of log record
+func (c *chunk) syncLog() error {
+	if c.wal == nil || c.wal.mode != Interval {
+		return nil
+	}
+	return c.wal.sync()
+}
+
+// applied return error of operation, which was applied after it was logged.
+// Logged operation is replayed on next Open, so failed apply put store in failed
+// state, same way as failed batch, and caller get ErrFailed. Collision and missing
+// key fail same way on replay, they are returned as is
+func (c *chunk) applied(err error) error {
+	if err == nil || c.wal == nil || err == ErrCollision || err == ErrNotFound {
+		return err
+	}
+	return c.wal.fail(err)
+}
+
+// logOp append operation in log, if log is enabled
+func (c *chunk) logOp(op batchOp) error {
+	return c.logOps([]batchOp{op})
+}
+
+// logOps append operations of chunk in log as one record
+func (c *chunk) logOps(ops []batchOp) error {
+	if c.wal == nil {
+		return nil
+	}
+	for i := range ops {
+		ops[i].chunk = c.id
+	}
+	return c.wal.append(ops)
+}